@@ -0,0 +1,102 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/rcanderson23/connectionWatcher/connections"
+)
+
+// Server serves the blocks and decisions of the IPBlocker as JSON. The main loop owns the IPBlocker, so it publishes
+// them with SetBlocks and SetDecisions rather than the Server reading them while they change.
+type Server struct {
+	// Monitor is true if the IPBlocker is in monitor mode and nothing is blocked
+	Monitor bool
+
+	mu        sync.RWMutex
+	blocks    []connections.Block
+	decisions []connections.Decision
+}
+
+// BlocksResponse is the response of GET /api/v1/blocks
+type BlocksResponse struct {
+	Monitor bool                `json:"monitor"`
+	Blocks  []connections.Block `json:"blocks"`
+}
+
+// VerdictsResponse is the response of GET /api/v1/verdicts, the recent decisions oldest first
+type VerdictsResponse struct {
+	Monitor  bool                   `json:"monitor"`
+	Verdicts []connections.Decision `json:"verdicts"`
+}
+
+// SetBlocks replaces the blocks served
+func (s *Server) SetBlocks(blocks []connections.Block) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.blocks = blocks
+}
+
+// SetDecisions replaces the decisions served
+func (s *Server) SetDecisions(decisions []connections.Decision) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.decisions = decisions
+}
+
+// Handler returns the handler of every API endpoint
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/blocks", s.serveBlocks)
+	mux.HandleFunc("/api/v1/verdicts", s.serveVerdicts)
+	return mux
+}
+
+func (s *Server) serveBlocks(w http.ResponseWriter, r *http.Request) {
+	if !allowGet(w, r) {
+		return
+	}
+
+	s.mu.RLock()
+	resp := BlocksResponse{Monitor: s.Monitor, Blocks: s.blocks}
+	s.mu.RUnlock()
+	if resp.Blocks == nil {
+		resp.Blocks = []connections.Block{}
+	}
+
+	writeJSON(w, resp)
+}
+
+func (s *Server) serveVerdicts(w http.ResponseWriter, r *http.Request) {
+	if !allowGet(w, r) {
+		return
+	}
+
+	s.mu.RLock()
+	resp := VerdictsResponse{Monitor: s.Monitor, Verdicts: s.decisions}
+	s.mu.RUnlock()
+	if resp.Verdicts == nil {
+		resp.Verdicts = []connections.Decision{}
+	}
+
+	writeJSON(w, resp)
+}
+
+// allowGet responds 405 to any method but GET and returns false if it did
+func allowGet(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, resp interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("Failed to write API response: %v", err)
+	}
+}
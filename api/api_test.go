@@ -0,0 +1,77 @@
+package api
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/rcanderson23/connectionWatcher/connections"
+)
+
+func TestServer_blocks(t *testing.T) {
+	blocks := []connections.Block{
+		{Network: "192.0.2.1/32", Reason: connections.ReasonPortScan, Ports: []uint16{22, 80, 443}, BlockedAt: 100, Expires: 3700},
+		{Network: "198.51.100.0/24", Reason: connections.ReasonDenylist, BlockedAt: 50},
+	}
+
+	tests := []struct {
+		name       string
+		method     string
+		blocks     []connections.Block
+		wantStatus int
+		want       []connections.Block
+	}{
+		{name: "blocks", method: http.MethodGet, blocks: blocks, wantStatus: http.StatusOK, want: blocks},
+		{name: "no blocks", method: http.MethodGet, wantStatus: http.StatusOK, want: []connections.Block{}},
+		{name: "post", method: http.MethodPost, blocks: blocks, wantStatus: http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{}
+			s.SetBlocks(tt.blocks)
+
+			rec := httptest.NewRecorder()
+			s.Handler().ServeHTTP(rec, httptest.NewRequest(tt.method, "/api/v1/blocks", nil))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+
+			var got BlocksResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+			if !reflect.DeepEqual(got.Blocks, tt.want) {
+				t.Errorf("blocks = %+v, want %+v", got.Blocks, tt.want)
+			}
+		})
+	}
+}
+
+func TestServer_verdicts(t *testing.T) {
+	decisions := []connections.Decision{
+		{IP: net.ParseIP("192.0.2.1"), Reason: connections.ReasonPortScan, Severity: "medium", Action: connections.ActionWouldBlock, Time: 100},
+	}
+
+	s := &Server{Monitor: true}
+	s.SetDecisions(decisions)
+
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/verdicts", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	var got VerdictsResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if !got.Monitor || !reflect.DeepEqual(got.Verdicts, decisions) {
+		t.Errorf("verdicts = %+v, want monitor %+v", got, decisions)
+	}
+}
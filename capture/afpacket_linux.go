@@ -0,0 +1,128 @@
+//go:build linux
+// +build linux
+
+package capture
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// snapLen is the number of bytes kept of each packet, enough for the IP and TCP headers
+	snapLen = 128
+	// skfAdProtocol is SKF_AD_OFF + SKF_AD_PROTOCOL, loading it returns the ethertype of the packet
+	skfAdProtocol = 0xfffff000
+)
+
+// synRstFilter is a classic BPF program for a SOCK_DGRAM packet socket that only accepts TCP segments with SYN or RST
+// set, so established traffic never leaves the kernel
+var synRstFilter = []syscall.SockFilter{
+	/* 0 */ *syscall.LsfStmt(syscall.BPF_LD|syscall.BPF_W|syscall.BPF_ABS, skfAdProtocol),
+	/* 1 */ *syscall.LsfJump(syscall.BPF_JMP|syscall.BPF_JEQ|syscall.BPF_K, etherTypeIPv4, 0, 7),
+	// ipv4, skip non-tcp and non-first fragments
+	/* 2 */ *syscall.LsfStmt(syscall.BPF_LD|syscall.BPF_B|syscall.BPF_ABS, 9),
+	/* 3 */ *syscall.LsfJump(syscall.BPF_JMP|syscall.BPF_JEQ|syscall.BPF_K, ipProtoTCP, 0, 11),
+	/* 4 */ *syscall.LsfStmt(syscall.BPF_LD|syscall.BPF_H|syscall.BPF_ABS, 6),
+	/* 5 */ *syscall.LsfJump(syscall.BPF_JMP|syscall.BPF_JSET|syscall.BPF_K, 0x1fff, 9, 0),
+	/* 6 */ *syscall.LsfStmt(syscall.BPF_LDX|syscall.BPF_B|syscall.BPF_MSH, 0),
+	/* 7 */ *syscall.LsfStmt(syscall.BPF_LD|syscall.BPF_B|syscall.BPF_IND, 13),
+	/* 8 */ *syscall.LsfJump(syscall.BPF_JMP|syscall.BPF_JSET|syscall.BPF_K, FlagSYN|FlagRST, 5, 6),
+	// ipv6 without extension headers
+	/* 9 */ *syscall.LsfJump(syscall.BPF_JMP|syscall.BPF_JEQ|syscall.BPF_K, etherTypeIPv6, 0, 5),
+	/* 10 */ *syscall.LsfStmt(syscall.BPF_LD|syscall.BPF_B|syscall.BPF_ABS, 6),
+	/* 11 */ *syscall.LsfJump(syscall.BPF_JMP|syscall.BPF_JEQ|syscall.BPF_K, ipProtoTCP, 0, 3),
+	/* 12 */ *syscall.LsfStmt(syscall.BPF_LD|syscall.BPF_B|syscall.BPF_ABS, 53),
+	/* 13 */ *syscall.LsfJump(syscall.BPF_JMP|syscall.BPF_JSET|syscall.BPF_K, FlagSYN|FlagRST, 0, 1),
+	/* 14 */ *syscall.LsfStmt(syscall.BPF_RET|syscall.BPF_K, snapLen),
+	/* 15 */ *syscall.LsfStmt(syscall.BPF_RET|syscall.BPF_K, 0),
+}
+
+// Capture reads TCP handshake packets from an AF_PACKET socket on every interface and hands them to a Tracker
+type Capture struct {
+	Tracker *Tracker
+
+	fd   int
+	once sync.Once
+	done chan struct{}
+}
+
+// Open returns a pointer to a Capture feeding tr. Requires CAP_NET_RAW.
+func Open(tr *Tracker) (*Capture, error) {
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, int(htons(syscall.ETH_P_ALL)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open packet socket: %v", err)
+	}
+
+	if err := syscall.AttachLsf(fd, synRstFilter); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("failed to attach packet filter: %v", err)
+	}
+
+	// wake up every second so Close is noticed
+	tv := syscall.NsecToTimeval(time.Second.Nanoseconds())
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("failed to set packet socket timeout: %v", err)
+	}
+
+	return &Capture{
+		Tracker: tr,
+		fd:      fd,
+		done:    make(chan struct{}),
+	}, nil
+}
+
+// Run reads packets until Close is called
+func (c *Capture) Run() error {
+	defer syscall.Close(c.fd)
+
+	buf := make([]byte, snapLen)
+	for {
+		select {
+		case <-c.done:
+			return nil
+		default:
+		}
+
+		n, from, err := syscall.Recvfrom(c.fd, buf, 0)
+		if err == syscall.EAGAIN || err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read packet: %v", err)
+		}
+
+		sll, ok := from.(*syscall.SockaddrLinklayer)
+		if !ok {
+			continue
+		}
+
+		seg, err := decodeIP(ntohs(sll.Protocol), buf[:n])
+		if err != nil {
+			if err != errNotTCP {
+				log.Printf("failed to decode packet: %v", err)
+			}
+			continue
+		}
+
+		c.Tracker.Handle(seg, sll.Pkttype == syscall.PACKET_OUTGOING, time.Now().Unix())
+	}
+}
+
+// Close stops Run and releases the socket
+func (c *Capture) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return nil
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
+
+func ntohs(v uint16) uint16 {
+	return htons(v)
+}
@@ -0,0 +1,26 @@
+//go:build !linux
+// +build !linux
+
+package capture
+
+import "errors"
+
+// Capture reads TCP handshake packets from an AF_PACKET socket, only supported on linux
+type Capture struct {
+	Tracker *Tracker
+}
+
+// Open always fails outside of linux
+func Open(tr *Tracker) (*Capture, error) {
+	return nil, errors.New("packet capture is only supported on linux")
+}
+
+// Run always fails outside of linux
+func (c *Capture) Run() error {
+	return errors.New("packet capture is only supported on linux")
+}
+
+// Close is a no-op outside of linux
+func (c *Capture) Close() error {
+	return nil
+}
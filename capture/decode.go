@@ -0,0 +1,159 @@
+package capture
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// LinkType is the link layer header type of captured packets, values match the pcap LINKTYPE_ registry
+type LinkType uint32
+
+const (
+	LinkTypeEthernet LinkType = 1
+	LinkTypeRaw      LinkType = 101
+	LinkTypeLinuxSLL LinkType = 113
+	LinkTypeIPv4     LinkType = 228
+	LinkTypeIPv6     LinkType = 229
+)
+
+const (
+	etherTypeIPv4 = 0x0800
+	etherTypeIPv6 = 0x86dd
+	etherTypeVLAN = 0x8100
+
+	ipProtoTCP = 6
+
+	// TCP flags
+	FlagFIN = 0x01
+	FlagSYN = 0x02
+	FlagRST = 0x04
+	FlagACK = 0x10
+)
+
+// errNotTCP is returned for packets that are valid but not TCP, they are expected and skipped without logging
+var errNotTCP = errors.New("not a tcp packet")
+
+// Segment is the part of a TCP segment needed to follow a handshake
+type Segment struct {
+	SrcIP   net.IP
+	SrcPort uint16
+	DstIP   net.IP
+	DstPort uint16
+	Flags   uint8
+}
+
+// SYN reports if the segment opens a connection, a SYN without ACK
+func (s Segment) SYN() bool {
+	return s.Flags&FlagSYN != 0 && s.Flags&FlagACK == 0
+}
+
+// SYNACK reports if the segment accepts a connection
+func (s Segment) SYNACK() bool {
+	return s.Flags&FlagSYN != 0 && s.Flags&FlagACK != 0
+}
+
+// RST reports if the segment resets a connection
+func (s Segment) RST() bool {
+	return s.Flags&FlagRST != 0
+}
+
+// decodeLink strips the link layer header of linkType from b and returns the IP packet along with its ethertype
+func decodeLink(linkType LinkType, b []byte) ([]byte, uint16, error) {
+	switch linkType {
+	case LinkTypeEthernet:
+		if len(b) < 14 {
+			return nil, 0, fmt.Errorf("ethernet frame too short: %d", len(b))
+		}
+		etherType := binary.BigEndian.Uint16(b[12:14])
+		b = b[14:]
+		// a single 802.1Q tag is common on trunk ports
+		if etherType == etherTypeVLAN {
+			if len(b) < 4 {
+				return nil, 0, fmt.Errorf("vlan tag too short: %d", len(b))
+			}
+			etherType = binary.BigEndian.Uint16(b[2:4])
+			b = b[4:]
+		}
+		return b, etherType, nil
+	case LinkTypeLinuxSLL:
+		if len(b) < 16 {
+			return nil, 0, fmt.Errorf("linux cooked header too short: %d", len(b))
+		}
+		return b[16:], binary.BigEndian.Uint16(b[14:16]), nil
+	case LinkTypeRaw:
+		if len(b) == 0 {
+			return nil, 0, errors.New("empty packet")
+		}
+		if b[0]>>4 == 6 {
+			return b, etherTypeIPv6, nil
+		}
+		return b, etherTypeIPv4, nil
+	case LinkTypeIPv4:
+		return b, etherTypeIPv4, nil
+	case LinkTypeIPv6:
+		return b, etherTypeIPv6, nil
+	default:
+		return nil, 0, fmt.Errorf("unsupported link type: %d", linkType)
+	}
+}
+
+// decodeIP expects an IP packet of etherType and returns the TCP segment it carries. IPv6 packets with extension
+// headers and non-first IPv4 fragments are not decoded.
+func decodeIP(etherType uint16, b []byte) (Segment, error) {
+	var seg Segment
+	var tcp []byte
+
+	switch etherType {
+	case etherTypeIPv4:
+		if len(b) < 20 {
+			return Segment{}, fmt.Errorf("ipv4 header too short: %d", len(b))
+		}
+		if b[9] != ipProtoTCP {
+			return Segment{}, errNotTCP
+		}
+		if binary.BigEndian.Uint16(b[6:8])&0x1fff != 0 {
+			return Segment{}, errNotTCP
+		}
+		ihl := int(b[0]&0x0f) * 4
+		if ihl < 20 || len(b) < ihl {
+			return Segment{}, fmt.Errorf("invalid ipv4 header length: %d", ihl)
+		}
+		seg.SrcIP = net.IPv4(b[12], b[13], b[14], b[15])
+		seg.DstIP = net.IPv4(b[16], b[17], b[18], b[19])
+		tcp = b[ihl:]
+	case etherTypeIPv6:
+		if len(b) < 40 {
+			return Segment{}, fmt.Errorf("ipv6 header too short: %d", len(b))
+		}
+		if b[6] != ipProtoTCP {
+			return Segment{}, errNotTCP
+		}
+		seg.SrcIP = make(net.IP, net.IPv6len)
+		copy(seg.SrcIP, b[8:24])
+		seg.DstIP = make(net.IP, net.IPv6len)
+		copy(seg.DstIP, b[24:40])
+		tcp = b[40:]
+	default:
+		return Segment{}, errNotTCP
+	}
+
+	if len(tcp) < 14 {
+		return Segment{}, fmt.Errorf("tcp header too short: %d", len(tcp))
+	}
+	seg.SrcPort = binary.BigEndian.Uint16(tcp[0:2])
+	seg.DstPort = binary.BigEndian.Uint16(tcp[2:4])
+	seg.Flags = tcp[13]
+
+	return seg, nil
+}
+
+// Decode returns the TCP segment in a packet captured with linkType
+func Decode(linkType LinkType, b []byte) (Segment, error) {
+	ip, etherType, err := decodeLink(linkType, b)
+	if err != nil {
+		return Segment{}, err
+	}
+	return decodeIP(etherType, ip)
+}
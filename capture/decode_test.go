@@ -0,0 +1,126 @@
+package capture
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+// tcpHeader returns a minimal TCP header with only the ports and flags set
+func tcpHeader(srcPort, dstPort uint16, flags uint8) []byte {
+	b := make([]byte, 20)
+	b[0], b[1] = byte(srcPort>>8), byte(srcPort)
+	b[2], b[3] = byte(dstPort>>8), byte(dstPort)
+	b[12] = 5 << 4
+	b[13] = flags
+	return b
+}
+
+func ipv4Packet(src, dst net.IP, proto uint8, payload []byte) []byte {
+	b := make([]byte, 20)
+	b[0] = 0x45
+	b[9] = proto
+	copy(b[12:16], src.To4())
+	copy(b[16:20], dst.To4())
+	return append(b, payload...)
+}
+
+func ipv6Packet(src, dst net.IP, payload []byte) []byte {
+	b := make([]byte, 40)
+	b[0] = 6 << 4
+	b[6] = ipProtoTCP
+	copy(b[8:24], src.To16())
+	copy(b[24:40], dst.To16())
+	return append(b, payload...)
+}
+
+func ethernetFrame(etherType uint16, payload []byte) []byte {
+	b := make([]byte, 14)
+	b[12], b[13] = byte(etherType>>8), byte(etherType)
+	return append(b, payload...)
+}
+
+func TestDecode(t *testing.T) {
+	remote4, local4 := net.IPv4(10, 0, 0, 2), net.IPv4(10, 0, 0, 1)
+	remote6, local6 := net.ParseIP("2001:db8::2"), net.ParseIP("2001:db8::1")
+
+	vlan := ethernetFrame(etherTypeVLAN, append([]byte{0, 10, 0x08, 0x00}, ipv4Packet(remote4, local4, ipProtoTCP, tcpHeader(40000, 22, FlagSYN))...))
+
+	type args struct {
+		linkType LinkType
+		b        []byte
+	}
+	tests := []struct {
+		name    string
+		args    args
+		want    Segment
+		wantErr bool
+	}{
+		{
+			name: "ethernet ipv4 syn",
+			args: args{
+				linkType: LinkTypeEthernet,
+				b:        ethernetFrame(etherTypeIPv4, ipv4Packet(remote4, local4, ipProtoTCP, tcpHeader(40000, 22, FlagSYN))),
+			},
+			want:    Segment{SrcIP: remote4, SrcPort: 40000, DstIP: local4, DstPort: 22, Flags: FlagSYN},
+			wantErr: false,
+		},
+		{
+			name: "ethernet vlan ipv4 syn",
+			args: args{
+				linkType: LinkTypeEthernet,
+				b:        vlan,
+			},
+			want:    Segment{SrcIP: remote4, SrcPort: 40000, DstIP: local4, DstPort: 22, Flags: FlagSYN},
+			wantErr: false,
+		},
+		{
+			name: "raw ipv6 rst",
+			args: args{
+				linkType: LinkTypeRaw,
+				b:        ipv6Packet(local6, remote6, tcpHeader(22, 40000, FlagRST|FlagACK)),
+			},
+			want:    Segment{SrcIP: local6, SrcPort: 22, DstIP: remote6, DstPort: 40000, Flags: FlagRST | FlagACK},
+			wantErr: false,
+		},
+		{
+			name: "udp",
+			args: args{
+				linkType: LinkTypeIPv4,
+				b:        ipv4Packet(remote4, local4, 17, make([]byte, 8)),
+			},
+			want:    Segment{},
+			wantErr: true,
+		},
+		{
+			name: "truncated tcp header",
+			args: args{
+				linkType: LinkTypeIPv4,
+				b:        ipv4Packet(remote4, local4, ipProtoTCP, make([]byte, 4)),
+			},
+			want:    Segment{},
+			wantErr: true,
+		},
+		{
+			name: "unsupported link type",
+			args: args{
+				linkType: LinkType(147),
+				b:        ipv4Packet(remote4, local4, ipProtoTCP, tcpHeader(40000, 22, FlagSYN)),
+			},
+			want:    Segment{},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Decode(tt.args.linkType, tt.args.b)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Decode() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Decode() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package capture
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	pcapMagicMicro = 0xa1b2c3d4
+	pcapMagicNano  = 0xa1b23c4d
+	// pcapMaxSnapLen bounds the size of a single packet so a corrupt file can't allocate unbounded memory
+	pcapMaxSnapLen = 256 * 1024
+)
+
+// Packet is a captured packet and the time it was captured
+type Packet struct {
+	Timestamp time.Time
+	LinkType  LinkType
+	Data      []byte
+}
+
+// PacketReader returns captured packets one at a time, io.EOF is returned after the last packet
+type PacketReader interface {
+	Next() (Packet, error)
+}
+
+// PcapReader reads packets from a classic libpcap file
+type PcapReader struct {
+	r         io.Reader
+	order     binary.ByteOrder
+	nano      bool
+	linkType  LinkType
+	recordHdr [16]byte
+}
+
+// NewPcapReader reads the pcap file header from r and returns a pointer to a PcapReader for its packets
+func NewPcapReader(r io.Reader) (*PcapReader, error) {
+	var hdr [24]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, fmt.Errorf("failed to read pcap header: %v", err)
+	}
+
+	pr := &PcapReader{r: r}
+	switch {
+	case binary.LittleEndian.Uint32(hdr[0:4]) == pcapMagicMicro:
+		pr.order = binary.LittleEndian
+	case binary.BigEndian.Uint32(hdr[0:4]) == pcapMagicMicro:
+		pr.order = binary.BigEndian
+	case binary.LittleEndian.Uint32(hdr[0:4]) == pcapMagicNano:
+		pr.order, pr.nano = binary.LittleEndian, true
+	case binary.BigEndian.Uint32(hdr[0:4]) == pcapMagicNano:
+		pr.order, pr.nano = binary.BigEndian, true
+	default:
+		return nil, errors.New("not a pcap file")
+	}
+
+	// the link type is the low 16 bits, the upper bits hold FCS information
+	pr.linkType = LinkType(pr.order.Uint32(hdr[20:24]) & 0xffff)
+
+	return pr, nil
+}
+
+// Next returns the next packet in the file
+func (pr *PcapReader) Next() (Packet, error) {
+	if _, err := io.ReadFull(pr.r, pr.recordHdr[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return Packet{}, fmt.Errorf("truncated pcap record header: %v", err)
+		}
+		return Packet{}, err
+	}
+
+	sec := int64(pr.order.Uint32(pr.recordHdr[0:4]))
+	frac := int64(pr.order.Uint32(pr.recordHdr[4:8]))
+	capLen := pr.order.Uint32(pr.recordHdr[8:12])
+	if capLen > pcapMaxSnapLen {
+		return Packet{}, fmt.Errorf("pcap record too large: %d", capLen)
+	}
+
+	data := make([]byte, capLen)
+	if _, err := io.ReadFull(pr.r, data); err != nil {
+		return Packet{}, fmt.Errorf("truncated pcap record: %v", err)
+	}
+
+	if !pr.nano {
+		frac *= int64(time.Microsecond)
+	}
+
+	return Packet{
+		Timestamp: time.Unix(sec, frac),
+		LinkType:  pr.linkType,
+		Data:      data,
+	}, nil
+}
@@ -0,0 +1,149 @@
+package capture
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/rcanderson23/connectionWatcher/connections"
+)
+
+func TestNewPcapReader(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr bool
+	}{
+		{
+			name:    "not a pcap",
+			data:    bytes.Repeat([]byte{0xff}, 24),
+			wantErr: true,
+		},
+		{
+			name:    "truncated header",
+			data:    []byte{0xd4, 0xc3, 0xb2, 0xa1},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewPcapReader(bytes.NewReader(tt.data))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewPcapReader() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReplay(t *testing.T) {
+	f, err := os.Open("../test/synscan.pcap")
+	if err != nil {
+		t.Fatalf("failed to open file: %v", err)
+	}
+	defer f.Close()
+
+	pr, err := NewPcapReader(f)
+	if err != nil {
+		t.Fatalf("NewPcapReader() error = %v", err)
+	}
+
+	detection := &connections.Detection{Detectors: []connections.Detector{&connections.PortScanDetector{}}}
+	handled, err := Replay(pr, NewTracker(detection))
+	if err != nil {
+		t.Fatalf("Replay() error = %v", err)
+	}
+	// the udp packet is skipped
+	if want := 13; handled != want {
+		t.Errorf("Replay() handled = %d, want %d", handled, want)
+	}
+
+	verdicts := detection.Verdicts(1000)
+	if len(verdicts) != 1 {
+		t.Fatalf("Verdicts() = %v, want only 10.0.0.2", verdicts)
+	}
+	if got := verdicts[0].Host.RemoteIP.String(); got != "10.0.0.2" {
+		t.Errorf("Verdicts() remote = %v, want 10.0.0.2", got)
+	}
+
+	ports := verdicts[0].Host.Ports
+	sort.Slice(ports, func(i, j int) bool { return ports[i] < ports[j] })
+	if want := []uint16{22, 23, 25, 80}; !reflect.DeepEqual(ports, want) {
+		t.Errorf("Verdicts() ports = %v, want %v", ports, want)
+	}
+}
+
+func readAllPackets(t *testing.T, path string) []Packet {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("failed to open file: %v", err)
+	}
+	defer f.Close()
+
+	pr, err := NewReader(f)
+	if err != nil {
+		t.Fatalf("NewReader() error = %v", err)
+	}
+
+	var pkts []Packet
+	for {
+		pkt, err := pr.Next()
+		if err == io.EOF {
+			return pkts
+		}
+		if err != nil {
+			t.Fatalf("Next() error = %v", err)
+		}
+		pkts = append(pkts, pkt)
+	}
+}
+
+func TestNewReader(t *testing.T) {
+	pcap := readAllPackets(t, "../test/synscan.pcap")
+	pcapng := readAllPackets(t, "../test/synscan.pcapng")
+
+	if len(pcap) != 14 {
+		t.Errorf("pcap packets = %d, want 14", len(pcap))
+	}
+	if len(pcap) != len(pcapng) {
+		t.Fatalf("pcap packets = %d, pcapng packets = %d", len(pcap), len(pcapng))
+	}
+	for i := range pcap {
+		if !pcap[i].Timestamp.Equal(pcapng[i].Timestamp) {
+			t.Errorf("packet %d timestamp pcap = %v, pcapng = %v", i, pcap[i].Timestamp, pcapng[i].Timestamp)
+		}
+		if pcap[i].LinkType != pcapng[i].LinkType || !bytes.Equal(pcap[i].Data, pcapng[i].Data) {
+			t.Errorf("packet %d differs between pcap and pcapng", i)
+		}
+	}
+}
+
+func TestReplayWithClock(t *testing.T) {
+	f, err := os.Open("../test/synscan.pcapng")
+	if err != nil {
+		t.Fatalf("failed to open file: %v", err)
+	}
+	defer f.Close()
+
+	pr, err := NewReader(f)
+	if err != nil {
+		t.Fatalf("NewReader() error = %v", err)
+	}
+
+	var ticks []int64
+	detection := &connections.Detection{Detectors: []connections.Detector{&connections.PortScanDetector{}}}
+	_, err = ReplayWithClock(pr, NewTracker(detection), time.Second, func(now time.Time) {
+		ticks = append(ticks, now.Unix())
+	})
+	if err != nil {
+		t.Fatalf("ReplayWithClock() error = %v", err)
+	}
+
+	// packets span 1000.000 to 1002.013
+	if want := []int64{1001, 1002, 1003}; !reflect.DeepEqual(ticks, want) {
+		t.Errorf("ReplayWithClock() ticks = %v, want %v", ticks, want)
+	}
+}
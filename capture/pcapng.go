@@ -0,0 +1,212 @@
+package capture
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+const (
+	pcapngSectionHeader    = 0x0a0d0d0a
+	pcapngInterfaceDesc    = 0x00000001
+	pcapngEnhancedPacket   = 0x00000006
+	pcapngByteOrderMagic   = 0x1a2b3c4d
+	pcapngOptionEnd        = 0
+	pcapngOptionTsResol    = 9
+	pcapngDefaultTsResol   = 6
+	pcapngMaxBlockLen      = pcapMaxSnapLen + 64
+	pcapngBlockTrailerSize = 4
+)
+
+// pcapngInterface is the part of an Interface Description Block needed to read its packets
+type pcapngInterface struct {
+	linkType LinkType
+	// unitsPerSecond is the timestamp resolution of the interface
+	unitsPerSecond uint64
+}
+
+// PcapngReader reads packets from a pcapng file. Only Enhanced Packet Blocks are returned, Simple Packet Blocks have
+// no timestamp and are skipped along with every other block type.
+type PcapngReader struct {
+	r          io.Reader
+	order      binary.ByteOrder
+	interfaces []pcapngInterface
+}
+
+// NewPcapngReader reads the first Section Header Block from r and returns a pointer to a PcapngReader for its packets
+func NewPcapngReader(r io.Reader) (*PcapngReader, error) {
+	pr := &PcapngReader{r: r}
+
+	// a file that doesn't start with a section header fails with an error from readBlock
+	if _, _, err := pr.readBlock(); err != nil {
+		return nil, fmt.Errorf("failed to read pcapng section header: %v", err)
+	}
+
+	return pr, nil
+}
+
+// readBlock reads the next block and returns its type and body. The byte order is set from every Section Header Block.
+func (pr *PcapngReader) readBlock() (uint32, []byte, error) {
+	var hdr [8]byte
+	if _, err := io.ReadFull(pr.r, hdr[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return 0, nil, fmt.Errorf("truncated pcapng block header: %v", err)
+		}
+		return 0, nil, err
+	}
+
+	// the section header type reads the same in either byte order, its body starts with the byte order magic
+	if binary.LittleEndian.Uint32(hdr[0:4]) == pcapngSectionHeader {
+		var bom [4]byte
+		if _, err := io.ReadFull(pr.r, bom[:]); err != nil {
+			return 0, nil, fmt.Errorf("truncated pcapng section header: %v", err)
+		}
+		switch {
+		case binary.LittleEndian.Uint32(bom[:]) == pcapngByteOrderMagic:
+			pr.order = binary.LittleEndian
+		case binary.BigEndian.Uint32(bom[:]) == pcapngByteOrderMagic:
+			pr.order = binary.BigEndian
+		default:
+			return 0, nil, errors.New("invalid pcapng byte order magic")
+		}
+
+		body, err := pr.readBody(pr.order.Uint32(hdr[4:8]), 4)
+		if err != nil {
+			return 0, nil, err
+		}
+		return pcapngSectionHeader, append(bom[:], body...), nil
+	}
+
+	if pr.order == nil {
+		return 0, nil, errors.New("pcapng block before section header")
+	}
+
+	body, err := pr.readBody(pr.order.Uint32(hdr[4:8]), 0)
+	if err != nil {
+		return 0, nil, err
+	}
+	return pr.order.Uint32(hdr[0:4]), body, nil
+}
+
+// readBody reads the rest of a block of totalLen bytes, consumed bytes of the body have already been read
+func (pr *PcapngReader) readBody(totalLen uint32, consumed int) ([]byte, error) {
+	if totalLen < 12+uint32(consumed) || totalLen%4 != 0 || totalLen > pcapngMaxBlockLen {
+		return nil, fmt.Errorf("invalid pcapng block length: %d", totalLen)
+	}
+
+	rest := make([]byte, int(totalLen)-8-consumed)
+	if _, err := io.ReadFull(pr.r, rest); err != nil {
+		return nil, fmt.Errorf("truncated pcapng block: %v", err)
+	}
+
+	// drop the trailing copy of the block length
+	return rest[:len(rest)-pcapngBlockTrailerSize], nil
+}
+
+// Next returns the next packet in the file
+func (pr *PcapngReader) Next() (Packet, error) {
+	for {
+		blockType, body, err := pr.readBlock()
+		if err != nil {
+			return Packet{}, err
+		}
+
+		switch blockType {
+		case pcapngSectionHeader:
+			// interface ids are scoped to a section
+			pr.interfaces = nil
+		case pcapngInterfaceDesc:
+			iface, err := pr.parseInterface(body)
+			if err != nil {
+				return Packet{}, err
+			}
+			pr.interfaces = append(pr.interfaces, iface)
+		case pcapngEnhancedPacket:
+			return pr.parseEnhancedPacket(body)
+		}
+	}
+}
+
+func (pr *PcapngReader) parseInterface(body []byte) (pcapngInterface, error) {
+	if len(body) < 8 {
+		return pcapngInterface{}, fmt.Errorf("pcapng interface description too short: %d", len(body))
+	}
+
+	iface := pcapngInterface{
+		linkType:       LinkType(pr.order.Uint16(body[0:2])),
+		unitsPerSecond: uint64(math.Pow10(pcapngDefaultTsResol)),
+	}
+
+	opts := body[8:]
+	for len(opts) >= 4 {
+		code := pr.order.Uint16(opts[0:2])
+		length := int(pr.order.Uint16(opts[2:4]))
+		if code == pcapngOptionEnd {
+			break
+		}
+
+		padded := (length + 3) &^ 3
+		if len(opts) < 4+padded {
+			return pcapngInterface{}, errors.New("truncated pcapng interface option")
+		}
+
+		if code == pcapngOptionTsResol && length == 1 {
+			resol := opts[4]
+			if resol&0x80 == 0 {
+				if resol > 19 {
+					return pcapngInterface{}, fmt.Errorf("unsupported pcapng timestamp resolution: %d", resol)
+				}
+				iface.unitsPerSecond = uint64(math.Pow10(int(resol)))
+			} else {
+				if resol&0x7f > 63 {
+					return pcapngInterface{}, fmt.Errorf("unsupported pcapng timestamp resolution: %d", resol)
+				}
+				iface.unitsPerSecond = 1 << (resol & 0x7f)
+			}
+		}
+
+		opts = opts[4+padded:]
+	}
+
+	return iface, nil
+}
+
+func (pr *PcapngReader) parseEnhancedPacket(body []byte) (Packet, error) {
+	if len(body) < 20 {
+		return Packet{}, fmt.Errorf("pcapng enhanced packet too short: %d", len(body))
+	}
+
+	id := pr.order.Uint32(body[0:4])
+	if int(id) >= len(pr.interfaces) {
+		return Packet{}, fmt.Errorf("pcapng packet for unknown interface %d", id)
+	}
+	iface := pr.interfaces[id]
+
+	capLen := pr.order.Uint32(body[12:16])
+	if uint64(capLen) > uint64(len(body)-20) {
+		return Packet{}, fmt.Errorf("pcapng packet length %d exceeds block", capLen)
+	}
+
+	ts := uint64(pr.order.Uint32(body[4:8]))<<32 | uint64(pr.order.Uint32(body[8:12]))
+	sec := ts / iface.unitsPerSecond
+	frac := ts % iface.unitsPerSecond
+	var nsec uint64
+	if iface.unitsPerSecond <= uint64(time.Second) {
+		nsec = frac * uint64(time.Second) / iface.unitsPerSecond
+	} else {
+		// finer than a nanosecond would overflow, precision beyond that is never needed
+		nsec = uint64(float64(frac) / float64(iface.unitsPerSecond) * float64(time.Second))
+	}
+
+	data := make([]byte, capLen)
+	copy(data, body[20:20+capLen])
+
+	return Packet{
+		Timestamp: time.Unix(int64(sec), int64(nsec)),
+		LinkType:  iface.linkType,
+		Data:      data,
+	}, nil
+}
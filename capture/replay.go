@@ -0,0 +1,69 @@
+package capture
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+)
+
+// NewReader detects whether r is a pcap or pcapng file and returns a PacketReader for it
+func NewReader(r io.Reader) (PacketReader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(4)
+	if err != nil {
+		return nil, errors.New("not a pcap or pcapng file")
+	}
+
+	if binary.LittleEndian.Uint32(magic) == pcapngSectionHeader {
+		return NewPcapngReader(br)
+	}
+	return NewPcapReader(br)
+}
+
+// Replay feeds every TCP packet from pr into tr using the packet timestamps. Packets that fail to decode are skipped,
+// the number of packets handled is returned.
+func Replay(pr PacketReader, tr *Tracker) (int, error) {
+	return ReplayWithClock(pr, tr, 0, nil)
+}
+
+// ReplayWithClock is Replay with a simulated clock. tick is called every period of capture time, starting one period
+// after the first packet, with every tick that falls before a packet called before the packet is handled. A final
+// tick is made after the last packet. tick is never called if period is not positive.
+func ReplayWithClock(pr PacketReader, tr *Tracker, period time.Duration, tick func(now time.Time)) (int, error) {
+	var handled int
+	var next time.Time
+	clock := period > 0 && tick != nil
+
+	for {
+		pkt, err := pr.Next()
+		if err == io.EOF {
+			if clock && !next.IsZero() {
+				tick(next)
+			}
+			return handled, nil
+		}
+		if err != nil {
+			return handled, err
+		}
+
+		if clock {
+			if next.IsZero() {
+				next = pkt.Timestamp.Add(period)
+			}
+			for !pkt.Timestamp.Before(next) {
+				tick(next)
+				next = next.Add(period)
+			}
+		}
+
+		seg, err := Decode(pkt.LinkType, pkt.Data)
+		if err != nil {
+			continue
+		}
+
+		tr.Handle(seg, false, pkt.Timestamp.Unix())
+		handled++
+	}
+}
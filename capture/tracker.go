@@ -0,0 +1,131 @@
+package capture
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/rcanderson23/connectionWatcher/metrics"
+)
+
+// DefaultAttemptTimeout is the time in seconds a SYN waits for a reply before the attempt is counted as unanswered
+const DefaultAttemptTimeout = int64(10)
+
+// Result is the outcome of a connection attempt
+type Result uint8
+
+const (
+	ResultNone Result = iota
+	// ResultOpen is an attempt answered with a SYN/ACK, the port is open
+	ResultOpen
+	// ResultClosed is an attempt answered with a RST, the port is closed
+	ResultClosed
+	// ResultUnanswered is an attempt that received no reply before the timeout, the port is likely filtered
+	ResultUnanswered
+)
+
+func (r Result) String() string {
+	switch r {
+	case ResultOpen:
+		return "open"
+	case ResultClosed:
+		return "closed"
+	case ResultUnanswered:
+		return "unanswered"
+	default:
+		return "none"
+	}
+}
+
+// PortAdder records a remote host connecting to a local port, connections.Detection satisfies this
+type PortAdder interface {
+	AddPort(localIP string, remoteIP string, port uint16, t int64)
+}
+
+// Tracker follows TCP handshakes and feeds every inbound connection attempt into a PortAdder, whether or not a
+// socket is ever created for it
+type Tracker struct {
+	Ports PortAdder
+	// Timeout is the time in seconds a SYN waits for a reply
+	Timeout int64
+
+	mu sync.Mutex
+	// pending maps an attempt key to the unix time of its SYN
+	pending map[string]int64
+	// expired is the unix time pending was last checked for attempts past the Timeout
+	expired int64
+}
+
+// NewTracker returns a pointer to a Tracker feeding attempts into ports
+func NewTracker(ports PortAdder) *Tracker {
+	return &Tracker{
+		Ports:   ports,
+		Timeout: DefaultAttemptTimeout,
+		pending: make(map[string]int64),
+	}
+}
+
+// Handle processes a segment seen at unix time t. Outgoing segments are sent by the local host, a SYN sent by the
+// local host is its own outgoing connection and is ignored. When the direction isn't known, such as packets read
+// from a pcap file, every SYN is treated as inbound. The Result of the attempt is returned for replies.
+func (tr *Tracker) Handle(seg Segment, outgoing bool, t int64) Result {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	tr.expire(t)
+
+	switch {
+	case seg.SYN():
+		if outgoing {
+			return ResultNone
+		}
+		// a retransmitted SYN is the same attempt
+		key := attemptKey(seg.SrcIP, seg.SrcPort, seg.DstIP, seg.DstPort)
+		if _, present := tr.pending[key]; present {
+			return ResultNone
+		}
+		tr.pending[key] = t
+		tr.Ports.AddPort(seg.DstIP.String(), seg.SrcIP.String(), seg.DstPort, t)
+		return ResultNone
+	case seg.SYNACK(), seg.RST():
+		// replies travel from the local host back to the remote host
+		key := attemptKey(seg.DstIP, seg.DstPort, seg.SrcIP, seg.SrcPort)
+		if _, present := tr.pending[key]; !present {
+			return ResultNone
+		}
+		delete(tr.pending, key)
+
+		result := ResultClosed
+		if seg.SYNACK() {
+			result = ResultOpen
+		}
+		metrics.CaptureAttempts.WithLabelValues(result.String()).Inc()
+		return result
+	default:
+		return ResultNone
+	}
+}
+
+// expire counts and removes attempts that have waited longer than the Timeout at most once a second, the caller must
+// hold mu
+func (tr *Tracker) expire(t int64) {
+	if t == tr.expired {
+		return
+	}
+	tr.expired = t
+
+	for key, ts := range tr.pending {
+		if t-ts >= tr.Timeout {
+			delete(tr.pending, key)
+			metrics.CaptureAttempts.WithLabelValues(ResultUnanswered.String()).Inc()
+		}
+	}
+}
+
+// attemptKey returns the key of an attempt from the remote endpoint to the local endpoint
+func attemptKey(remoteIP net.IP, remotePort uint16, localIP net.IP, localPort uint16) string {
+	remote := net.JoinHostPort(remoteIP.String(), strconv.Itoa(int(remotePort)))
+	local := net.JoinHostPort(localIP.String(), strconv.Itoa(int(localPort)))
+	return fmt.Sprintf("%s->%s", remote, local)
+}
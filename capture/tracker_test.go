@@ -0,0 +1,126 @@
+package capture
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/rcanderson23/connectionWatcher/connections"
+)
+
+type addedPort struct {
+	localIP  string
+	remoteIP string
+	port     uint16
+	t        int64
+}
+
+type fakePortAdder struct {
+	added []addedPort
+}
+
+func (f *fakePortAdder) AddPort(localIP string, remoteIP string, port uint16, t int64) {
+	f.added = append(f.added, addedPort{localIP: localIP, remoteIP: remoteIP, port: port, t: t})
+}
+
+func TestTracker_Handle(t *testing.T) {
+	remote, local := net.IPv4(10, 0, 0, 2), net.IPv4(10, 0, 0, 1)
+
+	type step struct {
+		seg      Segment
+		outgoing bool
+		t        int64
+		want     Result
+	}
+	tests := []struct {
+		name  string
+		steps []step
+		want  []addedPort
+	}{
+		{
+			name: "open port",
+			steps: []step{
+				{seg: Segment{SrcIP: remote, SrcPort: 40000, DstIP: local, DstPort: 22, Flags: FlagSYN}, t: 10, want: ResultNone},
+				{seg: Segment{SrcIP: local, SrcPort: 22, DstIP: remote, DstPort: 40000, Flags: FlagSYN | FlagACK}, outgoing: true, t: 10, want: ResultOpen},
+			},
+			want: []addedPort{{localIP: "10.0.0.1", remoteIP: "10.0.0.2", port: 22, t: 10}},
+		},
+		{
+			name: "closed port",
+			steps: []step{
+				{seg: Segment{SrcIP: remote, SrcPort: 40000, DstIP: local, DstPort: 23, Flags: FlagSYN}, t: 10, want: ResultNone},
+				{seg: Segment{SrcIP: local, SrcPort: 23, DstIP: remote, DstPort: 40000, Flags: FlagRST | FlagACK}, outgoing: true, t: 11, want: ResultClosed},
+				// only the first reply is counted
+				{seg: Segment{SrcIP: local, SrcPort: 23, DstIP: remote, DstPort: 40000, Flags: FlagRST | FlagACK}, outgoing: true, t: 11, want: ResultNone},
+			},
+			want: []addedPort{{localIP: "10.0.0.1", remoteIP: "10.0.0.2", port: 23, t: 10}},
+		},
+		{
+			name: "retransmitted syn",
+			steps: []step{
+				{seg: Segment{SrcIP: remote, SrcPort: 40000, DstIP: local, DstPort: 22, Flags: FlagSYN}, t: 10, want: ResultNone},
+				{seg: Segment{SrcIP: remote, SrcPort: 40000, DstIP: local, DstPort: 22, Flags: FlagSYN}, t: 11, want: ResultNone},
+				{seg: Segment{SrcIP: local, SrcPort: 22, DstIP: remote, DstPort: 40000, Flags: FlagSYN | FlagACK}, outgoing: true, t: 11, want: ResultOpen},
+			},
+			want: []addedPort{{localIP: "10.0.0.1", remoteIP: "10.0.0.2", port: 22, t: 10}},
+		},
+		{
+			name: "outgoing syn ignored",
+			steps: []step{
+				{seg: Segment{SrcIP: local, SrcPort: 40000, DstIP: remote, DstPort: 443, Flags: FlagSYN}, outgoing: true, t: 10, want: ResultNone},
+				{seg: Segment{SrcIP: remote, SrcPort: 443, DstIP: local, DstPort: 40000, Flags: FlagSYN | FlagACK}, t: 10, want: ResultNone},
+			},
+			want: nil,
+		},
+		{
+			name: "reply after timeout",
+			steps: []step{
+				{seg: Segment{SrcIP: remote, SrcPort: 40000, DstIP: local, DstPort: 22, Flags: FlagSYN}, t: 10, want: ResultNone},
+				{seg: Segment{SrcIP: local, SrcPort: 22, DstIP: remote, DstPort: 40000, Flags: FlagSYN | FlagACK}, outgoing: true, t: 10 + DefaultAttemptTimeout, want: ResultNone},
+			},
+			want: []addedPort{{localIP: "10.0.0.1", remoteIP: "10.0.0.2", port: 22, t: 10}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ports := &fakePortAdder{}
+			tr := NewTracker(ports)
+			for i, s := range tt.steps {
+				if got := tr.Handle(s.seg, s.outgoing, s.t); got != s.want {
+					t.Errorf("Handle() step %d = %v, want %v", i, got, s.want)
+				}
+			}
+			if !reflect.DeepEqual(ports.added, tt.want) {
+				t.Errorf("Handle() added = %v, want %v", ports.added, tt.want)
+			}
+		})
+	}
+}
+
+func TestTracker_Handle_allowlisted(t *testing.T) {
+	allowlist, err := connections.NewAllowlist([]string{"10.0.0.2"}, nil)
+	if err != nil {
+		t.Fatalf("NewAllowlist() error = %v", err)
+	}
+	detection := &connections.Detection{
+		Detectors: []connections.Detector{&connections.PortScanDetector{}},
+		Allowlist: allowlist,
+	}
+	tr := NewTracker(detection)
+
+	// both hosts scan the same ports, only the one that isn't allowlisted is observed
+	local := net.IPv4(10, 0, 0, 1)
+	for _, remote := range []net.IP{net.IPv4(10, 0, 0, 2), net.IPv4(10, 0, 0, 3)} {
+		for _, port := range []uint16{22, 23, 25, 80} {
+			tr.Handle(Segment{SrcIP: remote, SrcPort: 40000, DstIP: local, DstPort: port, Flags: FlagSYN}, false, 10)
+		}
+	}
+
+	verdicts := detection.Verdicts(10)
+	if len(verdicts) != 1 {
+		t.Fatalf("Verdicts() = %v, want only 10.0.0.3", verdicts)
+	}
+	if got := verdicts[0].Host.RemoteIP.String(); got != "10.0.0.3" {
+		t.Errorf("Verdicts() remote = %v, want 10.0.0.3", got)
+	}
+}
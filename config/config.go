@@ -0,0 +1,602 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rcanderson23/connectionWatcher/connections"
+	"gopkg.in/yaml.v2"
+)
+
+// EnvPrefix is prepended to the upper-cased flag name, with dashes replaced by underscores, to name the environment
+// variable for a setting. e.g. CONNWATCHER_METRICS_ADDRESS for -metrics-address
+const EnvPrefix = "CONNWATCHER_"
+
+const (
+	// ExitCleanUp removes every block and firewall entry on exit
+	ExitCleanUp = "cleanup"
+	// ExitKeep leaves blocks in place on exit, to be restored from the state file on the next start
+	ExitKeep = "keep"
+)
+
+// Config holds every runtime setting. Settings are applied in order of precedence from defaults, the config file,
+// environment variables and finally command-line flags.
+type Config struct {
+	// Source is where connections are observed from, proc or netlink
+	Source string `yaml:"source"`
+	// TCPPaths are the tcp tables read by the proc source
+	TCPPaths []string `yaml:"tcp_paths"`
+	// TTL is the sliding window the distinct ports a remote host connects to are counted in
+	TTL time.Duration `yaml:"ttl"`
+	// WaitPeriod is the amount of time between every observation
+	WaitPeriod time.Duration `yaml:"wait_period"`
+	// MetricsAddress is the address the prometheus metrics are served on
+	MetricsAddress string `yaml:"metrics_address"`
+	// Detectors are the detectors enabled: portscan, horizontal, rate, sequential and score
+	Detectors []string `yaml:"detectors"`
+	// PortThreshold is the number of distinct local ports a remote host connects to within TTL before it is blocked
+	PortThreshold int `yaml:"port_threshold"`
+	// Thresholds override PortThreshold and TTL for connections to some local IPs and ports, the first match applies.
+	// They can only be set in the config file.
+	Thresholds []ThresholdConfig `yaml:"thresholds"`
+	// HorizontalThreshold is the number of distinct local IPs a remote host connects to on the same port within
+	// HorizontalWindow before the horizontal detector blocks it
+	HorizontalThreshold int `yaml:"horizontal_threshold"`
+	// HorizontalWindow is the sliding window the local IPs are counted in, TTL if zero
+	HorizontalWindow time.Duration `yaml:"horizontal_window"`
+	// RateLimit is the number of new connections a remote host opens to a local port within RateWindow before the rate
+	// detector blocks it
+	RateLimit int `yaml:"rate_limit"`
+	// PortRateLimits override RateLimit for some local ports, such as ssh or smtp. They can only be set in the config
+	// file.
+	PortRateLimits map[uint16]int `yaml:"port_rate_limits"`
+	// RateWindow is the sliding window new connections are counted in, TTL if zero
+	RateWindow time.Duration `yaml:"rate_window"`
+	// SequentialPorts is the number of consecutive local ports a remote host connects to before the sequential
+	// detector blocks it
+	SequentialPorts int `yaml:"sequential_ports"`
+	// ScoreThreshold is the risk score that gets a remote host blocked by the score detector
+	ScoreThreshold float64 `yaml:"score_threshold"`
+	// ScoreHalfLife is the time it takes a risk score to halve
+	ScoreHalfLife time.Duration `yaml:"score_half_life"`
+	// ScoreWeights are what each signal adds to a risk score, they can only be set in the config file
+	ScoreWeights ScoreWeightsConfig `yaml:"score_weights"`
+	// SensitivePorts are the ports weighted with the sensitive_port weight, they can only be set in the config file
+	SensitivePorts []uint16 `yaml:"sensitive_ports"`
+	// Backend is the firewall hosts are blocked with, iptables, nftables or ipset
+	Backend string `yaml:"backend"`
+	// Table is the iptables table blocking rules are inserted into
+	Table string `yaml:"table"`
+	// Chain is the iptables chain that jumps to BlockChain, or holds the rule matching the ipset
+	Chain string `yaml:"chain"`
+	// BlockChain is the iptables chain owned by connectionWatcher that holds the blocking rules
+	BlockChain string `yaml:"block_chain"`
+	// StaleChain is what happens to a BlockChain left behind by a previous run, flush or adopt
+	StaleChain string `yaml:"stale_chain"`
+	// NFTablesTable is the inet table owned by the nftables backend
+	NFTablesTable string `yaml:"nftables_table"`
+	// IPSetName is the list:set owned by the ipset backend, its member sets are named after it
+	IPSetName string `yaml:"ipset_name"`
+	// BlockTTL is how long a host is blocked the first time, zero blocks hosts until the process exits
+	BlockTTL time.Duration `yaml:"block_ttl"`
+	// MaxBlockTTL caps the block duration of repeat offenders, which doubles with every block
+	MaxBlockTTL time.Duration `yaml:"max_block_ttl"`
+	// ReconcileInterval is how often the firewall is reconciled with the blocked hosts
+	ReconcileInterval time.Duration `yaml:"reconcile_interval"`
+	// StateFile is where blocks are saved so they are restored on startup, empty disables saving them
+	StateFile string `yaml:"state_file"`
+	// Monitor only logs and counts the hosts that would be blocked, the firewall is never touched
+	Monitor bool `yaml:"monitor"`
+	// ExitPolicy is what happens to blocks on exit, cleanup or keep
+	ExitPolicy string `yaml:"exit_policy"`
+	// Allowlist are IPs and CIDRs that are never blocked, in addition to loopback, link-local, local interface addresses
+	// and default gateways
+	Allowlist []string `yaml:"allowlist"`
+	// AllowlistFiles are files of IPs and CIDRs that are never blocked, one per line
+	AllowlistFiles []string `yaml:"allowlist_files"`
+	// Denylist are files, or directories of files, of IPs and CIDRs that are always blocked
+	Denylist []string `yaml:"denylist"`
+	// DenylistInterval is how often the Denylist files are checked for changes
+	DenylistInterval time.Duration `yaml:"denylist_interval"`
+	// EphemeralPortRange overrides the kernel's ip_local_port_range, formatted as min-max. Empty reads it from the kernel.
+	EphemeralPortRange string `yaml:"ephemeral_port_range"`
+	// Capture enables detection from captured TCP handshake packets
+	Capture bool `yaml:"capture"`
+	// Record is the snapshot archive every poll of the proc source is written to, empty disables recording
+	Record string `yaml:"record"`
+}
+
+// ThresholdConfig overrides the port threshold and window for connections to LocalIPs and Ports
+type ThresholdConfig struct {
+	// Name identifies the threshold in logs, it must be unique
+	Name string `yaml:"name"`
+	// LocalIPs are IPs and CIDRs of the local addresses the threshold applies to, any if empty
+	LocalIPs []string `yaml:"local_ips"`
+	// Ports are the local ports the threshold applies to, any if empty
+	Ports []uint16 `yaml:"ports"`
+	// PortThreshold and Window replace port_threshold and ttl, they are inherited if zero
+	PortThreshold int           `yaml:"port_threshold"`
+	Window        time.Duration `yaml:"window"`
+}
+
+// ScoreWeightsConfig are what each signal adds to the risk score of a remote host
+type ScoreWeightsConfig struct {
+	// Port is added for every distinct port, SensitivePort instead for a sensitive port
+	Port          float64 `yaml:"port"`
+	SensitivePort float64 `yaml:"sensitive_port"`
+	// HalfOpen is added for every new half-open connection
+	HalfOpen float64 `yaml:"half_open"`
+	// NewConnection is added for every new connection
+	NewConnection float64 `yaml:"new_connection"`
+	// Denylist is added for every new connection from a denylisted network
+	Denylist float64 `yaml:"denylist"`
+}
+
+// Default returns the settings used when nothing is configured
+func Default() Config {
+	return Config{
+		Source:              "proc",
+		TCPPaths:            []string{"/proc/net/tcp", "/proc/net/tcp6"},
+		TTL:                 connections.DefaultWindow,
+		WaitPeriod:          10 * time.Second,
+		MetricsAddress:      ":9090",
+		Detectors:           connections.DefaultDetectors,
+		PortThreshold:       connections.DefaultPortThreshold,
+		HorizontalThreshold: connections.DefaultHorizontalThreshold,
+		RateLimit:           connections.DefaultRateLimit,
+		SequentialPorts:     connections.DefaultSequentialPorts,
+		ScoreThreshold:      connections.DefaultScoreThreshold,
+		ScoreHalfLife:       connections.DefaultScoreHalfLife,
+		ScoreWeights:        ScoreWeightsConfig(connections.DefaultScoreWeights),
+		SensitivePorts:      connections.DefaultSensitivePorts,
+		Backend:             connections.BackendIPTables,
+		Table:               connections.DefaultTable,
+		Chain:               connections.DefaultChain,
+		BlockChain:          connections.DefaultBlockChain,
+		StaleChain:          connections.StaleChainFlush,
+		NFTablesTable:       connections.DefaultNFTablesTable,
+		IPSetName:           connections.DefaultIPSetName,
+		BlockTTL:            connections.DefaultBlockTTL,
+		MaxBlockTTL:         connections.DefaultMaxBlockTTL,
+		ReconcileInterval:   connections.DefaultReconcileInterval,
+		ExitPolicy:          ExitCleanUp,
+		DenylistInterval:    connections.DefaultDenylistInterval,
+	}
+}
+
+// Load returns the Config for the command name from the config file, environment and command-line args, along with
+// the args remaining after flags. The config file is set with the -config flag or the CONNWATCHER_CONFIG variable.
+func Load(name string, args []string, lookupEnv func(string) (string, bool)) (Config, []string, error) {
+	// the first pass only finds the config file, flags are parsed again so they take precedence over it
+	var path string
+	pre := newFlagSet(name, &Config{}, &path)
+	pre.SetOutput(ioutil.Discard)
+	if v, ok := lookupEnv(envName("config")); ok {
+		path = v
+	}
+	if err := pre.Parse(args); err != nil && err != flag.ErrHelp {
+		return Config{}, nil, err
+	}
+
+	cfg := Default()
+	if path != "" {
+		if err := cfg.loadFile(path); err != nil {
+			return Config{}, nil, err
+		}
+	}
+
+	fs := newFlagSet(name, &cfg, &path)
+	var envErr error
+	fs.VisitAll(func(f *flag.Flag) {
+		if v, ok := lookupEnv(envName(f.Name)); ok && envErr == nil && f.Name != "config" {
+			if err := f.Value.Set(v); err != nil {
+				envErr = fmt.Errorf("invalid value %q for %s: %v", v, envName(f.Name), err)
+			}
+		}
+	})
+	if envErr != nil {
+		return Config{}, nil, envErr
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return Config{}, nil, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return Config{}, nil, err
+	}
+
+	return cfg, fs.Args(), nil
+}
+
+// newFlagSet returns a FlagSet setting the fields of cfg, defaults are the current values of cfg
+func newFlagSet(name string, cfg *Config, path *string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage of %s:\n", name)
+		fs.PrintDefaults()
+		fmt.Fprintf(fs.Output(), "\nEvery flag can also be set in the config file, using underscores instead of dashes, or with an\n"+
+			"environment variable such as %s for -ttl.\n", envName("ttl"))
+	}
+	fs.StringVar(path, "config", *path, "path to a YAML config file")
+	fs.StringVar(&cfg.Source, "source", cfg.Source, "where connections are observed from, proc or netlink")
+	fs.Var((*stringList)(&cfg.TCPPaths), "tcp-paths", "comma separated tcp tables read by the proc source")
+	fs.DurationVar(&cfg.TTL, "ttl", cfg.TTL, "sliding window the distinct ports a remote host connects to are counted in")
+	fs.DurationVar(&cfg.WaitPeriod, "wait-period", cfg.WaitPeriod, "amount of time between every observation")
+	fs.StringVar(&cfg.MetricsAddress, "metrics-address", cfg.MetricsAddress, "address prometheus metrics are served on")
+	fs.Var((*stringList)(&cfg.Detectors), "detectors", "comma separated detectors enabled: portscan, horizontal, rate, sequential and score")
+	fs.IntVar(&cfg.HorizontalThreshold, "horizontal-threshold", cfg.HorizontalThreshold, "distinct local IPs a remote host connects to on the same port before the horizontal detector blocks it")
+	fs.DurationVar(&cfg.HorizontalWindow, "horizontal-window", cfg.HorizontalWindow, "sliding window the horizontal detector counts local IPs in, ttl if 0")
+	fs.IntVar(&cfg.RateLimit, "rate-limit", cfg.RateLimit, "new connections a remote host opens to a local port before the rate detector blocks it")
+	fs.DurationVar(&cfg.RateWindow, "rate-window", cfg.RateWindow, "sliding window the rate detector counts new connections in, ttl if 0")
+	fs.IntVar(&cfg.SequentialPorts, "sequential-ports", cfg.SequentialPorts, "consecutive local ports a remote host connects to before the sequential detector blocks it")
+	fs.Float64Var(&cfg.ScoreThreshold, "score-threshold", cfg.ScoreThreshold, "risk score that gets a remote host blocked by the score detector")
+	fs.DurationVar(&cfg.ScoreHalfLife, "score-half-life", cfg.ScoreHalfLife, "time it takes a risk score to halve")
+	fs.IntVar(&cfg.PortThreshold, "port-threshold", cfg.PortThreshold, "distinct local ports a remote host connects to before it is blocked")
+	fs.StringVar(&cfg.Backend, "backend", cfg.Backend, "firewall hosts are blocked with, iptables, nftables or ipset")
+	fs.StringVar(&cfg.Table, "table", cfg.Table, "iptables table blocking rules are inserted into")
+	fs.StringVar(&cfg.Chain, "chain", cfg.Chain, "iptables chain that jumps to the block chain")
+	fs.StringVar(&cfg.BlockChain, "block-chain", cfg.BlockChain, "iptables chain owned by connectionWatcher holding the blocking rules")
+	fs.StringVar(&cfg.StaleChain, "stale-chain", cfg.StaleChain, "what happens to a block chain left behind by a previous run, flush or adopt")
+	fs.StringVar(&cfg.NFTablesTable, "nftables-table", cfg.NFTablesTable, "inet table owned by the nftables backend")
+	fs.StringVar(&cfg.IPSetName, "ipset-name", cfg.IPSetName, "list:set owned by the ipset backend")
+	fs.DurationVar(&cfg.BlockTTL, "block-ttl", cfg.BlockTTL, "how long a host is blocked the first time, 0 blocks until exit")
+	fs.DurationVar(&cfg.MaxBlockTTL, "max-block-ttl", cfg.MaxBlockTTL, "longest block of a repeat offender, the block ttl doubles with every block")
+	fs.DurationVar(&cfg.ReconcileInterval, "reconcile-interval", cfg.ReconcileInterval, "how often the firewall is reconciled with the blocked hosts")
+	fs.StringVar(&cfg.StateFile, "state-file", cfg.StateFile, "file blocks are saved to and restored from on startup, empty disables it")
+	fs.BoolVar(&cfg.Monitor, "monitor", cfg.Monitor, "only log and count the hosts that would be blocked, never touching the firewall")
+	fs.StringVar(&cfg.ExitPolicy, "exit-policy", cfg.ExitPolicy, "what happens to blocks on exit, cleanup or keep")
+	fs.Var((*stringList)(&cfg.Allowlist), "allowlist", "comma separated IPs and CIDRs that are never blocked")
+	fs.Var((*stringList)(&cfg.AllowlistFiles), "allowlist-files", "comma separated files of IPs and CIDRs that are never blocked, one per line")
+	fs.Var((*stringList)(&cfg.Denylist), "denylist", "comma separated files or directories of IPs and CIDRs that are always blocked")
+	fs.DurationVar(&cfg.DenylistInterval, "denylist-interval", cfg.DenylistInterval, "how often the denylist files are checked for changes")
+	fs.StringVar(&cfg.EphemeralPortRange, "ephemeral-port-range", cfg.EphemeralPortRange, "ephemeral port range as min-max, read from the kernel when empty")
+	fs.BoolVar(&cfg.Capture, "capture", cfg.Capture, "also detect scans from captured TCP handshake packets, requires CAP_NET_RAW")
+	fs.StringVar(&cfg.Record, "record", cfg.Record, "write every poll of the proc source to this snapshot archive for later replay")
+	return fs
+}
+
+func envName(flagName string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// loadFile applies the settings in the YAML file at path, unknown keys are an error so typos aren't ignored
+func (c *Config) loadFile(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %v", err)
+	}
+
+	if err := yaml.UnmarshalStrict(b, c); err != nil {
+		return fmt.Errorf("failed to parse config file %s: %v", path, err)
+	}
+
+	return nil
+}
+
+// Validate checks every setting and returns a single error describing all invalid settings
+func (c Config) Validate() error {
+	var problems []string
+	invalid := func(format string, a ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, a...))
+	}
+
+	switch c.Source {
+	case "proc":
+		if len(c.TCPPaths) == 0 {
+			invalid("tcp_paths must not be empty with the proc source")
+		}
+	case "netlink":
+		if c.Record != "" {
+			invalid("record requires the proc source")
+		}
+	default:
+		invalid("source must be proc or netlink, got %q", c.Source)
+	}
+
+	if c.TTL < time.Second {
+		invalid("ttl must be at least 1s, got %v", c.TTL)
+	}
+	if c.WaitPeriod <= 0 {
+		invalid("wait_period must be positive, got %v", c.WaitPeriod)
+	}
+	if _, _, err := net.SplitHostPort(c.MetricsAddress); err != nil {
+		invalid("metrics_address must be host:port, got %q", c.MetricsAddress)
+	}
+	if c.PortThreshold < 1 {
+		invalid("port_threshold must be at least 1, got %d", c.PortThreshold)
+	}
+	if len(c.Detectors) == 0 {
+		invalid("detectors must not be empty")
+	}
+	for _, name := range c.Detectors {
+		if _, err := connections.NewDetector(name, connections.DetectorConfig{}); err != nil {
+			invalid("detectors must be portscan, horizontal, rate, sequential or score, got %q", name)
+		}
+	}
+	if c.HorizontalThreshold < 2 {
+		invalid("horizontal_threshold must be at least 2, got %d", c.HorizontalThreshold)
+	}
+	if c.HorizontalWindow != 0 && c.HorizontalWindow < time.Second {
+		invalid("horizontal_window must be 0 or at least 1s, got %v", c.HorizontalWindow)
+	}
+	if c.RateLimit < 1 {
+		invalid("rate_limit must be at least 1, got %d", c.RateLimit)
+	}
+	for _, port := range sortedPorts(c.PortRateLimits) {
+		if port == 0 || c.PortRateLimits[port] < 1 {
+			invalid("port_rate_limits must map ports to limits of at least 1, got %d: %d", port, c.PortRateLimits[port])
+		}
+	}
+	if c.RateWindow != 0 && c.RateWindow < time.Second {
+		invalid("rate_window must be 0 or at least 1s, got %v", c.RateWindow)
+	}
+	if c.SequentialPorts < 2 {
+		invalid("sequential_ports must be at least 2, got %d", c.SequentialPorts)
+	}
+	if c.ScoreThreshold <= 0 {
+		invalid("score_threshold must be positive, got %v", c.ScoreThreshold)
+	}
+	if c.ScoreHalfLife < time.Second {
+		invalid("score_half_life must be at least 1s, got %v", c.ScoreHalfLife)
+	}
+	w := c.ScoreWeights
+	if w.Port < 0 || w.SensitivePort < 0 || w.HalfOpen < 0 || w.NewConnection < 0 || w.Denylist < 0 {
+		invalid("score_weights must not be negative, got %+v", w)
+	}
+	for _, port := range c.SensitivePorts {
+		if port == 0 {
+			invalid("sensitive_ports must not contain port 0")
+		}
+	}
+	names := make(map[string]bool)
+	for i, th := range c.Thresholds {
+		if th.Name == "" || names[th.Name] {
+			invalid("thresholds[%d]: name must be set and unique, got %q", i, th.Name)
+		}
+		names[th.Name] = true
+		for _, ip := range th.LocalIPs {
+			if _, err := connections.ParseNet(ip); err != nil {
+				invalid("thresholds[%d]: local_ips must be IPs or CIDRs, got %q", i, ip)
+			}
+		}
+		if th.PortThreshold < 0 {
+			invalid("thresholds[%d]: port_threshold must not be negative, got %d", i, th.PortThreshold)
+		}
+		if th.Window != 0 && th.Window < time.Second {
+			invalid("thresholds[%d]: window must be 0 or at least 1s, got %v", i, th.Window)
+		}
+	}
+	switch c.Backend {
+	case connections.BackendIPTables, connections.BackendNFTables, connections.BackendIPSet:
+	default:
+		invalid("backend must be iptables, nftables or ipset, got %q", c.Backend)
+	}
+	if c.Table == "" || strings.ContainsAny(c.Table, " \t") {
+		invalid("table must be a single iptables table name, got %q", c.Table)
+	}
+	if c.Chain == "" || strings.ContainsAny(c.Chain, " \t") {
+		invalid("chain must be a single iptables chain name, got %q", c.Chain)
+	}
+	if c.BlockChain == "" || c.BlockChain == c.Chain || strings.ContainsAny(c.BlockChain, " \t") {
+		invalid("block_chain must be a single iptables chain name other than chain, got %q", c.BlockChain)
+	}
+	if c.StaleChain != connections.StaleChainFlush && c.StaleChain != connections.StaleChainAdopt {
+		invalid("stale_chain must be flush or adopt, got %q", c.StaleChain)
+	}
+	if c.NFTablesTable == "" || strings.ContainsAny(c.NFTablesTable, " \t") {
+		invalid("nftables_table must be a single nftables table name, got %q", c.NFTablesTable)
+	}
+	// ipset names are limited to 31 characters, including the suffix of the member sets
+	if c.IPSetName == "" || len(c.IPSetName) > 26 || strings.ContainsAny(c.IPSetName, " \t") {
+		invalid("ipset_name must be a single name of at most 26 characters, got %q", c.IPSetName)
+	}
+	if c.BlockTTL != 0 && c.BlockTTL < time.Second {
+		invalid("block_ttl must be 0 or at least 1s, got %v", c.BlockTTL)
+	}
+	if c.BlockTTL != 0 && c.MaxBlockTTL < c.BlockTTL {
+		invalid("max_block_ttl must be at least block_ttl %v, got %v", c.BlockTTL, c.MaxBlockTTL)
+	}
+	if c.ReconcileInterval < time.Second {
+		invalid("reconcile_interval must be at least 1s, got %v", c.ReconcileInterval)
+	}
+	if c.ExitPolicy != ExitCleanUp && c.ExitPolicy != ExitKeep {
+		invalid("exit_policy must be cleanup or keep, got %q", c.ExitPolicy)
+	}
+	if c.ExitPolicy == ExitKeep && c.StateFile == "" {
+		invalid("exit_policy keep requires a state_file")
+	}
+	for _, entry := range c.Allowlist {
+		if _, err := connections.ParseAllowlistEntry(entry); err != nil {
+			invalid("allowlist: %v", err)
+		}
+	}
+	if c.DenylistInterval < time.Second {
+		invalid("denylist_interval must be at least 1s, got %v", c.DenylistInterval)
+	}
+	if c.EphemeralPortRange != "" {
+		if _, err := connections.ParsePortRange(c.EphemeralPortRange); err != nil {
+			invalid("ephemeral_port_range must be min-max, got %q: %v", c.EphemeralPortRange, err)
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// Reload returns c with the settings of next that can change at runtime, along with the names of the settings that
+// differ in next but require a restart to change
+func (c Config) Reload(next Config) (Config, []string) {
+	var restart []string
+	if next.Source != c.Source {
+		restart = append(restart, "source")
+	}
+	if strings.Join(next.TCPPaths, ",") != strings.Join(c.TCPPaths, ",") {
+		restart = append(restart, "tcp_paths")
+	}
+	if next.MetricsAddress != c.MetricsAddress {
+		restart = append(restart, "metrics_address")
+	}
+	if next.Backend != c.Backend {
+		restart = append(restart, "backend")
+	}
+	if next.BlockChain != c.BlockChain {
+		restart = append(restart, "block_chain")
+	}
+	if next.StaleChain != c.StaleChain {
+		restart = append(restart, "stale_chain")
+	}
+	if next.NFTablesTable != c.NFTablesTable {
+		restart = append(restart, "nftables_table")
+	}
+	if next.IPSetName != c.IPSetName {
+		restart = append(restart, "ipset_name")
+	}
+	if next.StateFile != c.StateFile {
+		restart = append(restart, "state_file")
+	}
+	if next.Monitor != c.Monitor {
+		restart = append(restart, "monitor")
+	}
+	if next.Capture != c.Capture {
+		restart = append(restart, "capture")
+	}
+	if next.Record != c.Record {
+		restart = append(restart, "record")
+	}
+
+	c.TTL = next.TTL
+	c.WaitPeriod = next.WaitPeriod
+	c.Detectors = next.Detectors
+	c.PortThreshold = next.PortThreshold
+	c.Thresholds = next.Thresholds
+	c.HorizontalThreshold = next.HorizontalThreshold
+	c.HorizontalWindow = next.HorizontalWindow
+	c.RateLimit = next.RateLimit
+	c.PortRateLimits = next.PortRateLimits
+	c.RateWindow = next.RateWindow
+	c.SequentialPorts = next.SequentialPorts
+	c.ScoreThreshold = next.ScoreThreshold
+	c.ScoreHalfLife = next.ScoreHalfLife
+	c.ScoreWeights = next.ScoreWeights
+	c.SensitivePorts = next.SensitivePorts
+	c.Table = next.Table
+	c.Chain = next.Chain
+	c.BlockTTL = next.BlockTTL
+	c.MaxBlockTTL = next.MaxBlockTTL
+	c.ReconcileInterval = next.ReconcileInterval
+	c.ExitPolicy = next.ExitPolicy
+	c.Allowlist = next.Allowlist
+	c.AllowlistFiles = next.AllowlistFiles
+	c.Denylist = next.Denylist
+	c.DenylistInterval = next.DenylistInterval
+	c.EphemeralPortRange = next.EphemeralPortRange
+
+	return c, restart
+}
+
+// EphemeralPorts returns the configured ephemeral port range, the zero PortRange when it should be read from the kernel
+func (c Config) EphemeralPorts() connections.PortRange {
+	if c.EphemeralPortRange == "" {
+		return connections.PortRange{}
+	}
+	// validated by Validate
+	r, _ := connections.ParsePortRange(c.EphemeralPortRange)
+	return r
+}
+
+// NewAllowlist returns the configured allowlist, reading the allowlist files
+func (c Config) NewAllowlist() (*connections.Allowlist, error) {
+	return connections.NewAllowlist(c.Allowlist, c.AllowlistFiles)
+}
+
+// Detection returns the settings of the detectors
+func (c Config) Detection() connections.DetectorConfig {
+	var thresholds []connections.Threshold
+	for _, th := range c.Thresholds {
+		threshold := connections.Threshold{
+			Name:          th.Name,
+			Ports:         th.Ports,
+			PortThreshold: th.PortThreshold,
+			Window:        th.Window,
+		}
+		for _, ip := range th.LocalIPs {
+			// validated by Validate
+			n, _ := connections.ParseNet(ip)
+			threshold.LocalNets = append(threshold.LocalNets, n)
+		}
+		thresholds = append(thresholds, threshold)
+	}
+
+	return connections.DetectorConfig{
+		Detectors:           c.Detectors,
+		PortThreshold:       c.PortThreshold,
+		Window:              c.TTL,
+		Thresholds:          thresholds,
+		HorizontalThreshold: c.HorizontalThreshold,
+		HorizontalWindow:    c.HorizontalWindow,
+		RateLimit:           c.RateLimit,
+		PortRateLimits:      c.PortRateLimits,
+		RateWindow:          c.RateWindow,
+		SequentialPorts:     c.SequentialPorts,
+		ScoreThreshold:      c.ScoreThreshold,
+		ScoreHalfLife:       c.ScoreHalfLife,
+		ScoreWeights:        connections.ScoreWeights(c.ScoreWeights),
+		SensitivePorts:      c.SensitivePorts,
+		Capture:             c.Capture,
+	}
+}
+
+// Blocker returns the settings of the IPBlocker
+func (c Config) Blocker() connections.BlockerConfig {
+	return connections.BlockerConfig{
+		Backend:       c.Backend,
+		Table:         c.Table,
+		Chain:         c.Chain,
+		BlockChain:    c.BlockChain,
+		StaleChain:    c.StaleChain,
+		NFTablesTable: c.NFTablesTable,
+		IPSetName:     c.IPSetName,
+		BlockTTL:      c.BlockTTL,
+		MaxBlockTTL:   c.MaxBlockTTL,
+		StatePath:     c.StateFile,
+		Monitor:       c.Monitor,
+	}
+}
+
+// sortedPorts returns the ports of limits in order
+func sortedPorts(limits map[uint16]int) []uint16 {
+	var ports []uint16
+	for port := range limits {
+		ports = append(ports, port)
+	}
+	sort.Slice(ports, func(i, j int) bool { return ports[i] < ports[j] })
+	return ports
+}
+
+// stringList is a flag.Value for a comma separated list
+type stringList []string
+
+func (s *stringList) String() string {
+	if s == nil {
+		return ""
+	}
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(v string) error {
+	*s = nil
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*s = append(*s, item)
+		}
+	}
+	return nil
+}
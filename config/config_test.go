@@ -0,0 +1,291 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfigFile(t *testing.T, contents string) string {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatalf("failed to write config file: %v", err)
+	}
+	return path
+}
+
+func env(vars map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		v, ok := vars[key]
+		return v, ok
+	}
+}
+
+func TestLoad(t *testing.T) {
+	file := writeConfigFile(t, `
+source: netlink
+ttl: 2m
+port_threshold: 5
+metrics_address: 127.0.0.1:9100
+port_rate_limits:
+  22: 10
+score_weights:
+  half_open: 3
+`)
+
+	type args struct {
+		args []string
+		env  map[string]string
+	}
+	tests := []struct {
+		name     string
+		args     args
+		want     func(c *Config)
+		wantArgs []string
+		wantErr  bool
+	}{
+		{
+			name:    "defaults",
+			args:    args{},
+			want:    func(c *Config) {},
+			wantErr: false,
+		},
+		{
+			name: "config file",
+			args: args{args: []string{"-config", file}},
+			want: func(c *Config) {
+				c.Source = "netlink"
+				c.TTL = 2 * time.Minute
+				c.PortThreshold = 5
+				c.MetricsAddress = "127.0.0.1:9100"
+				c.PortRateLimits = map[uint16]int{22: 10}
+				c.ScoreWeights.HalfOpen = 3
+			},
+			wantErr: false,
+		},
+		{
+			name: "environment overrides file",
+			args: args{env: map[string]string{"CONNWATCHER_CONFIG": file, "CONNWATCHER_PORT_THRESHOLD": "7"}},
+			want: func(c *Config) {
+				c.Source = "netlink"
+				c.TTL = 2 * time.Minute
+				c.PortThreshold = 7
+				c.MetricsAddress = "127.0.0.1:9100"
+				c.PortRateLimits = map[uint16]int{22: 10}
+				c.ScoreWeights.HalfOpen = 3
+			},
+			wantErr: false,
+		},
+		{
+			name: "flags override environment",
+			args: args{
+				args: []string{"-config", file, "-port-threshold", "9", "-tcp-paths", "/tmp/tcp", "-source", "proc", "capture.pcap"},
+				env:  map[string]string{"CONNWATCHER_PORT_THRESHOLD": "7", "CONNWATCHER_WAIT_PERIOD": "5s"},
+			},
+			want: func(c *Config) {
+				c.Source = "proc"
+				c.TCPPaths = []string{"/tmp/tcp"}
+				c.TTL = 2 * time.Minute
+				c.WaitPeriod = 5 * time.Second
+				c.PortThreshold = 9
+				c.MetricsAddress = "127.0.0.1:9100"
+				c.PortRateLimits = map[uint16]int{22: 10}
+				c.ScoreWeights.HalfOpen = 3
+			},
+			wantArgs: []string{"capture.pcap"},
+			wantErr:  false,
+		},
+		{
+			name:    "invalid environment value",
+			args:    args{env: map[string]string{"CONNWATCHER_TTL": "forever"}},
+			wantErr: true,
+		},
+		{
+			name:    "missing config file",
+			args:    args{args: []string{"-config", file + ".missing"}},
+			wantErr: true,
+		},
+		{
+			name:    "invalid flag value",
+			args:    args{args: []string{"-port-threshold", "0"}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, gotArgs, err := Load("test", tt.args.args, env(tt.args.env))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Load() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.wantErr {
+				return
+			}
+
+			want := Default()
+			tt.want(&want)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Load() got = %+v, want %+v", got, want)
+			}
+			if (len(gotArgs) > 0 || len(tt.wantArgs) > 0) && !reflect.DeepEqual(gotArgs, tt.wantArgs) {
+				t.Errorf("Load() args = %v, want %v", gotArgs, tt.wantArgs)
+			}
+		})
+	}
+}
+
+func TestLoad_unknownKey(t *testing.T) {
+	file := writeConfigFile(t, "port_treshold: 5\n")
+	_, _, err := Load("test", []string{"-config", file}, env(nil))
+	if err == nil || !strings.Contains(err.Error(), "port_treshold") {
+		t.Errorf("Load() error = %v, want error naming the unknown key", err)
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(c *Config)
+		wantErr []string
+	}{
+		{
+			name:    "default",
+			modify:  func(c *Config) {},
+			wantErr: nil,
+		},
+		{
+			name: "every problem reported",
+			modify: func(c *Config) {
+				c.Source = "pcap"
+				c.TTL = time.Millisecond
+				c.WaitPeriod = 0
+				c.MetricsAddress = "9090"
+				c.Chain = ""
+				c.EphemeralPortRange = "60999-32768"
+			},
+			wantErr: []string{"source", "ttl", "wait_period", "metrics_address", "chain", "ephemeral_port_range"},
+		},
+		{
+			name: "record with netlink",
+			modify: func(c *Config) {
+				c.Source = "netlink"
+				c.Record = "/tmp/archive"
+			},
+			wantErr: []string{"record requires the proc source"},
+		},
+		{
+			name: "keep without state file",
+			modify: func(c *Config) {
+				c.ExitPolicy = ExitKeep
+			},
+			wantErr: []string{"exit_policy keep requires a state_file"},
+		},
+		{
+			name: "unknown backend",
+			modify: func(c *Config) {
+				c.Backend = "pf"
+			},
+			wantErr: []string{"backend must be iptables, nftables or ipset"},
+		},
+		{
+			name: "block ttl longer than max",
+			modify: func(c *Config) {
+				c.BlockTTL = 2 * time.Hour
+				c.MaxBlockTTL = time.Hour
+			},
+			wantErr: []string{"max_block_ttl"},
+		},
+		{
+			name: "invalid allowlist entry",
+			modify: func(c *Config) {
+				c.Allowlist = []string{"192.0.2.0/24", "example.com"}
+			},
+			wantErr: []string{"allowlist", "example.com"},
+		},
+		{
+			name: "invalid thresholds",
+			modify: func(c *Config) {
+				c.Thresholds = []ThresholdConfig{
+					{Name: "web", LocalIPs: []string{"10.0.0.0/24"}, Ports: []uint16{80, 443}, PortThreshold: 5},
+					{Name: "web", LocalIPs: []string{"web01"}, Window: time.Millisecond},
+				}
+			},
+			wantErr: []string{"thresholds[1]: name", "thresholds[1]: local_ips", "thresholds[1]: window"},
+		},
+		{
+			name: "invalid detectors",
+			modify: func(c *Config) {
+				c.Detectors = []string{"portscan", "bogus"}
+				c.HorizontalThreshold = 1
+				c.HorizontalWindow = time.Millisecond
+				c.RateLimit = 0
+				c.PortRateLimits = map[uint16]int{22: 10, 25: 0}
+				c.RateWindow = time.Millisecond
+				c.SequentialPorts = 1
+				c.ScoreThreshold = 0
+				c.ScoreHalfLife = 0
+				c.ScoreWeights.Port = -1
+				c.SensitivePorts = []uint16{22, 0}
+			},
+			wantErr: []string{
+				"detectors", "horizontal_threshold", "horizontal_window", "rate_limit", "port_rate_limits", "rate_window",
+				"sequential_ports", "score_threshold", "score_half_life", "score_weights", "sensitive_ports",
+			},
+		},
+		{
+			name: "proc without paths",
+			modify: func(c *Config) {
+				c.TCPPaths = nil
+			},
+			wantErr: []string{"tcp_paths"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Default()
+			tt.modify(&c)
+			err := c.Validate()
+			if (err != nil) != (len(tt.wantErr) > 0) {
+				t.Fatalf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			for _, want := range tt.wantErr {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("Validate() error = %v, want it to mention %s", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestConfig_Reload(t *testing.T) {
+	c := Default()
+	next := Default()
+	next.PortThreshold = 5
+	next.TTL = 5 * time.Minute
+	next.Chain = "CONNWATCHER"
+	next.Source = "netlink"
+	next.MetricsAddress = ":9100"
+
+	got, restart := c.Reload(next)
+
+	want := Default()
+	want.PortThreshold = 5
+	want.TTL = 5 * time.Minute
+	want.Chain = "CONNWATCHER"
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Reload() got = %+v, want %+v", got, want)
+	}
+	if wantRestart := []string{"source", "metrics_address"}; !reflect.DeepEqual(restart, wantRestart) {
+		t.Errorf("Reload() restart = %v, want %v", restart, wantRestart)
+	}
+}
@@ -0,0 +1,195 @@
+package connections
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+)
+
+const (
+	// RoutePath is the IPv4 routing table the default gateway is read from
+	RoutePath = "/proc/net/route"
+	// IPv6RoutePath is the IPv6 routing table the default gateway is read from
+	IPv6RoutePath = "/proc/net/ipv6_route"
+)
+
+// builtinAllowlist are networks that are never blocked, a remote host can't legitimately have these addresses
+var builtinAllowlist = []string{
+	"0.0.0.0/32",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"::/128",
+	"::1/128",
+	"fe80::/10",
+}
+
+// Allowlist is a set of networks that are never blocked. A nil Allowlist contains nothing.
+type Allowlist struct {
+	Nets []*net.IPNet
+}
+
+// NewAllowlist returns an Allowlist of entries, the entries of every file, and automatically loopback, link-local,
+// the addresses of every local interface and the default gateways. Entries are IPs or CIDRs.
+func NewAllowlist(entries []string, files []string) (*Allowlist, error) {
+	a := &Allowlist{}
+	for _, entry := range append(builtinAllowlist, entries...) {
+		n, err := ParseAllowlistEntry(entry)
+		if err != nil {
+			return nil, err
+		}
+		a.Nets = append(a.Nets, n)
+	}
+
+	for _, file := range files {
+		nets, err := readAllowlistFile(file)
+		if err != nil {
+			return nil, err
+		}
+		a.Nets = append(a.Nets, nets...)
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		log.Printf("Failed to read interface addresses, they are not allowlisted: %v", err)
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			a.Nets = append(a.Nets, hostNet(ipNet.IP))
+		}
+	}
+
+	for _, gw := range defaultGateways(RoutePath, IPv6RoutePath) {
+		a.Nets = append(a.Nets, hostNet(gw))
+	}
+
+	return a, nil
+}
+
+// ParseAllowlistEntry parses an IP or CIDR, an IP is a network of a single host
+func ParseAllowlistEntry(s string) (*net.IPNet, error) {
+	n, err := ParseNet(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid allowlist entry %q: %v", s, err)
+	}
+	return n, nil
+}
+
+// readAllowlistFile returns the entries of the file at path, one per line. Blank lines and anything after a # are
+// ignored.
+func readAllowlistFile(path string) ([]*net.IPNet, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read allowlist file: %v", err)
+	}
+	defer f.Close()
+
+	var nets []*net.IPNet
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		entry := strings.TrimSpace(strings.SplitN(scanner.Text(), "#", 2)[0])
+		if entry == "" {
+			continue
+		}
+
+		n, err := ParseAllowlistEntry(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		nets = append(nets, n)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read allowlist file: %v", err)
+	}
+	return nets, nil
+}
+
+// Contains returns true if ip is in any network of the Allowlist
+func (a *Allowlist) Contains(ip net.IP) bool {
+	if a == nil {
+		return false
+	}
+
+	for _, n := range a.Nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Overlaps returns true if any network of the Allowlist overlaps n
+func (a *Allowlist) Overlaps(n *net.IPNet) bool {
+	if a == nil {
+		return false
+	}
+
+	for _, allowed := range a.Nets {
+		if allowed.Contains(n.IP) || n.Contains(allowed.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultGateways returns the gateways of the default routes in the IPv4 and IPv6 routing tables, a table that can't
+// be read is logged and skipped
+func defaultGateways(path4, path6 string) []net.IP {
+	var gateways []net.IP
+	for _, read := range []struct {
+		path  string
+		parse func(fields []string) net.IP
+	}{
+		{path: path4, parse: parseDefaultRoute},
+		{path: path6, parse: parseDefaultIPv6Route},
+	} {
+		f, err := os.Open(read.path)
+		if err != nil {
+			log.Printf("Failed to read default gateway, it is not allowlisted: %v", err)
+			continue
+		}
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if gw := read.parse(strings.Fields(scanner.Text())); gw != nil {
+				gateways = append(gateways, gw)
+			}
+		}
+		f.Close()
+	}
+
+	return gateways
+}
+
+// parseDefaultRoute returns the gateway of a line of /proc/net/route if it is a default route, addresses are hex
+// little endian like /proc/net/tcp
+func parseDefaultRoute(fields []string) net.IP {
+	if len(fields) < 8 || fields[1] != "00000000" || fields[7] != "00000000" || fields[2] == "00000000" {
+		return nil
+	}
+
+	gw, err := parseIPv4(fields[2])
+	if err != nil {
+		return nil
+	}
+	return gw
+}
+
+// parseDefaultIPv6Route returns the next hop of a line of /proc/net/ipv6_route if it is a default route, addresses
+// are hex in network order
+func parseDefaultIPv6Route(fields []string) net.IP {
+	const unspecified = "00000000000000000000000000000000"
+	if len(fields) < 5 || fields[0] != unspecified || fields[1] != "00" || fields[4] == unspecified {
+		return nil
+	}
+
+	b, err := hex.DecodeString(fields[4])
+	if err != nil || len(b) != net.IPv6len {
+		return nil
+	}
+	return net.IP(b)
+}
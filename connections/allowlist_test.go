@@ -0,0 +1,150 @@
+package connections
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAllowlist_Contains(t *testing.T) {
+	a, err := NewAllowlist([]string{"192.0.2.10", "198.51.100.0/24", "2001:db8::/32"}, nil)
+	if err != nil {
+		t.Fatalf("NewAllowlist() error = %v", err)
+	}
+
+	tests := []struct {
+		name string
+		ip   string
+		want bool
+	}{
+		{name: "ip", ip: "192.0.2.10", want: true},
+		{name: "ip not listed", ip: "192.0.2.11", want: false},
+		{name: "cidr", ip: "198.51.100.77", want: true},
+		{name: "ipv6 cidr", ip: "2001:db8::1", want: true},
+		{name: "ipv4-mapped", ip: "::ffff:198.51.100.1", want: true},
+		{name: "loopback", ip: "127.0.0.53", want: true},
+		{name: "ipv6 loopback", ip: "::1", want: true},
+		{name: "unspecified", ip: "0.0.0.0", want: true},
+		{name: "link-local", ip: "169.254.169.254", want: true},
+		{name: "ipv6 link-local", ip: "fe80::1", want: true},
+		{name: "public", ip: "203.0.113.1", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := a.Contains(net.ParseIP(tt.ip)); got != tt.want {
+				t.Errorf("Contains(%s) = %v, want %v", tt.ip, got, tt.want)
+			}
+		})
+	}
+
+	var none *Allowlist
+	if none.Contains(net.ParseIP("127.0.0.1")) {
+		t.Errorf("nil Allowlist Contains() = true, want false")
+	}
+}
+
+func TestParseAllowlistEntry(t *testing.T) {
+	tests := []struct {
+		name    string
+		entry   string
+		want    string
+		wantErr bool
+	}{
+		{name: "ipv4", entry: "192.0.2.1", want: "192.0.2.1/32"},
+		{name: "ipv6", entry: "2001:db8::1", want: "2001:db8::1/128"},
+		{name: "cidr", entry: "192.0.2.1/24", want: "192.0.2.0/24"},
+		{name: "ipv6 cidr", entry: "2001:db8::/32", want: "2001:db8::/32"},
+		{name: "invalid ip", entry: "192.0.2", wantErr: true},
+		{name: "invalid cidr", entry: "192.0.2.0/33", wantErr: true},
+		{name: "hostname", entry: "localhost", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseAllowlistEntry(tt.entry)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseAllowlistEntry() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && got.String() != tt.want {
+				t.Errorf("ParseAllowlistEntry() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadAllowlistFile(t *testing.T) {
+	nets, err := readAllowlistFile("../test/allowlist")
+	if err != nil {
+		t.Fatalf("readAllowlistFile() error = %v", err)
+	}
+
+	var got []string
+	for _, n := range nets {
+		got = append(got, n.String())
+	}
+	want := []string{"192.0.2.10/32", "198.51.100.0/24", "2001:db8::/32"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("readAllowlistFile() = %v, want %v", got, want)
+	}
+
+	if _, err := readAllowlistFile("../test/missing"); err == nil {
+		t.Errorf("readAllowlistFile() of missing file error = nil")
+	}
+}
+
+func TestDefaultGateways(t *testing.T) {
+	got := defaultGateways("../test/route", "../test/ipv6_route")
+	want := []net.IP{net.ParseIP("192.0.2.1").To4(), net.ParseIP("fd00::1")}
+	if len(got) != len(want) {
+		t.Fatalf("defaultGateways() = %v, want %v", got, want)
+	}
+	for i := range want {
+		if !got[i].Equal(want[i]) {
+			t.Errorf("defaultGateways()[%d] = %s, want %s", i, got[i], want[i])
+		}
+	}
+}
+
+func TestParseDefaultRoute(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want net.IP
+	}{
+		{name: "default route", line: "eth0\t00000000\t010200C0\t0003\t0\t0\t0\t00000000", want: net.IPv4(192, 0, 2, 1)},
+		{name: "local route", line: "eth0\t000200C0\t00000000\t0001\t0\t0\t0\t00FFFFFF", want: nil},
+		{name: "short gateway", line: "eth0\t00000000\t0102\t0003\t0\t0\t0\t00000000", want: nil},
+		{name: "short line", line: "eth0\t00000000\t010200C0", want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseDefaultRoute(strings.Fields(tt.line)); !got.Equal(tt.want) {
+				t.Errorf("parseDefaultRoute() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIPBlocker_UnblockAllowlisted(t *testing.T) {
+	backend := newFakeBackend()
+	ipb := &IPBlocker{Backend: backend, Offenses: make(map[string]int)}
+	for _, ip := range []string{"192.0.2.10", "203.0.113.1"} {
+		if err := backend.Block(hostNet(net.ParseIP(ip)), 0); err != nil {
+			t.Fatal(err)
+		}
+		ipb.block(net.ParseIP(ip), ReasonPortScan, nil, 0)
+	}
+
+	ipb.Allowlist = &Allowlist{Nets: []*net.IPNet{hostNet(net.ParseIP("192.0.2.10"))}}
+
+	got := ipb.UnblockAllowlisted()
+	if len(got) != 1 || !got[0].Equal(net.ParseIP("192.0.2.10")) {
+		t.Errorf("UnblockAllowlisted() = %v, want [192.0.2.10]", got)
+	}
+	if len(ipb.BlockedHosts) != 1 || !ipb.BlockedHosts[0].IP.Equal(net.ParseIP("203.0.113.1")) {
+		t.Errorf("BlockedHosts = %v, want 203.0.113.1", ipb.BlockedHosts)
+	}
+	if _, ok := backend.blocked["192.0.2.10/32"]; ok {
+		t.Errorf("backend still blocks 192.0.2.10")
+	}
+}
@@ -0,0 +1,175 @@
+package connections
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ArchiveMagic is the first line of every snapshot archive
+const ArchiveMagic = "connectionWatcher snapshot archive v1\n"
+
+// archiveEphemeral starts the header line with the ephemeral port range of the recording host
+const archiveEphemeral = "ephemeral "
+
+// maxArchiveFileLen bounds the size of a single snapshot so a corrupt archive can't allocate unbounded memory
+const maxArchiveFileLen = 1 << 30
+
+// ArchiveFile is the contents of a tcp table captured during a poll
+type ArchiveFile struct {
+	Path string
+	Data []byte
+}
+
+// Poll is every tcp table read by a single poll along with the unix time of the poll
+type Poll struct {
+	Time  int64
+	Files []ArchiveFile
+}
+
+// ArchiveWriter writes polls to a snapshot archive. The header is followed by an `ephemeral <min>-<max>` line with the
+// ephemeral port range of the recording host, so connection directions are classified the same on replay. Each poll
+// is a `poll <unix time> <file count>` line followed by a `file <path> <length>` line and the raw contents of each
+// file.
+type ArchiveWriter struct {
+	w io.Writer
+}
+
+// NewArchiveWriter writes the archive header with the ephemeral port range to w and returns a pointer to an
+// ArchiveWriter
+func NewArchiveWriter(w io.Writer, ephemeral PortRange) (*ArchiveWriter, error) {
+	header := fmt.Sprintf("%s%s%d-%d\n", ArchiveMagic, archiveEphemeral, ephemeral.Min, ephemeral.Max)
+	if _, err := io.WriteString(w, header); err != nil {
+		return nil, fmt.Errorf("failed to write archive header: %v", err)
+	}
+	return &ArchiveWriter{w: w}, nil
+}
+
+// WritePoll appends a poll to the archive in a single write
+func (aw *ArchiveWriter) WritePoll(p Poll) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "poll %d %d\n", p.Time, len(p.Files))
+	for _, f := range p.Files {
+		if strings.ContainsAny(f.Path, " \n") {
+			return fmt.Errorf("archive paths can't contain whitespace: %q", f.Path)
+		}
+		fmt.Fprintf(&buf, "file %s %d\n", f.Path, len(f.Data))
+		buf.Write(f.Data)
+	}
+
+	if _, err := aw.w.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("failed to write poll: %v", err)
+	}
+	return nil
+}
+
+// ArchiveReader reads polls from a snapshot archive
+type ArchiveReader struct {
+	// Ephemeral is the ephemeral port range of the recording host, the zero PortRange for archives recorded without it
+	Ephemeral PortRange
+
+	r *bufio.Reader
+}
+
+// NewArchiveReader reads the archive header from r and returns a pointer to an ArchiveReader
+func NewArchiveReader(r io.Reader) (*ArchiveReader, error) {
+	br := bufio.NewReader(r)
+	header, err := br.ReadString('\n')
+	if err != nil || header != ArchiveMagic {
+		return nil, errors.New("not a snapshot archive")
+	}
+
+	ar := &ArchiveReader{r: br}
+	if prefix, _ := br.Peek(len(archiveEphemeral)); string(prefix) == archiveEphemeral {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("truncated archive header: %v", err)
+		}
+		ar.Ephemeral, err = ParsePortRange(strings.TrimPrefix(strings.TrimSpace(line), archiveEphemeral))
+		if err != nil {
+			return nil, fmt.Errorf("invalid ephemeral port range in archive header: %v", err)
+		}
+	}
+	return ar, nil
+}
+
+// Next returns the next poll in the archive, io.EOF is returned after the last poll
+func (ar *ArchiveReader) Next() (Poll, error) {
+	line, err := ar.r.ReadString('\n')
+	if err == io.EOF && line == "" {
+		return Poll{}, io.EOF
+	}
+	if err != nil {
+		return Poll{}, fmt.Errorf("truncated poll header: %v", err)
+	}
+
+	var p Poll
+	var count int
+	if _, err := fmt.Sscanf(line, "poll %d %d\n", &p.Time, &count); err != nil {
+		return Poll{}, fmt.Errorf("invalid poll header %q: %v", strings.TrimSpace(line), err)
+	}
+
+	for i := 0; i < count; i++ {
+		f, err := ar.readFile()
+		if err != nil {
+			return Poll{}, err
+		}
+		p.Files = append(p.Files, f)
+	}
+
+	return p, nil
+}
+
+func (ar *ArchiveReader) readFile() (ArchiveFile, error) {
+	line, err := ar.r.ReadString('\n')
+	if err != nil {
+		return ArchiveFile{}, fmt.Errorf("truncated file header: %v", err)
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) != 3 || fields[0] != "file" {
+		return ArchiveFile{}, fmt.Errorf("invalid file header %q", strings.TrimSpace(line))
+	}
+
+	length, err := strconv.Atoi(fields[2])
+	if err != nil || length < 0 || length > maxArchiveFileLen {
+		return ArchiveFile{}, fmt.Errorf("invalid file length %q", fields[2])
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(ar.r, data); err != nil {
+		return ArchiveFile{}, fmt.Errorf("truncated file %s: %v", fields[1], err)
+	}
+
+	return ArchiveFile{Path: fields[1], Data: data}, nil
+}
+
+// ArchiveSource is a Source returning the connections of the current poll of a snapshot archive
+type ArchiveSource struct {
+	reader  *ArchiveReader
+	current Poll
+}
+
+// NewArchiveSource returns a pointer to an ArchiveSource reading polls from ar
+func NewArchiveSource(ar *ArchiveReader) *ArchiveSource {
+	return &ArchiveSource{reader: ar}
+}
+
+// Next advances to the next poll and returns its unix time, io.EOF is returned after the last poll
+func (as *ArchiveSource) Next() (int64, error) {
+	p, err := as.reader.Next()
+	if err != nil {
+		return 0, err
+	}
+	as.current = p
+	return p.Time, nil
+}
+
+// Connections returns the connections of the current poll
+func (as *ArchiveSource) Connections() (map[string]Connection, error) {
+	return connectionsFromFiles(as.current.Files)
+}
@@ -0,0 +1,231 @@
+package connections
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log"
+	"reflect"
+	"testing"
+)
+
+const (
+	tcpHeader = "  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode\n"
+	// 10.192.1.18 listening on 22, 80 and 443
+	tcpListeners = "   0: 00000000:0016 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 1 1 0 100 0 0 10 0\n" +
+		"   1: 00000000:0050 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 2 1 0 100 0 0 10 0\n" +
+		"   2: 00000000:01BB 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 3 1 0 100 0 0 10 0\n"
+	// 10.192.1.21 connected to 22, 80 and 443 of 10.192.1.18
+	tcpScan = "   3: 1201C00A:0016 1501C00A:D8AC 01 00000000:00000000 00:00000000 00000000     0        0 4 1 0 20 4 31 10 -1\n" +
+		"   4: 1201C00A:0050 1501C00A:D8AD 01 00000000:00000000 00:00000000 00000000     0        0 5 1 0 20 4 31 10 -1\n" +
+		"   5: 1201C00A:01BB 1501C00A:D8AE 01 00000000:00000000 00:00000000 00000000     0        0 6 1 0 20 4 31 10 -1\n"
+)
+
+func TestArchive_roundTrip(t *testing.T) {
+	polls := []Poll{
+		{
+			Time: 100,
+			Files: []ArchiveFile{
+				{Path: "/proc/net/tcp", Data: []byte(tcpHeader + tcpListeners)},
+				{Path: "/proc/net/tcp6", Data: []byte(tcpHeader)},
+			},
+		},
+		{
+			Time: 110,
+			Files: []ArchiveFile{
+				{Path: "/proc/net/tcp", Data: []byte(tcpHeader + tcpListeners + tcpScan)},
+			},
+		},
+	}
+
+	ephemeral := PortRange{Min: 49152, Max: 65535}
+
+	var buf bytes.Buffer
+	aw, err := NewArchiveWriter(&buf, ephemeral)
+	if err != nil {
+		t.Fatalf("NewArchiveWriter() error = %v", err)
+	}
+	for _, p := range polls {
+		if err := aw.WritePoll(p); err != nil {
+			t.Fatalf("WritePoll() error = %v", err)
+		}
+	}
+
+	ar, err := NewArchiveReader(&buf)
+	if err != nil {
+		t.Fatalf("NewArchiveReader() error = %v", err)
+	}
+	if ar.Ephemeral != ephemeral {
+		t.Errorf("Ephemeral got = %v, want %v", ar.Ephemeral, ephemeral)
+	}
+
+	var got []Poll
+	for {
+		p, err := ar.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next() error = %v", err)
+		}
+		got = append(got, p)
+	}
+
+	if !reflect.DeepEqual(got, polls) {
+		t.Errorf("Next() got = %v, want %v", got, polls)
+	}
+}
+
+func TestArchiveReader_Next(t *testing.T) {
+	tests := []struct {
+		name    string
+		archive string
+		wantErr bool
+	}{
+		{
+			name:    "empty archive",
+			archive: ArchiveMagic,
+			wantErr: false,
+		},
+		{
+			name:    "truncated file",
+			archive: ArchiveMagic + "poll 100 1\nfile /proc/net/tcp 500\n" + tcpHeader,
+			wantErr: true,
+		},
+		{
+			name:    "missing file",
+			archive: ArchiveMagic + "poll 100 2\nfile /proc/net/tcp 0\n",
+			wantErr: true,
+		},
+		{
+			name:    "invalid poll header",
+			archive: ArchiveMagic + "poll soon\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ar, err := NewArchiveReader(bytes.NewBufferString(tt.archive))
+			if err != nil {
+				t.Fatalf("NewArchiveReader() error = %v", err)
+			}
+			_, err = ar.Next()
+			if err == io.EOF {
+				err = nil
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Next() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewArchiveReader(t *testing.T) {
+	tests := []struct {
+		name          string
+		archive       string
+		wantEphemeral PortRange
+		wantErr       bool
+	}{
+		{
+			name:          "ephemeral port range",
+			archive:       ArchiveMagic + "ephemeral 1024-65535\n",
+			wantEphemeral: PortRange{Min: 1024, Max: 65535},
+			wantErr:       false,
+		},
+		{
+			name:          "archive recorded without ephemeral port range",
+			archive:       ArchiveMagic + "poll 100 0\n",
+			wantEphemeral: PortRange{},
+			wantErr:       false,
+		},
+		{
+			name:    "invalid ephemeral port range",
+			archive: ArchiveMagic + "ephemeral 60999-32768\n",
+			wantErr: true,
+		},
+		{
+			name:    "tcp table",
+			archive: tcpHeader,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ar, err := NewArchiveReader(bytes.NewBufferString(tt.archive))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewArchiveReader() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && ar.Ephemeral != tt.wantEphemeral {
+				t.Errorf("Ephemeral got = %v, want %v", ar.Ephemeral, tt.wantEphemeral)
+			}
+		})
+	}
+}
+
+func TestArchiveSource_replay(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	var buf bytes.Buffer
+	aw, _ := NewArchiveWriter(&buf, DefaultEphemeralRange)
+	aw.WritePoll(Poll{Time: 100, Files: []ArchiveFile{{Path: "/proc/net/tcp", Data: []byte(tcpHeader + tcpListeners)}}})
+	aw.WritePoll(Poll{Time: 110, Files: []ArchiveFile{{Path: "/proc/net/tcp", Data: []byte(tcpHeader + tcpListeners + tcpScan)}}})
+
+	ar, err := NewArchiveReader(&buf)
+	if err != nil {
+		t.Fatalf("NewArchiveReader() error = %v", err)
+	}
+
+	source := NewArchiveSource(ar)
+	detection := &Detection{Detectors: []Detector{&PortScanDetector{}}}
+	cw := NewConnectionWatcher(source, nil, PortRange{})
+	cw.Detection = detection
+
+	var blocked []Verdict
+	for {
+		ts, err := source.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next() error = %v", err)
+		}
+		cw.Observe(ts)
+		blocked = append(blocked, detection.Verdicts(ts)...)
+	}
+
+	if len(blocked) != 1 || blocked[0].Host.RemoteIP.String() != "10.192.1.21" {
+		t.Errorf("Verdicts() = %v, want 10.192.1.21", blocked)
+	}
+}
+
+func TestArchiveSource_malformed(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	// endpoints of the right length with the ':' misplaced or the port missing
+	table := tcpHeader +
+		"   0: 1201C0:0A0016 1501C00A:D8AC 01 00000000:00000000 00:00000000 00000000     0        0 4 1 0 20 4 31 10 -1\n" +
+		"   1: 1201C00A0016: 1501C00A:D8AD 01 00000000:00000000 00:00000000 00000000     0        0 5 1 0 20 4 31 10 -1\n" +
+		tcpScan
+
+	var buf bytes.Buffer
+	aw, _ := NewArchiveWriter(&buf, DefaultEphemeralRange)
+	aw.WritePoll(Poll{Time: 100, Files: []ArchiveFile{{Path: "/proc/net/tcp", Data: []byte(table)}}})
+
+	ar, err := NewArchiveReader(&buf)
+	if err != nil {
+		t.Fatalf("NewArchiveReader() error = %v", err)
+	}
+	source := NewArchiveSource(ar)
+	if _, err := source.Next(); err != nil {
+		t.Fatalf("Next() error = %v", err)
+	}
+
+	conns, err := source.Connections()
+	if err != nil {
+		t.Fatalf("Connections() error = %v", err)
+	}
+	if len(conns) != 3 {
+		t.Errorf("Connections() = %d connections, want the 3 valid lines", len(conns))
+	}
+}
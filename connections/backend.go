@@ -0,0 +1,102 @@
+package connections
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	// BackendIPTables blocks hosts with a DROP rule per host through iptables and ip6tables
+	BackendIPTables = "iptables"
+	// BackendNFTables blocks hosts by adding them to sets of a table owned by connectionWatcher
+	BackendNFTables = "nftables"
+	// BackendIPSet blocks hosts by adding them to ipsets matched by a single iptables and ip6tables rule
+	BackendIPSet = "ipset"
+)
+
+// Backend is the firewall hosts are blocked with. Addresses are passed as networks so a backend can block a whole
+// range, a single host is a /32 or /128.
+type Backend interface {
+	// Block drops all traffic from n, a backend that supports it expires the block after ttl. A zero ttl never
+	// expires.
+	Block(n *net.IPNet, ttl time.Duration) error
+	// Unblock removes the block of n, it isn't an error if n isn't blocked
+	Unblock(n *net.IPNet) error
+	// Exists returns true if n is blocked
+	Exists(n *net.IPNet) (bool, error)
+	// List returns every network blocked by the backend
+	List() ([]*net.IPNet, error)
+	// CleanUp removes every block made through the backend and anything else it created
+	CleanUp() error
+}
+
+// relocator is a Backend whose blocks can be moved to another table and chain
+type relocator interface {
+	Relocate(table, chain string) error
+}
+
+// NewBackend returns the Backend named in c
+func NewBackend(c BlockerConfig) (Backend, error) {
+	// the constructors return typed nil pointers on error, which must not become a non-nil Backend
+	switch c.Backend {
+	case "", BackendIPTables:
+		b, err := NewIPTablesBackend(c.Table, c.Chain, c.BlockChain, c.StaleChain)
+		if err != nil {
+			return nil, err
+		}
+		return b, nil
+	case BackendNFTables:
+		b, err := NewNFTablesBackend(c.NFTablesTable)
+		if err != nil {
+			return nil, err
+		}
+		return b, nil
+	case BackendIPSet:
+		b, err := NewIPSetBackend(c.IPSetName, c.Table, c.Chain)
+		if err != nil {
+			return nil, err
+		}
+		return b, nil
+	default:
+		return nil, fmt.Errorf("unknown firewall backend %q", c.Backend)
+	}
+}
+
+// hostNet returns the network containing only ip
+func hostNet(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+// ParseNet parses an IP or CIDR, an IP is a network of a single host
+func ParseNet(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, n, err := net.ParseCIDR(s)
+		return n, err
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address: %s", s)
+	}
+	return hostNet(ip), nil
+}
+
+// isIPv4 returns true if n is an IPv4 network, IPv4-mapped addresses are blocked as IPv4
+func isIPv4(n *net.IPNet) bool {
+	return n.IP.To4() != nil
+}
+
+// containsNet returns true if nets contains n
+func containsNet(nets []*net.IPNet, n *net.IPNet) bool {
+	for _, other := range nets {
+		if other.String() == n.String() {
+			return true
+		}
+	}
+	return false
+}
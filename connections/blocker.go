@@ -1,170 +1,461 @@
 package connections
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"sort"
 	"strings"
+	"time"
 
-	"github.com/coreos/go-iptables/iptables"
+	"github.com/rcanderson23/connectionWatcher/metrics"
 )
 
 const (
-	// Filter is the table to target with blocking rules
-	Filter = "filter"
-	// Chain is the chain to target with blocking rules
-	Chain = "INPUT"
+	// DefaultTable is the table to target with blocking rules
+	DefaultTable = "filter"
+	// DefaultChain is the chain to target with blocking rules
+	DefaultChain = "INPUT"
+	// DefaultBlockTTL is how long a host is blocked for the first time
+	DefaultBlockTTL = time.Hour
+	// DefaultMaxBlockTTL caps the block duration of repeat offenders
+	DefaultMaxBlockTTL = 24 * time.Hour
+	// OffenseRetention is how many times the longest block the offenses of a host are remembered for after its last
+	// offense
+	OffenseRetention = 4
+
+	// ReasonPortScan is the reason of hosts blocked by the PortScanDetector
+	ReasonPortScan = DetectorPortScan
+
+	// MaxDecisions is the number of recent decisions an IPBlocker keeps
+	MaxDecisions = 1000
 )
 
-// IPBlocker is used to track and block remote IPs based on the number of connections made in 30 seconds
-// shortcut: ideally the number of connections and timeframe are configurable by the user
+// Actions an IPBlocker takes on a Verdict
+const (
+	ActionBlocked     = "blocked"
+	ActionWouldBlock  = "would_block"
+	ActionAllowlisted = "allowlisted"
+	ActionFailed      = "failed"
+)
+
+// BlockerConfig holds the settings of an IPBlocker
+type BlockerConfig struct {
+	// Backend is the firewall backend hosts are blocked with, BackendIPTables if empty
+	Backend string
+	// Table and Chain are where the iptables backend jumps to BlockChain, and where the ipset backend inserts its rule
+	Table string
+	Chain string
+	// BlockChain is the chain owned by the iptables backend, a stale one is handled with the StaleChain policy
+	BlockChain string
+	StaleChain string
+	// NFTablesTable is the table owned by the nftables backend
+	NFTablesTable string
+	// IPSetName is the list:set owned by the ipset backend
+	IPSetName string
+	// BlockTTL is how long a host is blocked the first time, doubling with every repeat offense up to MaxBlockTTL.
+	// Zero blocks hosts until the process exits.
+	BlockTTL    time.Duration
+	MaxBlockTTL time.Duration
+	// StatePath is the file blocks are saved to, nothing is saved if empty
+	StatePath string
+	// Monitor only records and logs the hosts that would be blocked, the firewall is never touched
+	Monitor bool
+}
+
+// IPBlocker blocks the remote hosts of the verdicts of a Detection and tracks them until their block expires
 type IPBlocker struct {
-	// Store `LocalIP:RemoteIP` mapped to the port and timestamp(unix epoch)
-	IPPortTime   map[string]map[uint16]int64
-	BlockedHosts []net.IP
-	IP4Table     *iptables.IPTables
+	BlockedHosts []BlockedHost
+	// Backend is the firewall hosts are blocked with, nothing is blocked if nil
+	Backend Backend
+	// BlockTTL is how long a host is blocked the first time, zero blocks hosts until the process exits
+	BlockTTL time.Duration
+	// MaxBlockTTL caps the escalating block duration of repeat offenders, BlockTTL is not escalated if zero
+	MaxBlockTTL time.Duration
+	// Offenses counts the times each remote IP has been blocked, remembered after its blocks expire until
+	// OffenseRetention times the longest block has passed since its last offense
+	Offenses map[string]int
+	// LastOffenses are the unix times each remote IP of the Offenses was last blocked
+	LastOffenses map[string]int64
+	// StatePath is the file the BlockedHosts and Offenses are saved to whenever they change, nothing is saved if empty
+	StatePath string
+	// Allowlist are the remote hosts that are never blocked
+	Allowlist *Allowlist
+	// Denylisted are the networks blocked for being listed in a denylist file, they never expire
+	Denylisted []DenylistedNet
+	// Monitor only records and logs the hosts that would be blocked, nothing is blocked through the Backend
+	Monitor bool
+
+	// decisions are the last MaxDecisions decisions, oldest first
+	decisions []Decision
 }
 
-// NewIPBlocker returns a pointer to a newly constructed IPBlocker
-func NewIPBlocker() *IPBlocker {
-	return &IPBlocker{
-		IPPortTime: make(map[string]map[uint16]int64),
-		IP4Table:   NewIPv4Table(),
-	}
+// Decision is what an IPBlocker did with a Verdict
+type Decision struct {
+	IP       net.IP   `json:"ip"`
+	Reason   string   `json:"reason"`
+	Severity string   `json:"severity"`
+	Evidence string   `json:"evidence"`
+	Ports    []uint16 `json:"ports,omitempty"`
+	// Action is ActionBlocked, ActionWouldBlock in monitor mode, ActionAllowlisted or ActionFailed
+	Action string `json:"action"`
+	// Error is why blocking failed
+	Error string `json:"error,omitempty"`
+	// Time is measured in seconds since the unix epoch
+	Time int64 `json:"time"`
+}
+
+// HostPair is a remote IP connecting to a local IP, both in their string form
+type HostPair struct {
+	LocalIP  string
+	RemoteIP string
+}
+
+// BlockedHost is a remote host with a rule dropping its traffic
+type BlockedHost struct {
+	IP net.IP `json:"ip"`
+	// Reason is why the host was blocked, such as ReasonPortScan
+	Reason string `json:"reason"`
+	// Ports are the local ports the host was observed connecting to
+	Ports []uint16 `json:"ports,omitempty"`
+	// BlockedAt and Expires are measured in seconds since the unix epoch, a zero Expires never expires
+	BlockedAt int64 `json:"blocked_at"`
+	Expires   int64 `json:"expires"`
 }
 
-// NewIPv4Table returns an IPTables to be used for host blocking. Checks that the ACCEPT and INPUT are present to be used
-// shortcut: we are assuming the ACCEPT table is present along with the INPUT chain
-func NewIPv4Table() *iptables.IPTables {
-	ip4t, err := iptables.New()
+// NewIPBlocker returns a pointer to a newly constructed IPBlocker using the provided settings. Host blocking is
+// disabled if the firewall backend can't be created. In monitor mode no backend is created and no state is saved.
+func NewIPBlocker(c BlockerConfig) *IPBlocker {
+	if c.Monitor {
+		log.Printf("Monitor mode, hosts that would be blocked are only logged")
+		return &IPBlocker{
+			BlockTTL:     c.BlockTTL,
+			MaxBlockTTL:  c.MaxBlockTTL,
+			Offenses:     make(map[string]int),
+			LastOffenses: make(map[string]int64),
+			Monitor:      true,
+		}
+	}
+
+	backend, err := NewBackend(c)
 	if err != nil {
-		log.Printf("Failed to create iptables: %v. Host blocking is disabled.", err)
-		return nil
+		log.Printf("Failed to create firewall backend: %v. Host blocking is disabled.", err)
 	}
 
-	return ip4t
+	return &IPBlocker{
+		Backend:      backend,
+		BlockTTL:     c.BlockTTL,
+		MaxBlockTTL:  c.MaxBlockTTL,
+		Offenses:     make(map[string]int),
+		LastOffenses: make(map[string]int64),
+		StatePath:    c.StatePath,
+	}
 }
 
-// RemoveOldConnections checks the map IPPortTime and removes any entries that are older than the provided ttl and the unix time provided
-// now and ttl are measured in seconds
-func (ipb *IPBlocker) RemoveOldConnections(now int64, ttl int64) []uint16 {
-	var removedPorts []uint16
-
-	for ip, portMap := range ipb.IPPortTime {
-		for port, ts := range portMap {
-			lifetime := now - ts
-			if lifetime >= ttl {
-				removedPorts = append(removedPorts, port)
-				delete(ipb.IPPortTime[ip], port)
-			}
+// Reconfigure applies c to the IPBlocker without unblocking any host, blocks keep the expiry they were given. When the
+// table or chain of the iptables backend changes, the rules of blocked hosts are moved to it. The backend itself can't
+// be changed. Nothing is applied if the rules can't be moved.
+func (ipb *IPBlocker) Reconfigure(c BlockerConfig) error {
+	if r, ok := ipb.Backend.(relocator); ok {
+		if err := r.Relocate(c.Table, c.Chain); err != nil {
+			return err
 		}
 	}
 
-	return removedPorts
+	ipb.BlockTTL, ipb.MaxBlockTTL = c.BlockTTL, c.MaxBlockTTL
+	return nil
 }
 
-// AddPort updates the IPPortTime map with the port and time(unix epoch)
-func (ipb *IPBlocker) AddPort(localIP string, remoteIP string, port uint16, t int64) {
-	key := fmt.Sprintf("%s:%s", localIP, remoteIP)
-	if _, present := ipb.IPPortTime[key]; !present {
-		ipb.IPPortTime[key] = make(map[uint16]int64)
+// blockTTL returns how long a host is blocked for after offenses previous blocks. The BlockTTL doubles with every
+// offense up to the MaxBlockTTL, zero never expires.
+func (ipb *IPBlocker) blockTTL(offenses int) time.Duration {
+	ttl := ipb.BlockTTL
+	if ttl <= 0 {
+		return 0
 	}
 
-	ipb.IPPortTime[key][port] = t
+	for i := 0; i < offenses && ttl < ipb.MaxBlockTTL; i++ {
+		ttl *= 2
+	}
+	if ttl > ipb.MaxBlockTTL && ipb.MaxBlockTTL > 0 {
+		ttl = ipb.MaxBlockTTL
+	}
+	return ttl
 }
 
-// HostsToBlock checks for any remote hosts that has 3 or more ports connected from its IP
-// returns a slice of RemoteHost.
-func (ipb *IPBlocker) HostsToBlock() []RemoteHost {
-	var hosts []RemoteHost
+// BlockHosts blocks the remote hosts of verdicts through the Backend at unix time t, each block expires after the
+// blockTTL of the host. Allowlisted hosts are never blocked. In monitor mode the hosts are only logged and counted.
+// Hosts blocked already, or in a denylisted network, are skipped and every other decision is recorded. Returns a
+// *BlockError for every host that wasn't blocked, counted by kind in the block_errors metric.
+func (ipb *IPBlocker) BlockHosts(verdicts []Verdict, t int64) []error {
+	var errs []error
+	fail := func(v Verdict, err error) {
+		blockErr := &BlockError{IP: v.Host.RemoteIP, Reason: v.Reason, Err: err}
+		metrics.BlockErrors.WithLabelValues(blockErr.Kind()).Inc()
+		errs = append(errs, blockErr)
+	}
 
-	// key `LocalIP:RemoteIP` formatted string
-	for key, portMap := range ipb.IPPortTime {
-		if len(portMap) >= 3 {
+	for _, v := range verdicts {
+		host := v.Host
 
-			var ports []uint16
-			for port := range portMap {
-				ports = append(ports, port)
+		if ipb.Allowlist.Contains(host.RemoteIP) {
+			log.Printf("Not blocking allowlisted host: %s\n", v.String())
+			ipb.record(v, ActionAllowlisted, nil, t)
+			fail(v, ErrAllowlisted)
+			continue
+		}
 
-				delete(ipb.IPPortTime[key], port)
-			}
+		if ipb.Monitor {
+			log.Printf("Would block %s\n", v.String())
+			metrics.WouldBlock.WithLabelValues(v.Reason).Inc()
+			ipb.record(v, ActionWouldBlock, nil, t)
+			continue
+		}
+
+		// a host in a denylisted network is blocked already, and sets of intervals refuse overlapping elements
+		if ipb.isBlocked(host.RemoteIP) || ipb.isDenylisted(host.RemoteIP) {
+			continue
+		}
 
-			ips := strings.Split(key, ":")
-			hosts = append(hosts, RemoteHost{
-				RemoteIP: net.ParseIP(ips[1]),
-				LocalIP:  net.ParseIP(ips[0]),
-				Ports:    ports,
-			})
+		log.Printf("Detected %s\n", v.String())
+		err := ErrBackendUnavailable
+		if ipb.Backend != nil {
+			err = ipb.insertRule(host, v.Reason, t)
+		}
+		switch {
+		case errors.Is(err, ErrRuleExists):
+			// the rule is adopted as the block of the host, it is still counted as it wasn't inserted by us
+			ipb.record(v, ActionBlocked, err, t)
+			fail(v, err)
+		case err != nil:
+			ipb.record(v, ActionFailed, err, t)
+			fail(v, err)
+		default:
+			ipb.record(v, ActionBlocked, nil, t)
 		}
 	}
 
-	return hosts
+	ipb.saveState()
+	return errs
 }
 
-// BlockHosts inserts iptables entry to block hosts
-// Note: we are checking to make sure we don't block incoming from 0.0.0.0 or 127.0.0.1 but there may be a better set...
-// shortcut: assuming iptables is in use here and not nftables
-// shortcut: assuming default INPUT chain is available to use
-func (ipb *IPBlocker) BlockHosts(hosts []RemoteHost) []error {
-	var errs []error
-
-	for _, host := range hosts {
-		remoteIP := host.RemoteIP.String()
-
-		if remoteIP != "0.0.0.0" && remoteIP != "127.0.0.1" && !ipb.isBlocked(host.RemoteIP) {
-			log.Printf("Port scan detected: %s\n", host.String())
-
-			if ipb.IP4Table != nil {
-				err := ipb.insertRule(host.RemoteIP)
-				if err != nil {
-					log.Printf("Failed to insert block rule for %s: %v", remoteIP, err)
-				}
-			}
-		}
+// record records the action taken on v at unix time t and the error that made it fail, forgetting the oldest
+// decisions past MaxDecisions
+func (ipb *IPBlocker) record(v Verdict, action string, err error, t int64) {
+	d := Decision{
+		IP:       v.Host.RemoteIP,
+		Reason:   v.Reason,
+		Severity: v.Severity.String(),
+		Evidence: v.Evidence,
+		Ports:    v.Host.Ports,
+		Action:   action,
+		Time:     t,
+	}
+	if err != nil {
+		d.Error = err.Error()
 	}
+	ipb.decisions = append(ipb.decisions, d)
+	if len(ipb.decisions) > MaxDecisions {
+		ipb.decisions = append([]Decision{}, ipb.decisions[len(ipb.decisions)-MaxDecisions:]...)
+	}
+}
 
-	return errs
+// Decisions returns a copy of the recent decisions, oldest first
+func (ipb *IPBlocker) Decisions() []Decision {
+	return append([]Decision{}, ipb.decisions...)
 }
 
 func (ipb *IPBlocker) isBlocked(addr net.IP) bool {
-	for _, ip := range ipb.BlockedHosts {
-		if ip.Equal(addr) {
+	for _, host := range ipb.BlockedHosts {
+		if host.IP.Equal(addr) {
 			return true
 		}
 	}
 	return false
 }
 
-func (ipb *IPBlocker) insertRule(ip net.IP) error {
-	exist, err := ipb.IP4Table.Exists(Filter, Chain, "-s", ip.String(), "-j", "DROP")
+// insertRule blocks host through the Backend and records it as blocked. If the Backend blocks it already the rule is
+// recorded as the block of host and ErrRuleExists is returned, errors of the Backend are classified with backendError.
+func (ipb *IPBlocker) insertRule(host RemoteHost, reason string, t int64) error {
+	ip := host.RemoteIP
+	exist, err := ipb.Backend.Exists(hostNet(ip))
 	if err != nil {
-		return err
+		return backendError(err)
 	}
 
 	if exist {
-		return nil
+		ipb.block(ip, reason, host.Ports, t)
+		return ErrRuleExists
 	}
 
-	err = ipb.IP4Table.Insert("filter", "INPUT", 1, "-s", ip.String(), "-j", "DROP")
+	err = ipb.Backend.Block(hostNet(ip), ipb.blockTTL(ipb.Offenses[ip.String()]))
 	if err != nil {
-		return err
+		return backendError(err)
 	}
 
-	ipb.BlockedHosts = append(ipb.BlockedHosts, ip)
+	ipb.block(ip, reason, host.Ports, t)
 
 	return nil
 }
 
-// CleanUp is meant to clean up any iptable rules on the host
-func (ipb *IPBlocker) CleanUp() {
-	log.Printf("Cleaning up iptable entries made by connection watcher")
-	for _, ip := range ipb.BlockedHosts {
-		err := ipb.IP4Table.Delete(Filter, Chain, "-s", ip.String(), "-j", "DROP")
-		if err != nil {
-			log.Printf("Failed to remove iptable block for %s: %v", ip.String(), err)
+// block records ip as blocked for reason at unix time t and counts the offense
+func (ipb *IPBlocker) block(ip net.IP, reason string, ports []uint16, t int64) BlockedHost {
+	if ipb.Offenses == nil {
+		ipb.Offenses = make(map[string]int)
+	}
+	if ipb.LastOffenses == nil {
+		ipb.LastOffenses = make(map[string]int64)
+	}
+
+	host := BlockedHost{IP: ip, Reason: reason, Ports: ports, BlockedAt: t}
+	if ttl := ipb.blockTTL(ipb.Offenses[ip.String()]); ttl > 0 {
+		host.Expires = t + int64(ttl/time.Second)
+		log.Printf("Blocking %s for %v", ip, ttl)
+	}
+	ipb.Offenses[ip.String()]++
+	ipb.LastOffenses[ip.String()] = t
+
+	ipb.BlockedHosts = append(ipb.BlockedHosts, host)
+	metrics.BlockedHosts.WithLabelValues(reason).Inc()
+	return host
+}
+
+// ExpireBlocks removes the rules of hosts whose block has expired at unix time now and returns their IPs. A rule
+// that fails to be removed is kept and retried on the next call. Offenses that are no longer remembered at now are
+// forgotten.
+func (ipb *IPBlocker) ExpireBlocks(now int64) []net.IP {
+	var expired []net.IP
+	remaining := ipb.BlockedHosts[:0]
+	for _, host := range ipb.BlockedHosts {
+		if host.Expires == 0 || now < host.Expires {
+			remaining = append(remaining, host)
+			continue
+		}
+
+		if ipb.Backend != nil {
+			if err := ipb.Backend.Unblock(hostNet(host.IP)); err != nil {
+				log.Printf("Failed to remove expired block for %s: %v", host.IP, err)
+				remaining = append(remaining, host)
+				continue
+			}
+		}
+
+		log.Printf("Block expired for %s after %v", host.IP, time.Duration(host.Expires-host.BlockedAt)*time.Second)
+		expired = append(expired, host.IP)
+		metrics.BlockedHosts.WithLabelValues(host.Reason).Dec()
+		metrics.ExpiredBlocks.Inc()
+	}
+	ipb.BlockedHosts = remaining
+
+	if len(expired) > 0 || ipb.forgetOffenses(now) > 0 {
+		ipb.saveState()
+	}
+	return expired
+}
+
+// forgetOffenses forgets the offenses of hosts that aren't blocked and were last blocked OffenseRetention times the
+// longest block or more before unix time now, so the Offenses don't grow with every host ever blocked. Returns how
+// many hosts were forgotten.
+func (ipb *IPBlocker) forgetOffenses(now int64) int {
+	longest := ipb.MaxBlockTTL
+	if ipb.BlockTTL > longest {
+		longest = ipb.BlockTTL
+	}
+	retention := int64(OffenseRetention * longest / time.Second)
+
+	var forgotten int
+	for ip := range ipb.Offenses {
+		if now-ipb.LastOffenses[ip] < retention || ipb.isBlocked(net.ParseIP(ip)) {
+			continue
+		}
+		delete(ipb.Offenses, ip)
+		delete(ipb.LastOffenses, ip)
+		forgotten++
+	}
+	return forgotten
+}
+
+// UnblockAllowlisted removes the blocks of hosts that are in the Allowlist and returns their IPs, for hosts that were
+// blocked before being allowlisted
+func (ipb *IPBlocker) UnblockAllowlisted() []net.IP {
+	var unblocked []net.IP
+	remaining := ipb.BlockedHosts[:0]
+	for _, host := range ipb.BlockedHosts {
+		if !ipb.Allowlist.Contains(host.IP) {
+			remaining = append(remaining, host)
+			continue
+		}
+
+		if ipb.Backend != nil {
+			if err := ipb.Backend.Unblock(hostNet(host.IP)); err != nil {
+				log.Printf("Failed to remove block of allowlisted host %s: %v", host.IP, err)
+				remaining = append(remaining, host)
+				continue
+			}
 		}
+
+		log.Printf("Removed block of allowlisted host %s", host.IP)
+		unblocked = append(unblocked, host.IP)
+		metrics.BlockedHosts.WithLabelValues(host.Reason).Dec()
+	}
+	ipb.BlockedHosts = remaining
+
+	if len(unblocked) > 0 {
+		ipb.saveState()
+	}
+	return unblocked
+}
+
+// CleanUp is meant to clean up any blocks made on the host, along with anything the Backend created
+func (ipb *IPBlocker) CleanUp() {
+	if ipb.Backend == nil {
+		return
+	}
+
+	log.Printf("Cleaning up firewall entries made by connection watcher")
+	if err := ipb.Backend.CleanUp(); err != nil {
+		log.Printf("Failed to clean up firewall entries: %v", err)
+		return
+	}
+
+	// the hosts are no longer blocked, they must not be blocked again when the state is restored
+	for _, host := range ipb.BlockedHosts {
+		metrics.BlockedHosts.WithLabelValues(host.Reason).Dec()
+	}
+	metrics.BlockedHosts.WithLabelValues(ReasonDenylist).Set(0)
+	ipb.BlockedHosts = nil
+	ipb.Denylisted = nil
+	ipb.saveState()
+}
+
+// Block is a network blocked by the IPBlocker and why
+type Block struct {
+	Network string `json:"network"`
+	Reason  string `json:"reason"`
+	// Ports are the local ports a blocked host was observed connecting to
+	Ports []uint16 `json:"ports,omitempty"`
+	// BlockedAt and Expires are measured in seconds since the unix epoch, a zero Expires never expires
+	BlockedAt int64 `json:"blocked_at"`
+	Expires   int64 `json:"expires"`
+}
+
+// Blocks returns the blocked hosts followed by the denylisted networks
+func (ipb *IPBlocker) Blocks() []Block {
+	blocks := make([]Block, 0, len(ipb.BlockedHosts)+len(ipb.Denylisted))
+	for _, host := range ipb.BlockedHosts {
+		blocks = append(blocks, Block{
+			Network:   hostNet(host.IP).String(),
+			Reason:    host.Reason,
+			Ports:     host.Ports,
+			BlockedAt: host.BlockedAt,
+			Expires:   host.Expires,
+		})
+	}
+	for _, d := range ipb.Denylisted {
+		blocks = append(blocks, Block{Network: d.Net.String(), Reason: ReasonDenylist, BlockedAt: d.BlockedAt})
 	}
+	return blocks
 }
 
 // RemoteHost stores information needed to block and report blocked IPs
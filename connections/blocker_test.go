@@ -1,143 +1,279 @@
 package connections
 
 import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
 	"reflect"
 	"testing"
+	"time"
 )
 
-// shortcut: Test is flaky due to no guarantee on ordering in the slice. Helper functions to order the slices
-// of RemoteHost and Ports should fix this and allow for accurate testing with reflect.DeepEqual.
-//func TestIPBlocker_HostsToBlock(t *testing.T) {
-//	type fields struct {
-//		IPPortTime map[string]map[uint16]int64
-//	}
-//	tests := []struct {
-//		name   string
-//		fields fields
-//		want   []RemoteHost
-//	}{
-//		{
-//			name: "block 192.168.1.1",
-//			fields: fields{IPPortTime: map[string]map[uint16]int64{
-//				"192.168.1.1": {80: 10, 81: 20, 82: 30},
-//			}},
-//			want: []RemoteHost{{
-//				RemoteIP: net.ParseIP("192.168.1.1"),
-//				Ports: []uint16{80, 81, 82},
-//				},
-//			},
-//		},
-//		{
-//			name: "block 192.168.1.1 and 192.168.1.2",
-//			fields: fields{IPPortTime: map[string]map[uint16]int64{
-//				"192.168.1.1": {80: 10, 81: 20, 82: 30},
-//				"192.168.1.2": {80: 10, 81: 20, 82: 30},
-//			}},
-//			want: []RemoteHost{
-//				{
-//					RemoteIP: net.ParseIP("192.168.1.1"),
-//					Ports: []uint16{80, 81, 82},
-//				},
-//				{
-//					RemoteIP: net.ParseIP("192.168.1.2"),
-//					Ports: []uint16{80, 81, 82},
-//				},
-//			},
-//		},
-//	}
-//	for _, tt := range tests {
-//		t.Run(tt.name, func(t *testing.T) {
-//			ipb := &IPBlocker{
-//				IPPortTime: tt.fields.IPPortTime,
-//			}
-//			if got := ipb.HostsToBlock(); !reflect.DeepEqual(got, tt.want) {
-//				t.Errorf("HostsToBlock() = %v, want %v", got, tt.want)
-//			}
-//		})
-//	}
-//}
-
-func TestIPBlocker_RemoveOldConnections(t *testing.T) {
-	type fields struct {
-		IPPortTime map[string]map[uint16]int64
-	}
-	type args struct {
-		now int64
-		ttl int64
+func TestIPBlocker_Reconfigure(t *testing.T) {
+	table := newFakeTable(map[string][]string{
+		"filter/INPUT":       {"-j CONNWATCHER"},
+		"filter/CONNWATCHER": {"-s 192.168.1.1/32 -m comment --comment connectionWatcher -j DROP"},
+		"raw/PREROUTING":     nil,
+	})
+	backend := &IPTablesBackend{IP4Table: table}
+	ipb := &IPBlocker{
+		BlockedHosts: []BlockedHost{{IP: net.ParseIP("192.168.1.1")}},
+		Backend:      backend,
 	}
+
+	err := ipb.Reconfigure(BlockerConfig{Table: "raw", Chain: "PREROUTING"})
+	if err != nil {
+		t.Fatalf("Reconfigure() error = %v", err)
+	}
+
+	if backend.Table != "raw" || backend.Chain != "PREROUTING" {
+		t.Errorf("Reconfigure() = %s/%s, want raw/PREROUTING", backend.Table, backend.Chain)
+	}
+	if ok, _ := table.Exists("raw", "PREROUTING", "-j", "CONNWATCHER"); !ok {
+		t.Errorf("Reconfigure() chains = %v, want jump in raw/PREROUTING", table.chains)
+	}
+	if ok, _ := table.Exists("filter", "INPUT", "-j", "CONNWATCHER"); ok {
+		t.Errorf("Reconfigure() chains = %v, want jump removed from filter/INPUT", table.chains)
+	}
+	nets, err := backend.List()
+	if err != nil || len(nets) != 1 || nets[0].String() != "192.168.1.1/32" {
+		t.Errorf("Reconfigure() List() = %v, %v, want 192.168.1.1/32 moved to raw", nets, err)
+	}
+	if len(ipb.BlockedHosts) != 1 {
+		t.Errorf("Reconfigure() BlockedHosts = %v, want blocked hosts kept", ipb.BlockedHosts)
+	}
+}
+
+// stuckBackend is a Backend whose blocks can't be moved
+type stuckBackend struct {
+	*fakeBackend
+}
+
+func (b stuckBackend) Relocate(table, chain string) error {
+	return errors.New("table raw: permission denied")
+}
+
+func TestIPBlocker_Reconfigure_failedRelocation(t *testing.T) {
+	ipb := &IPBlocker{
+		Backend:     stuckBackend{newFakeBackend()},
+		BlockTTL:    time.Hour,
+		MaxBlockTTL: 24 * time.Hour,
+	}
+
+	err := ipb.Reconfigure(BlockerConfig{Table: "raw", Chain: "PREROUTING", BlockTTL: time.Minute, MaxBlockTTL: time.Hour})
+	if err == nil {
+		t.Fatalf("Reconfigure() error = nil, want relocation error")
+	}
+	if ipb.BlockTTL != time.Hour || ipb.MaxBlockTTL != 24*time.Hour {
+		t.Errorf("Reconfigure() BlockTTL, MaxBlockTTL = %v, %v, want previous 1h0m0s, 24h0m0s", ipb.BlockTTL, ipb.MaxBlockTTL)
+	}
+}
+
+func TestIPBlocker_blockTTL(t *testing.T) {
 	tests := []struct {
-		name   string
-		fields fields
-		args   args
-		want   []uint16
+		name        string
+		blockTTL    time.Duration
+		maxBlockTTL time.Duration
+		offenses    int
+		want        time.Duration
 	}{
+		{name: "first offense", blockTTL: time.Hour, maxBlockTTL: 24 * time.Hour, offenses: 0, want: time.Hour},
+		{name: "third offense", blockTTL: time.Hour, maxBlockTTL: 24 * time.Hour, offenses: 2, want: 4 * time.Hour},
+		{name: "capped", blockTTL: time.Hour, maxBlockTTL: 24 * time.Hour, offenses: 10, want: 24 * time.Hour},
+		{name: "no max", blockTTL: time.Hour, offenses: 3, want: time.Hour},
+		{name: "never expires", offenses: 3, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ipb := &IPBlocker{BlockTTL: tt.blockTTL, MaxBlockTTL: tt.maxBlockTTL}
+			if got := ipb.blockTTL(tt.offenses); got != tt.want {
+				t.Errorf("blockTTL() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIPBlocker_ExpireBlocks(t *testing.T) {
+	ipb := &IPBlocker{BlockTTL: time.Minute, MaxBlockTTL: time.Hour}
+	first := ipb.block(net.ParseIP("192.168.1.1"), ReasonPortScan, nil, 100)
+	ipb.block(net.ParseIP("2001:db8::1"), ReasonPortScan, nil, 130)
+
+	if first.Expires != 160 {
+		t.Fatalf("block() Expires = %d, want 160", first.Expires)
+	}
+
+	if got := ipb.ExpireBlocks(159); len(got) != 0 {
+		t.Errorf("ExpireBlocks(159) = %v, want none", got)
+	}
+	if got := ipb.ExpireBlocks(160); len(got) != 1 || !got[0].Equal(net.ParseIP("192.168.1.1")) {
+		t.Errorf("ExpireBlocks(160) = %v, want [192.168.1.1]", got)
+	}
+	if len(ipb.BlockedHosts) != 1 || ipb.isBlocked(net.ParseIP("192.168.1.1")) {
+		t.Errorf("ExpireBlocks() BlockedHosts = %v, want only 2001:db8::1", ipb.BlockedHosts)
+	}
+
+	// a repeat offender is blocked for twice as long
+	if again := ipb.block(net.ParseIP("192.168.1.1"), ReasonPortScan, nil, 200); again.Expires != 320 {
+		t.Errorf("block() repeat Expires = %d, want 320", again.Expires)
+	}
+}
+
+func TestIPBlocker_ExpireBlocks_forgetOffenses(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	ipb := &IPBlocker{BlockTTL: time.Minute, MaxBlockTTL: time.Hour}
+	ipb.block(net.ParseIP("192.168.1.1"), ReasonPortScan, nil, 100)
+	ipb.block(net.ParseIP("192.168.1.2"), ReasonPortScan, nil, 100)
+	ipb.block(net.ParseIP("192.168.1.1"), ReasonPortScan, nil, 1000)
+	// blocked until the process exits, its offense is kept however old
+	ipb.BlockedHosts = append(ipb.BlockedHosts, BlockedHost{IP: net.ParseIP("192.168.1.3"), BlockedAt: 100})
+	ipb.Offenses["192.168.1.3"], ipb.LastOffenses["192.168.1.3"] = 1, 100
+
+	// retained for 4 times the max block ttl after the last offense
+	ipb.ExpireBlocks(100 + 4*3600 - 1)
+	if len(ipb.Offenses) != 3 {
+		t.Errorf("ExpireBlocks() Offenses = %v, want every offense remembered", ipb.Offenses)
+	}
+
+	ipb.ExpireBlocks(100 + 4*3600)
+	want := map[string]int{"192.168.1.1": 2, "192.168.1.3": 1}
+	if !reflect.DeepEqual(ipb.Offenses, want) {
+		t.Errorf("ExpireBlocks() Offenses = %v, want %v", ipb.Offenses, want)
+	}
+	if _, present := ipb.LastOffenses["192.168.1.2"]; present {
+		t.Errorf("ExpireBlocks() LastOffenses = %v, want 192.168.1.2 forgotten", ipb.LastOffenses)
+	}
+}
+
+func TestIPBlocker_BlockHosts(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	scan := Verdict{
+		Host:     RemoteHost{RemoteIP: net.ParseIP("192.168.1.1"), Ports: []uint16{22, 80, 443}},
+		Reason:   ReasonPortScan,
+		Severity: SeverityMedium,
+	}
+	allowlisted := Verdict{Host: RemoteHost{RemoteIP: net.ParseIP("10.0.0.1")}, Reason: DetectorRate}
+
+	tests := []struct {
+		name        string
+		backend     *fakeBackend
+		monitor     bool
+		denylisted  string
+		wantBlocked []string
+		wantHosts   []string
+		wantActions []string
+		wantErrs    []string
+	}{
+		{
+			name:        "enforce",
+			backend:     newFakeBackend(),
+			wantBlocked: []string{"192.168.1.1/32"},
+			wantHosts:   []string{"192.168.1.1"},
+			wantActions: []string{ActionBlocked, ActionAllowlisted},
+			wantErrs:    []string{ErrorKindAllowlisted},
+		},
 		{
-			name: "remove all",
-			fields: fields{IPPortTime: map[string]map[uint16]int64{
-				"192.168.1.1": {80: 40, 81: 50, 82: 60},
-			}},
-			args: args{
-				now: 90,
-				ttl: 30,
-			},
-			want: []uint16{80, 81, 82},
+			name:        "monitor",
+			backend:     newFakeBackend(),
+			monitor:     true,
+			wantActions: []string{ActionWouldBlock, ActionAllowlisted},
+			wantErrs:    []string{ErrorKindAllowlisted},
 		},
 		{
-			name: "remove 80",
-			fields: fields{IPPortTime: map[string]map[uint16]int64{
-				"192.168.1.1": {80: 40, 81: 50, 82: 60},
-			}},
-			args: args{
-				now: 70,
-				ttl: 30,
-			},
-			want: []uint16{80},
+			name:        "no backend",
+			wantActions: []string{ActionFailed, ActionAllowlisted},
+			wantErrs:    []string{ErrorKindBackendUnavailable, ErrorKindAllowlisted},
 		},
 		{
-			name: "remove none",
-			fields: fields{IPPortTime: map[string]map[uint16]int64{
-				"192.168.1.1": {80: 40, 81: 50, 82: 60},
-			}},
-			args: args{
-				now: 60,
-				ttl: 30,
-			},
-			want: nil,
+			name:        "rule exists",
+			backend:     newFakeBackend("192.168.1.1/32"),
+			wantBlocked: []string{"192.168.1.1/32"},
+			wantHosts:   []string{"192.168.1.1"},
+			wantActions: []string{ActionBlocked, ActionAllowlisted},
+			wantErrs:    []string{ErrorKindRuleExists, ErrorKindAllowlisted},
+		},
+		{
+			name:        "in a denylisted network",
+			backend:     newFakeBackend("192.168.1.0/24"),
+			denylisted:  "192.168.1.0/24",
+			wantBlocked: []string{"192.168.1.0/24"},
+			wantActions: []string{ActionAllowlisted},
+			wantErrs:    []string{ErrorKindAllowlisted},
+		},
+		{
+			name:        "permission denied",
+			backend:     &fakeBackend{blocked: map[string]time.Duration{}, blockErr: errors.New("iptables: Permission denied (you must be root)")},
+			wantActions: []string{ActionFailed, ActionAllowlisted},
+			wantErrs:    []string{ErrorKindPermissionDenied, ErrorKindAllowlisted},
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			ipb := &IPBlocker{
-				IPPortTime: tt.fields.IPPortTime,
+				Allowlist: &Allowlist{Nets: []*net.IPNet{hostNet(net.ParseIP("10.0.0.1"))}},
+				Monitor:   tt.monitor,
+			}
+			if tt.backend != nil {
+				ipb.Backend = tt.backend
+			}
+			if tt.denylisted != "" {
+				_, n, _ := net.ParseCIDR(tt.denylisted)
+				ipb.Denylisted = []DenylistedNet{{Net: n}}
 			}
+			errs := ipb.BlockHosts([]Verdict{scan, allowlisted}, 100)
 
-			if got := ipb.RemoveOldConnections(tt.args.now, tt.args.ttl); !containsSamePorts(got, tt.want) {
-				t.Errorf("RemoveOldConnections() = %v, want %v", got, tt.want)
+			var kinds []string
+			for _, err := range errs {
+				var blockErr *BlockError
+				if !errors.As(err, &blockErr) {
+					t.Fatalf("BlockHosts() error %v is not a *BlockError", err)
+				}
+				kinds = append(kinds, blockErr.Kind())
+			}
+			if !reflect.DeepEqual(kinds, tt.wantErrs) {
+				t.Errorf("BlockHosts() errors = %v, want %v", errs, tt.wantErrs)
+			}
+
+			var blocked []string
+			if tt.backend != nil {
+				for n := range tt.backend.blocked {
+					blocked = append(blocked, n)
+				}
+			}
+			if !reflect.DeepEqual(blocked, tt.wantBlocked) {
+				t.Errorf("BlockHosts() backend = %v, want %v", blocked, tt.wantBlocked)
+			}
+			var hosts []string
+			for _, host := range ipb.BlockedHosts {
+				hosts = append(hosts, host.IP.String())
+			}
+			if !reflect.DeepEqual(hosts, tt.wantHosts) {
+				t.Errorf("BlockHosts() BlockedHosts = %v, want %v", hosts, tt.wantHosts)
+			}
+
+			var actions []string
+			for _, d := range ipb.Decisions() {
+				actions = append(actions, d.Action)
+			}
+			if !reflect.DeepEqual(actions, tt.wantActions) {
+				t.Errorf("Decisions() actions = %v, want %v", actions, tt.wantActions)
 			}
 		})
 	}
 }
 
-func containsSamePorts(a, b []uint16) bool {
-	if len(a) != len(b) {
-		return false
-	}
-
-	present := func(item uint16, slice []uint16) bool {
-		for _, s := range slice {
-			if s == item {
-				return true
-			}
-		}
-		return false
+func TestIPBlocker_record(t *testing.T) {
+	ipb := &IPBlocker{}
+	for i := 0; i < MaxDecisions+10; i++ {
+		ipb.record(Verdict{Host: RemoteHost{RemoteIP: net.ParseIP("192.168.1.1")}}, ActionWouldBlock, nil, int64(i))
 	}
 
-	for _, i := range b {
-		if !present(i, a) {
-			return false
-		}
+	decisions := ipb.Decisions()
+	if len(decisions) != MaxDecisions || decisions[0].Time != 10 {
+		t.Errorf("Decisions() = %d from %d, want %d from 10", len(decisions), decisions[0].Time, MaxDecisions)
 	}
-	return true
 }
 
 func TestNewIPBlocker(t *testing.T) {
@@ -149,7 +285,7 @@ func TestNewIPBlocker(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := NewIPBlocker(); !reflect.DeepEqual(got, tt.want) {
+			if got := NewIPBlocker(BlockerConfig{}); !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("NewIPBlocker() = %v, want %v", got, tt.want)
 			}
 		})
@@ -0,0 +1,169 @@
+package connections
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rcanderson23/connectionWatcher/metrics"
+)
+
+// StateVersion is the version of the state file format written by SaveState, LoadState refuses any other
+const StateVersion = 1
+
+// State is what an IPBlocker saves to keep its blocks across restarts
+type State struct {
+	Version  int            `json:"version"`
+	Hosts    []BlockedHost  `json:"hosts"`
+	Offenses map[string]int `json:"offenses,omitempty"`
+	// LastOffenses are measured in seconds since the unix epoch
+	LastOffenses map[string]int64 `json:"last_offenses,omitempty"`
+}
+
+// LoadState reads the State saved at path, a file that doesn't exist is an empty State
+func LoadState(path string) (State, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return State{Version: StateVersion}, nil
+	}
+	if err != nil {
+		return State{}, fmt.Errorf("failed to read state file: %v", err)
+	}
+
+	var s State
+	if err := json.Unmarshal(b, &s); err != nil {
+		return State{}, fmt.Errorf("failed to parse state file %s: %v", path, err)
+	}
+	if s.Version != StateVersion {
+		return State{}, fmt.Errorf("unsupported state file version %d in %s, expected %d", s.Version, path, StateVersion)
+	}
+
+	return s, nil
+}
+
+// SaveState writes s to path atomically, the file is written next to path and renamed over it so a crash leaves
+// either the previous or the new State
+func SaveState(path string, s State) error {
+	s.Version = StateVersion
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create state file: %v", err)
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write state file: %v", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write state file: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write state file: %v", err)
+	}
+
+	if err := os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace state file: %v", err)
+	}
+	return nil
+}
+
+// State returns the blocked hosts and offenses of the IPBlocker
+func (ipb *IPBlocker) State() State {
+	return State{
+		Version:      StateVersion,
+		Hosts:        ipb.BlockedHosts,
+		Offenses:     ipb.Offenses,
+		LastOffenses: ipb.LastOffenses,
+	}
+}
+
+// saveState saves the State to the StatePath, a failure is only logged as the blocks themselves are in place
+func (ipb *IPBlocker) saveState() {
+	if ipb.StatePath == "" {
+		return
+	}
+
+	if err := SaveState(ipb.StatePath, ipb.State()); err != nil {
+		log.Printf("Failed to save block state: %v", err)
+	}
+}
+
+// Restore blocks the hosts of s again at unix time now, reconciling them with the Backend. Blocks that expired while
+// the IPBlocker wasn't running, or of hosts that have been allowlisted since, are removed from the Backend. The others
+// are blocked for the rest of their ttl unless the Backend has them already. Hosts that can't be blocked are dropped
+// from the state. Offenses saved without the time of the last one are remembered as of now.
+func (ipb *IPBlocker) Restore(s State, now int64) {
+	if ipb.Offenses == nil {
+		ipb.Offenses = make(map[string]int)
+	}
+	if ipb.LastOffenses == nil {
+		ipb.LastOffenses = make(map[string]int64)
+	}
+	for ip, offenses := range s.Offenses {
+		ipb.Offenses[ip] = offenses
+		last, present := s.LastOffenses[ip]
+		if !present {
+			last = now
+		}
+		ipb.LastOffenses[ip] = last
+	}
+
+	var restored, expired int
+	for _, host := range s.Hosts {
+		if host.IP == nil || ipb.isBlocked(host.IP) {
+			continue
+		}
+
+		if (host.Expires != 0 && now >= host.Expires) || ipb.Allowlist.Contains(host.IP) {
+			if ipb.Backend != nil {
+				if err := ipb.Backend.Unblock(hostNet(host.IP)); err != nil {
+					log.Printf("Failed to remove expired block for %s: %v", host.IP, err)
+				}
+			}
+			expired++
+			continue
+		}
+
+		if ipb.Backend != nil {
+			if err := ipb.restoreRule(host, now); err != nil {
+				log.Printf("Failed to restore block for %s: %v", host.IP, err)
+				continue
+			}
+		}
+
+		ipb.BlockedHosts = append(ipb.BlockedHosts, host)
+		metrics.BlockedHosts.WithLabelValues(host.Reason).Inc()
+		restored++
+	}
+
+	log.Printf("Restored %d blocked hosts, removed %d expired or allowlisted blocks", restored, expired)
+	ipb.saveState()
+}
+
+// restoreRule blocks host in the Backend for the rest of its ttl unless it is blocked already
+func (ipb *IPBlocker) restoreRule(host BlockedHost, now int64) error {
+	exist, err := ipb.Backend.Exists(hostNet(host.IP))
+	if err != nil {
+		return err
+	}
+	if exist {
+		return nil
+	}
+
+	var ttl time.Duration
+	if host.Expires != 0 {
+		ttl = time.Duration(host.Expires-now) * time.Second
+	}
+	return ipb.Backend.Block(hostNet(host.IP), ttl)
+}
@@ -0,0 +1,170 @@
+package connections
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeBackend is a Backend keeping its blocks in memory, Block fails with blockErr if set
+type fakeBackend struct {
+	blocked  map[string]time.Duration
+	blockErr error
+}
+
+func newFakeBackend(nets ...string) *fakeBackend {
+	b := &fakeBackend{blocked: make(map[string]time.Duration)}
+	for _, n := range nets {
+		b.blocked[n] = 0
+	}
+	return b
+}
+
+func (b *fakeBackend) Block(n *net.IPNet, ttl time.Duration) error {
+	if b.blockErr != nil {
+		return b.blockErr
+	}
+	b.blocked[n.String()] = ttl
+	return nil
+}
+
+func (b *fakeBackend) Unblock(n *net.IPNet) error {
+	delete(b.blocked, n.String())
+	return nil
+}
+
+func (b *fakeBackend) Exists(n *net.IPNet) (bool, error) {
+	_, ok := b.blocked[n.String()]
+	return ok, nil
+}
+
+func (b *fakeBackend) List() ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for s := range b.blocked {
+		_, n, _ := net.ParseCIDR(s)
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func (b *fakeBackend) CleanUp() error {
+	b.blocked = make(map[string]time.Duration)
+	return nil
+}
+
+func TestSaveState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	want := State{
+		Version: StateVersion,
+		Hosts: []BlockedHost{
+			{IP: net.ParseIP("10.192.1.21"), Reason: ReasonPortScan, Ports: []uint16{22, 80, 443}, BlockedAt: 100, Expires: 3700},
+			{IP: net.ParseIP("2001:db8::1"), Reason: ReasonPortScan, BlockedAt: 200},
+		},
+		Offenses:     map[string]int{"10.192.1.21": 2, "2001:db8::1": 1},
+		LastOffenses: map[string]int64{"10.192.1.21": 100, "2001:db8::1": 200},
+	}
+	if err := SaveState(path, want); err != nil {
+		t.Fatalf("SaveState() error = %v", err)
+	}
+
+	got, err := LoadState(path)
+	if err != nil {
+		t.Fatalf("LoadState() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("LoadState() = %+v, want %+v", got, want)
+	}
+
+	files, _ := ioutil.ReadDir(filepath.Dir(path))
+	if len(files) != 1 {
+		t.Errorf("SaveState() left %d files, want only the state file", len(files))
+	}
+}
+
+func TestLoadState(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		content string
+		want    State
+		wantErr string
+	}{
+		{
+			name: "missing file",
+			want: State{Version: StateVersion},
+		},
+		{
+			name:    "unsupported version",
+			content: `{"version": 2, "hosts": []}`,
+			wantErr: "unsupported state file version 2",
+		},
+		{
+			name:    "corrupt",
+			content: `{"version": 1, "hosts": [`,
+			wantErr: "failed to parse state file",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, tt.name)
+			if tt.content != "" {
+				if err := ioutil.WriteFile(path, []byte(tt.content), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got, err := LoadState(path)
+			if (err != nil) != (tt.wantErr != "") || (err != nil && !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("LoadState() error = %v, want %q", err, tt.wantErr)
+			}
+			if err == nil && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("LoadState() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIPBlocker_Restore(t *testing.T) {
+	backend := newFakeBackend("10.192.1.22/32", "10.192.1.23/32")
+	ipb := &IPBlocker{Backend: backend}
+
+	ipb.Restore(State{
+		Version: StateVersion,
+		Hosts: []BlockedHost{
+			// missing from the backend, blocked for the rest of its ttl
+			{IP: net.ParseIP("10.192.1.21"), Reason: ReasonPortScan, BlockedAt: 100, Expires: 3700},
+			// still in the backend
+			{IP: net.ParseIP("10.192.1.22"), Reason: ReasonPortScan, BlockedAt: 100},
+			// expired while stopped
+			{IP: net.ParseIP("10.192.1.23"), Reason: ReasonPortScan, BlockedAt: 100, Expires: 200},
+		},
+		Offenses:     map[string]int{"10.192.1.21": 3, "10.192.1.24": 1},
+		LastOffenses: map[string]int64{"10.192.1.21": 100},
+	}, 700)
+
+	var got []string
+	for _, host := range ipb.BlockedHosts {
+		got = append(got, host.IP.String())
+	}
+	if want := []string{"10.192.1.21", "10.192.1.22"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Restore() BlockedHosts = %v, want %v", got, want)
+	}
+
+	wantBackend := map[string]time.Duration{"10.192.1.21/32": 3000 * time.Second, "10.192.1.22/32": 0}
+	if !reflect.DeepEqual(backend.blocked, wantBackend) {
+		t.Errorf("Restore() backend = %v, want %v", backend.blocked, wantBackend)
+	}
+	if ipb.Offenses["10.192.1.21"] != 3 {
+		t.Errorf("Restore() Offenses = %v, want offenses restored", ipb.Offenses)
+	}
+	// offenses saved without their time are remembered as of the restore
+	wantLast := map[string]int64{"10.192.1.21": 100, "10.192.1.24": 700}
+	if !reflect.DeepEqual(ipb.LastOffenses, wantLast) {
+		t.Errorf("Restore() LastOffenses = %v, want %v", ipb.LastOffenses, wantLast)
+	}
+}
@@ -6,99 +6,221 @@ import (
 	"io"
 	"log"
 	"net"
-	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/rcanderson23/connectionWatcher/metrics"
 )
 
-const (
-	MinEphemeralPort = uint16(32768)
-	MaxEphemeralPort = uint16(60999)
-)
-
 // Connection stores the connection tuple
 type Connection struct {
 	LocalIP    net.IP
 	LocalPort  uint16
 	RemoteIP   net.IP
 	RemotePort uint16
+	State      TCPState
+	// Direction is set by the ConnectionWatcher using the listeners of the observation the connection was found in
+	Direction Direction
+	// FirstSeen and LastSeen are the unix times of the first and last observations the connection was found in, set
+	// by the ConnectionWatcher
+	FirstSeen int64
+	LastSeen  int64
+}
+
+// Key returns the connection tuple as a string, IPv6 addresses are bracketed so the key is unambiguous
+func (c Connection) Key() string {
+	local := net.JoinHostPort(c.LocalIP.String(), strconv.Itoa(int(c.LocalPort)))
+	remote := net.JoinHostPort(c.RemoteIP.String(), strconv.Itoa(int(c.RemotePort)))
+	return fmt.Sprintf("%s:%s", local, remote)
 }
 
 // ConnectionWatcher holds connection state to be compared against and updated at every observation
 type ConnectionWatcher struct {
 	Connections map[string]Connection
+	Source      Source
 	Blocker     *IPBlocker
-	IgnoredIPs  []net.IP
+	// Detection is given the inbound connections of every observation, nothing is detected if nil
+	Detection *Detection
+	// Allowlist are the remote hosts whose connections are never given to the Detection
+	Allowlist *Allowlist
+	// EphemeralPorts is used to guess direction when an observation has no listening sockets
+	EphemeralPorts PortRange
+
+	// observed is true once the Source has been read, the connections of the first observation were open before it
+	// and aren't new
+	observed bool
 }
 
-// NewConnectionWatcher returns a pointer to a new ConnectionWatcher that includes the provided IPBlocker
-// as well as a set of IPs that should not be inserted into the IPBlocker
-func NewConnectionWatcher(blocker *IPBlocker) *ConnectionWatcher {
-	return &ConnectionWatcher{
+// NewConnectionWatcher returns a pointer to a new ConnectionWatcher that observes the provided Source and includes the
+// provided IPBlocker. The zero PortRange for ephemeral reads the range from the kernel.
+func NewConnectionWatcher(source Source, blocker *IPBlocker, ephemeral PortRange) *ConnectionWatcher {
+	cw := &ConnectionWatcher{
 		Connections: make(map[string]Connection),
+		Source:      source,
 		Blocker:     blocker,
 	}
+	cw.SetEphemeralPorts(ephemeral)
+
+	return cw
 }
 
-// Observe opens the provided file path and populates the ConnectionWatcher structure with the contents of the file
-func (cw *ConnectionWatcher) Observe(path string, t int64) {
-	f, err := os.Open(path)
-	if err != nil {
-		log.Printf("failed to open file: %v", err)
-		return
+// SetEphemeralPorts sets the EphemeralPorts, the zero PortRange reads the range from the kernel
+func (cw *ConnectionWatcher) SetEphemeralPorts(ephemeral PortRange) {
+	if ephemeral == (PortRange{}) {
+		var err error
+		ephemeral, err = ReadPortRange(EphemeralPortRangePath)
+		if err != nil {
+			log.Printf("Failed to read ephemeral port range: %v. Using default %d-%d.", err, DefaultEphemeralRange.Min, DefaultEphemeralRange.Max)
+			ephemeral = DefaultEphemeralRange
+		}
 	}
-	defer f.Close()
 
-	obsConns, err := getConnections(f)
+	cw.EphemeralPorts = ephemeral
+}
+
+// Observe reads the connections from the Source and populates the ConnectionWatcher structure with them
+func (cw *ConnectionWatcher) Observe(t int64) {
+	obsConns, err := cw.Source.Connections()
 	if err != nil {
+		// keep the previous observation rather than treating every connection as closed
 		log.Printf("failed to check new connections: %v", err)
 		return
 	}
 
-	cw.updateIPBlocker(obsConns, t)
-	printNewConnections(obsConns, cw.Connections)
+	cw.setDirections(obsConns)
+	cw.setSeen(obsConns, t)
+	newConns := newConnections(obsConns, cw.Connections)
+	if !cw.observed {
+		log.Printf("Observed %d open connections", len(obsConns))
+		newConns = make(map[string]Connection)
+		cw.observed = true
+	}
+	// the connections of the previous observation missing from this one have closed
+	closedConns := newConnections(cw.Connections, obsConns)
+	cw.updateDetection(obsConns, newConns, t)
+	printNewConnections(newConns)
+	printClosedConnections(closedConns)
 
 	// Connections are now equal to what was observed
 	cw.Connections = obsConns
 }
 
-// updateIPBlocker only updates the blocker when the local port isn't in the ephemeral range
-func (cw *ConnectionWatcher) updateIPBlocker(conns map[string]Connection, t int64) {
-	for _, conn := range conns {
-		if !IsEphemeralPort(conn.LocalPort) {
-			cw.Blocker.AddPort(conn.LocalIP.String(), conn.RemoteIP.String(), conn.LocalPort, t)
+// setDirections classifies every connection in conns as inbound or outbound using the listeners found in conns
+func (cw *ConnectionWatcher) setDirections(conns map[string]Connection) {
+	l := newListeners(conns)
+	for key, conn := range conns {
+		conn.Direction = direction(conn, l, cw.EphemeralPorts)
+		conns[key] = conn
+	}
+}
+
+// setSeen sets when every connection in conns was first seen from the previous observation, and that it was last
+// seen at unix time t
+func (cw *ConnectionWatcher) setSeen(conns map[string]Connection, t int64) {
+	for key, conn := range conns {
+		conn.FirstSeen = t
+		if past, present := cw.Connections[key]; present {
+			conn.FirstSeen = past.FirstSeen
+		}
+		conn.LastSeen = t
+		conns[key] = conn
+	}
+}
+
+// newConnections returns the connections of obs that weren't in the past observation
+func newConnections(obs map[string]Connection, past map[string]Connection) map[string]Connection {
+	added := make(map[string]Connection)
+	for key, conn := range obs {
+		if _, present := past[key]; !present {
+			added[key] = conn
 		}
 	}
+	return added
 }
 
-// shortcut: we are assuming that if the local port is in the default ephemeral range, it is the local host connecting
-// out. This isn't guaranteed but increases the accuracy of the printed logs.
-func printNewConnections(obs map[string]Connection, past map[string]Connection) {
+// updateDetection only gives the Detection inbound connections in a detectable state from hosts that aren't
+// allowlisted. The connections in newConns are observed as new.
+func (cw *ConnectionWatcher) updateDetection(conns map[string]Connection, newConns map[string]Connection, t int64) {
+	if cw.Detection == nil {
+		return
+	}
+
+	for key, conn := range conns {
+		if conn.State.Detectable() && conn.Direction == Inbound && !cw.Allowlist.Contains(conn.RemoteIP) {
+			_, isNew := newConns[key]
+			cw.Detection.Observe(Observation{
+				LocalIP:   conn.LocalIP.String(),
+				RemoteIP:  conn.RemoteIP.String(),
+				LocalPort: conn.LocalPort,
+				New:       isNew,
+				HalfOpen:  conn.State.HalfOpen(),
+				Time:      t,
+			})
+		}
+	}
+}
+
+func printNewConnections(obs map[string]Connection) {
 	for i := range obs {
-		if _, present := past[i]; !present {
-			if IsEphemeralPort(obs[i].LocalPort) {
-				log.Printf("New connection %s:%d -> %s:%d\n", obs[i].LocalIP, obs[i].LocalPort, obs[i].RemoteIP, obs[i].RemotePort)
-			} else {
-				log.Printf("New connection %s:%d -> %s:%d\n", obs[i].RemoteIP, obs[i].RemotePort, obs[i].LocalIP, obs[i].LocalPort)
-			}
-			metrics.NewConnections.Inc()
+		if !obs[i].State.Detectable() {
+			continue
+		}
+
+		switch {
+		case obs[i].State.HalfOpen():
+			log.Printf("New half-open connection %s:%d -> %s:%d\n", obs[i].RemoteIP, obs[i].RemotePort, obs[i].LocalIP, obs[i].LocalPort)
+			metrics.HalfOpenConnections.Inc()
+		case obs[i].Direction == Outbound:
+			log.Printf("New connection %s:%d -> %s:%d\n", obs[i].LocalIP, obs[i].LocalPort, obs[i].RemoteIP, obs[i].RemotePort)
+		default:
+			log.Printf("New connection %s:%d -> %s:%d\n", obs[i].RemoteIP, obs[i].RemotePort, obs[i].LocalIP, obs[i].LocalPort)
+		}
+		metrics.NewConnections.Inc()
+	}
+}
+
+// printClosedConnections logs every closed connection with how long it was observed for, which is also recorded in
+// the connection duration histogram. A connection found in a single observation was observed for 0s.
+func printClosedConnections(closed map[string]Connection) {
+	for _, conn := range closed {
+		if !conn.State.Detectable() {
+			continue
+		}
+
+		duration := time.Duration(conn.LastSeen-conn.FirstSeen) * time.Second
+		firstSeen := time.Unix(conn.FirstSeen, 0).UTC().Format(time.RFC3339)
+		lastSeen := time.Unix(conn.LastSeen, 0).UTC().Format(time.RFC3339)
+		if conn.Direction == Outbound {
+			log.Printf("Connection closed %s:%d -> %s:%d after %v, first seen %s, last seen %s\n", conn.LocalIP, conn.LocalPort, conn.RemoteIP, conn.RemotePort, duration, firstSeen, lastSeen)
+		} else {
+			log.Printf("Connection closed %s:%d -> %s:%d after %v, first seen %s, last seen %s\n", conn.RemoteIP, conn.RemotePort, conn.LocalIP, conn.LocalPort, duration, firstSeen, lastSeen)
 		}
+
+		metrics.ClosedConnections.Inc()
+		metrics.ConnectionDuration.WithLabelValues(conn.Direction.String()).Observe(duration.Seconds())
 	}
 }
 
 // getConnections accepts an io.Reader and returns a map of the string of the connection tuple along with the data
-// structure of the connection
+// structure of the connection. A file with only the header line, common for /proc/net/tcp6, has no connections.
 func getConnections(r io.Reader) (map[string]Connection, error) {
-	var lineCount int
-
 	scanner := bufio.NewScanner(r)
-	scanner.Scan() // skipping first line
+	// skipping first line, a file without one is not a tcp table
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("error scanning file: %v", err)
+		}
+		return nil, fmt.Errorf("file was empty")
+	}
 
 	newConns := make(map[string]Connection)
 	for scanner.Scan() {
-		lineCount++
-		line := strings.Split(strings.TrimSpace(scanner.Text()), " ")
+		line := strings.Fields(scanner.Text())
+		if len(line) < 4 {
+			log.Printf("failed to parse line: expected at least 4 fields, got %d", len(line))
+			continue
+		}
 
 		local := line[1]
 		localIP, localPort, err := parseEndpoint(local)
@@ -114,13 +236,20 @@ func getConnections(r io.Reader) (map[string]Connection, error) {
 			continue
 		}
 
-		key := fmt.Sprintf("%s:%d:%s:%d", localIP.String(), localPort, remoteIP.String(), remotePort)
-		newConns[key] = Connection{
+		state, err := parseState(line[3])
+		if err != nil {
+			log.Printf("failed to parse connection state: %v", err)
+			continue
+		}
+
+		conn := Connection{
 			LocalIP:    localIP,
 			LocalPort:  localPort,
 			RemoteIP:   remoteIP,
 			RemotePort: remotePort,
+			State:      state,
 		}
+		newConns[conn.Key()] = conn
 	}
 
 	err := scanner.Err()
@@ -128,10 +257,5 @@ func getConnections(r io.Reader) (map[string]Connection, error) {
 		return nil, fmt.Errorf("error scanning file: %v", err)
 	}
 
-	// if line counter is empty,
-	if lineCount == 0 {
-		return nil, fmt.Errorf("/proc/net/tcp was empty")
-	}
-
 	return newConns, nil
 }
@@ -1,12 +1,14 @@
 package connections
 
 import (
+	"bytes"
 	"io"
 	"io/ioutil"
 	"log"
 	"net"
 	"os"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
@@ -18,6 +20,12 @@ func TestGetConnections(t *testing.T) {
 	}
 	defer tcp1.Close()
 
+	tcp6, err := os.Open("../test/tcp6")
+	if err != nil {
+		t.Errorf("failed to open file: %v", err)
+	}
+	defer tcp6.Close()
+
 	empty, err := os.Open("../test/tcpEmpty")
 	if err != nil {
 		t.Errorf("failed to open file: %v", err)
@@ -44,12 +52,44 @@ func TestGetConnections(t *testing.T) {
 					LocalPort:  6443,
 					RemoteIP:   net.ParseIP("10.192.1.21"),
 					RemotePort: 55468,
+					State:      TCPEstablished,
 				},
 				"10.192.1.18:6443:10.192.1.24:60024": {
 					LocalIP:    net.ParseIP("10.192.1.18"),
 					LocalPort:  6443,
 					RemoteIP:   net.ParseIP("10.192.1.24"),
 					RemotePort: 60024,
+					State:      TCPEstablished,
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "tcp6",
+			args: args{
+				r: tcp6,
+			},
+			want: map[string]Connection{
+				"[::]:22:[::]:0": {
+					LocalIP:    net.ParseIP("::"),
+					LocalPort:  22,
+					RemoteIP:   net.ParseIP("::"),
+					RemotePort: 0,
+					State:      TCPListen,
+				},
+				"[2001:db8::1]:22:[2001:db8::2]:55468": {
+					LocalIP:    net.ParseIP("2001:db8::1"),
+					LocalPort:  22,
+					RemoteIP:   net.ParseIP("2001:db8::2"),
+					RemotePort: 55468,
+					State:      TCPEstablished,
+				},
+				"10.192.1.18:6443:10.192.1.24:60024": {
+					LocalIP:    net.ParseIP("10.192.1.18"),
+					LocalPort:  6443,
+					RemoteIP:   net.ParseIP("10.192.1.24"),
+					RemotePort: 60024,
+					State:      TCPEstablished,
 				},
 			},
 			wantErr: false,
@@ -77,18 +117,205 @@ func TestGetConnections(t *testing.T) {
 	}
 }
 
+func TestConnection_Key(t *testing.T) {
+	c := Connection{
+		LocalIP:    net.ParseIP("2001:db8::1"),
+		LocalPort:  22,
+		RemoteIP:   net.ParseIP("10.0.0.1"),
+		RemotePort: 40000,
+	}
+	if got, want := c.Key(), "[2001:db8::1]:22:10.0.0.1:40000"; got != want {
+		t.Errorf("Key() = %v, want %v", got, want)
+	}
+}
+
+func TestConnectionWatcher_updateDetection(t *testing.T) {
+	tests := []struct {
+		name  string
+		conns map[string]Connection
+		want  map[WindowKey]*PortWindow
+	}{
+		{
+			name: "listening socket ignored",
+			conns: map[string]Connection{
+				"0.0.0.0:22:0.0.0.0:0": {
+					LocalIP:   net.IPv4zero,
+					LocalPort: 22,
+					RemoteIP:  net.IPv4zero,
+					State:     TCPListen,
+				},
+			},
+			want: map[WindowKey]*PortWindow{},
+		},
+		{
+			name: "inbound established",
+			conns: map[string]Connection{
+				"10.0.0.1:22:10.0.0.2:50000": {
+					LocalIP:    net.IPv4(10, 0, 0, 1),
+					LocalPort:  22,
+					RemoteIP:   net.IPv4(10, 0, 0, 2),
+					RemotePort: 50000,
+					State:      TCPEstablished,
+					Direction:  Inbound,
+				},
+			},
+			want: map[WindowKey]*PortWindow{
+				{HostPair: HostPair{LocalIP: "10.0.0.1", RemoteIP: "10.0.0.2"}}: {Seen: []PortSeen{{Port: 22, Time: 10}}},
+			},
+		},
+		{
+			name: "outbound ignored",
+			conns: map[string]Connection{
+				"10.0.0.1:50000:10.0.0.2:443": {
+					LocalIP:    net.IPv4(10, 0, 0, 1),
+					LocalPort:  50000,
+					RemoteIP:   net.IPv4(10, 0, 0, 2),
+					RemotePort: 443,
+					State:      TCPEstablished,
+					Direction:  Outbound,
+				},
+			},
+			want: map[WindowKey]*PortWindow{},
+		},
+		{
+			name: "inbound half-open",
+			conns: map[string]Connection{
+				"10.0.0.1:50000:10.0.0.2:40000": {
+					LocalIP:    net.IPv4(10, 0, 0, 1),
+					LocalPort:  50000,
+					RemoteIP:   net.IPv4(10, 0, 0, 2),
+					RemotePort: 40000,
+					State:      TCPSynRecv,
+					Direction:  Inbound,
+				},
+			},
+			want: map[WindowKey]*PortWindow{
+				{HostPair: HostPair{LocalIP: "10.0.0.1", RemoteIP: "10.0.0.2"}}: {Seen: []PortSeen{{Port: 50000, Time: 10}}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &PortScanDetector{Windows: make(map[WindowKey]*PortWindow)}
+			cw := &ConnectionWatcher{
+				Detection: &Detection{Detectors: []Detector{d}},
+			}
+			cw.updateDetection(tt.conns, tt.conns, 10)
+			if !reflect.DeepEqual(d.Windows, tt.want) {
+				t.Errorf("updateDetection() Windows = %v, want %v", d.Windows, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewConnections(t *testing.T) {
+	past := map[string]Connection{
+		"10.0.0.1:22:10.0.0.2:50000": {LocalPort: 22, RemotePort: 50000},
+		"10.0.0.1:22:10.0.0.2:50001": {LocalPort: 22, RemotePort: 50001},
+	}
+	obs := map[string]Connection{
+		"10.0.0.1:22:10.0.0.2:50001": {LocalPort: 22, RemotePort: 50001},
+		"10.0.0.1:22:10.0.0.2:50002": {LocalPort: 22, RemotePort: 50002},
+	}
+
+	want := map[string]Connection{
+		"10.0.0.1:22:10.0.0.2:50002": {LocalPort: 22, RemotePort: 50002},
+	}
+	if got := newConnections(obs, past); !reflect.DeepEqual(got, want) {
+		t.Errorf("newConnections() = %v, want %v", got, want)
+	}
+}
+
+// pollSource returns one of its Polls every call to Connections, keys are set from the connections
+type pollSource struct {
+	Polls [][]Connection
+}
+
+func (s *pollSource) Connections() (map[string]Connection, error) {
+	conns := make(map[string]Connection)
+	if len(s.Polls) > 0 {
+		for _, conn := range s.Polls[0] {
+			conns[conn.Key()] = conn
+		}
+		s.Polls = s.Polls[1:]
+	}
+	return conns, nil
+}
+
+func TestConnectionWatcher_Observe_closed(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(ioutil.Discard)
+
+	listener := Connection{LocalIP: net.IPv4zero, LocalPort: 22, RemoteIP: net.IPv4zero, State: TCPListen}
+	ssh := Connection{LocalIP: net.IPv4(10, 0, 0, 1), LocalPort: 22, RemoteIP: net.IPv4(10, 0, 0, 2), RemotePort: 50000, State: TCPEstablished}
+	probe := Connection{LocalIP: net.IPv4(10, 0, 0, 1), LocalPort: 22, RemoteIP: net.IPv4(10, 0, 0, 3), RemotePort: 40000, State: TCPSynRecv}
+	source := &pollSource{Polls: [][]Connection{
+		{listener, ssh},
+		{listener, ssh, probe},
+		{listener, ssh},
+		{listener},
+	}}
+	cw := NewConnectionWatcher(source, nil, PortRange{Min: 32768, Max: 60999})
+
+	for _, ts := range []int64{100, 110, 120} {
+		cw.Observe(ts)
+	}
+	if got := cw.Connections[ssh.Key()]; got.FirstSeen != 100 || got.LastSeen != 120 {
+		t.Errorf("Observe() seen = %d-%d, want 100-120", got.FirstSeen, got.LastSeen)
+	}
+	if want := "Connection closed 10.0.0.3:40000 -> 10.0.0.1:22 after 0s, first seen 1970-01-01T00:01:50Z, last seen 1970-01-01T00:01:50Z"; !strings.Contains(buf.String(), want) {
+		t.Errorf("Observe() logged %q, want %q", buf.String(), want)
+	}
+
+	cw.Observe(130)
+	if want := "Connection closed 10.0.0.2:50000 -> 10.0.0.1:22 after 20s"; !strings.Contains(buf.String(), want) {
+		t.Errorf("Observe() logged %q, want %q", buf.String(), want)
+	}
+	if strings.Contains(buf.String(), "Connection closed 0.0.0.0") {
+		t.Errorf("Observe() logged a listener as closed: %q", buf.String())
+	}
+}
+
+func TestConnectionWatcher_Observe_restart(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	listener := Connection{LocalIP: net.IPv4zero, LocalPort: 443, RemoteIP: net.IPv4zero, State: TCPListen}
+	keepalive := func(port uint16) Connection {
+		return Connection{LocalIP: net.IPv4(10, 0, 0, 1), LocalPort: 443, RemoteIP: net.IPv4(10, 0, 0, 2), RemotePort: port, State: TCPEstablished}
+	}
+	// a reverse proxy holding keepalive connections when the watcher starts, then opening new ones
+	source := &pollSource{Polls: [][]Connection{
+		{listener, keepalive(50000), keepalive(50001), keepalive(50002)},
+		{listener, keepalive(50000), keepalive(50001), keepalive(50002), keepalive(50003)},
+		{listener, keepalive(50000), keepalive(50001), keepalive(50002), keepalive(50003), keepalive(50004), keepalive(50005)},
+	}}
+	cw := NewConnectionWatcher(source, nil, PortRange{Min: 32768, Max: 60999})
+	cw.Detection = &Detection{Detectors: []Detector{&RateDetector{Limit: 2}}}
+
+	cw.Observe(100)
+	cw.Observe(110)
+	if got := cw.Detection.Verdicts(110); len(got) != 0 {
+		t.Errorf("Verdicts() = %v, want the connections open at startup not counted as new", got)
+	}
+
+	cw.Observe(120)
+	if got := cw.Detection.Verdicts(120); len(got) != 1 || got[0].Reason != DetectorRate {
+		t.Errorf("Verdicts() = %v, want 3 new connections over the rate limit", got)
+	}
+}
+
 func benchmarkLogicLoop(path string, b *testing.B) {
 	log.SetOutput(ioutil.Discard)
-	blocker := NewIPBlocker()
-	cw := NewConnectionWatcher(blocker)
-	TTL := int64(60)
+	blocker := NewIPBlocker(BlockerConfig{})
+	cw := NewConnectionWatcher(NewProcSource(path), blocker, PortRange{})
+	cw.Detection, _ = NewDetection(DetectorConfig{})
 
 	for n := 0; n < b.N; n++ {
 		t := time.Now().Unix()
-		cw.Observe(path, t)
-		cw.Blocker.RemoveOldConnections(t, TTL)
-		hosts := cw.Blocker.HostsToBlock()
-		cw.Blocker.BlockHosts(hosts)
+		cw.Observe(t)
+		verdicts := cw.Detection.Verdicts(t)
+		cw.Blocker.BlockHosts(verdicts, t)
 	}
 }
 
@@ -96,11 +323,11 @@ func BenchmarkLogicLoop100000(b *testing.B) { benchmarkLogicLoop("../test/tcp100
 
 func benchmarkconnectionwatcherObserve(path string, b *testing.B) {
 	log.SetOutput(ioutil.Discard)
-	blocker := NewIPBlocker()
-	cw := NewConnectionWatcher(blocker)
+	blocker := NewIPBlocker(BlockerConfig{})
+	cw := NewConnectionWatcher(NewProcSource(path), blocker, PortRange{})
 	t := time.Now().Unix()
 	for n := 0; n < b.N; n++ {
-		cw.Observe(path, t)
+		cw.Observe(t)
 	}
 }
 
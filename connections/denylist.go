@@ -0,0 +1,321 @@
+package connections
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rcanderson23/connectionWatcher/metrics"
+)
+
+const (
+	// DefaultDenylistInterval is how often the denylist files are checked for changes
+	DefaultDenylistInterval = time.Minute
+
+	// ReasonDenylist is the reason of networks blocked for being listed in a denylist file
+	ReasonDenylist = "denylist"
+)
+
+// DenylistedNet is a network blocked because it is listed in a denylist file
+type DenylistedNet struct {
+	Net *net.IPNet
+	// BlockedAt is measured in seconds since the unix epoch
+	BlockedAt int64
+}
+
+// Denylist reads the networks to block from files, in the plain, FireHOL netset or Spamhaus DROP format. Paths are files
+// or directories of files, hidden files in a directory are skipped.
+type Denylist struct {
+	Paths []string
+
+	// modified is the modification time of every file at the last Load
+	modified map[string]time.Time
+}
+
+// NewDenylist returns a Denylist of the files at paths
+func NewDenylist(paths []string) *Denylist {
+	return &Denylist{Paths: paths}
+}
+
+// Load returns the networks of every file and true if any file changed, was added or was removed since the last
+// Load. Nothing is read when no file changed. Networks listed more than once, or contained in another network, are only
+// returned once, firewall sets of intervals can't hold overlapping networks.
+func (d *Denylist) Load() ([]*net.IPNet, bool, error) {
+	files, err := d.files()
+	if err != nil {
+		return nil, false, err
+	}
+	if sameModTimes(files, d.modified) {
+		return nil, false, nil
+	}
+
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var nets []*net.IPNet
+	seen := make(map[string]bool)
+	for _, name := range names {
+		fileNets, err := readDenylistFile(name)
+		if err != nil {
+			return nil, false, err
+		}
+		for _, n := range fileNets {
+			if !seen[n.String()] {
+				seen[n.String()] = true
+				nets = append(nets, n)
+			}
+		}
+	}
+
+	d.modified = files
+	return collapseNets(nets), true, nil
+}
+
+// collapseNets returns the nets that aren't contained in another of nets, in order
+func collapseNets(nets []*net.IPNet) []*net.IPNet {
+	// sorted by family, address then size, a network contained in another comes after it and any network between them
+	// is contained too, so it only needs to be compared with the last network kept
+	sorted := append([]*net.IPNet{}, nets...)
+	sort.Slice(sorted, func(i, j int) bool {
+		onesA, bitsA := sorted[i].Mask.Size()
+		onesB, bitsB := sorted[j].Mask.Size()
+		if bitsA != bitsB {
+			return bitsA < bitsB
+		}
+		if c := bytes.Compare(sorted[i].IP.To16(), sorted[j].IP.To16()); c != 0 {
+			return c < 0
+		}
+		return onesA < onesB
+	})
+
+	contained := make(map[*net.IPNet]bool)
+	var last *net.IPNet
+	for _, n := range sorted {
+		if last != nil && containsNetwork(last, n) {
+			contained[n] = true
+			continue
+		}
+		last = n
+	}
+
+	var collapsed []*net.IPNet
+	for _, n := range nets {
+		if !contained[n] {
+			collapsed = append(collapsed, n)
+		}
+	}
+	return collapsed
+}
+
+// containsNetwork returns true if n is a or is contained in it
+func containsNetwork(a, n *net.IPNet) bool {
+	onesA, bitsA := a.Mask.Size()
+	onesN, bitsN := n.Mask.Size()
+	return bitsA == bitsN && onesA <= onesN && a.Contains(n.IP)
+}
+
+// isDenylisted returns true if ip is in one of the Denylisted networks
+func (ipb *IPBlocker) isDenylisted(ip net.IP) bool {
+	for _, d := range ipb.Denylisted {
+		if d.Net.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// files returns the modification time of the files at the Paths, directories are expanded to the files in them
+func (d *Denylist) files() (map[string]time.Time, error) {
+	files := make(map[string]time.Time)
+	for _, path := range d.Paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read denylist: %v", err)
+		}
+
+		if !info.IsDir() {
+			files[path] = info.ModTime()
+			continue
+		}
+
+		entries, err := ioutil.ReadDir(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read denylist directory: %v", err)
+		}
+		for _, entry := range entries {
+			if entry.Mode().IsRegular() && !strings.HasPrefix(entry.Name(), ".") {
+				files[filepath.Join(path, entry.Name())] = entry.ModTime()
+			}
+		}
+	}
+	return files, nil
+}
+
+// sameModTimes returns true if a and b have the same files with the same modification times
+func sameModTimes(a, b map[string]time.Time) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, mtime := range a {
+		if other, ok := b[name]; !ok || !other.Equal(mtime) {
+			return false
+		}
+	}
+	return true
+}
+
+func readDenylistFile(path string) ([]*net.IPNet, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read denylist file: %v", err)
+	}
+	defer f.Close()
+
+	nets, err := ParseDenylist(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return nets, nil
+}
+
+// ParseDenylist returns the networks of a denylist with one IP or CIDR per line. Anything after a # or ; is a
+// comment, as are any fields after the first, which covers plain lists, FireHOL netsets and Spamhaus DROP lists such
+// as "192.0.2.0/24 ; SBL000001".
+func ParseDenylist(r io.Reader) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if i := strings.IndexAny(text, "#;"); i >= 0 {
+			text = text[:i]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+
+		n, err := ParseNet(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		nets = append(nets, n)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read denylist: %v", err)
+	}
+	return nets, nil
+}
+
+// SetDenylist blocks nets through the Backend at unix time t without expiry, and unblocks the networks denylisted
+// before that are no longer in nets. BlockedHosts in a newly blocked network are unblocked and forgotten, the network
+// blocks them. Networks overlapping the Allowlist are never blocked. In monitor mode the Backend is never touched, the
+// networks that would be blocked are only kept, logged, counted and recorded as decisions.
+func (ipb *IPBlocker) SetDenylist(nets []*net.IPNet, t int64) {
+	var denylisted []DenylistedNet
+	var added, removed int
+	for _, n := range nets {
+		if i := indexDenylisted(ipb.Denylisted, n); i >= 0 {
+			denylisted = append(denylisted, ipb.Denylisted[i])
+			continue
+		}
+
+		if ipb.Allowlist.Overlaps(n) {
+			log.Printf("Not blocking denylisted network overlapping the allowlist: %s", n)
+			continue
+		}
+
+		if ipb.Monitor {
+			v := Verdict{
+				Host:     RemoteHost{RemoteIP: n.IP},
+				Reason:   ReasonDenylist,
+				Severity: SeverityHigh,
+				Evidence: fmt.Sprintf("network %s is denylisted", n),
+			}
+			log.Printf("Would block %s\n", v.String())
+			metrics.WouldBlock.WithLabelValues(ReasonDenylist).Inc()
+			ipb.record(v, ActionWouldBlock, nil, t)
+		} else if ipb.Backend != nil {
+			ipb.unblockContained(n)
+			if err := ipb.Backend.Block(n, 0); err != nil {
+				log.Printf("Failed to block denylisted network %s: %v", n, err)
+				continue
+			}
+		}
+		denylisted = append(denylisted, DenylistedNet{Net: n, BlockedAt: t})
+		added++
+	}
+
+	for _, d := range ipb.Denylisted {
+		if indexDenylisted(denylisted, d.Net) >= 0 {
+			continue
+		}
+
+		if ipb.Backend != nil && !ipb.Monitor {
+			if err := ipb.Backend.Unblock(d.Net); err != nil {
+				log.Printf("Failed to unblock network removed from the denylist %s: %v", d.Net, err)
+				denylisted = append(denylisted, d)
+				continue
+			}
+		}
+		removed++
+	}
+
+	ipb.Denylisted = denylisted
+	if ipb.Monitor {
+		log.Printf("Updated denylist: %d networks would be blocked, %d added, %d removed", len(denylisted), added, removed)
+		return
+	}
+	metrics.BlockedHosts.WithLabelValues(ReasonDenylist).Set(float64(len(denylisted)))
+	log.Printf("Updated denylist: %d networks blocked, %d added, %d removed", len(denylisted), added, removed)
+}
+
+// unblockContained removes the blocks of the BlockedHosts in n, so the Backend can block n without overlapping them.
+// Hosts that can't be unblocked are kept.
+func (ipb *IPBlocker) unblockContained(n *net.IPNet) {
+	var unblocked int
+	remaining := ipb.BlockedHosts[:0]
+	for _, host := range ipb.BlockedHosts {
+		if !n.Contains(host.IP) {
+			remaining = append(remaining, host)
+			continue
+		}
+
+		if err := ipb.Backend.Unblock(hostNet(host.IP)); err != nil {
+			log.Printf("Failed to remove block of host in denylisted network %s: %v", host.IP, err)
+			remaining = append(remaining, host)
+			continue
+		}
+
+		log.Printf("Removed block of host %s in denylisted network %s", host.IP, n)
+		unblocked++
+		metrics.BlockedHosts.WithLabelValues(host.Reason).Dec()
+	}
+	ipb.BlockedHosts = remaining
+
+	if unblocked > 0 {
+		ipb.saveState()
+	}
+}
+
+// indexDenylisted returns the index of n in denylisted or -1
+func indexDenylisted(denylisted []DenylistedNet, n *net.IPNet) int {
+	for i, d := range denylisted {
+		if d.Net.String() == n.String() {
+			return i
+		}
+	}
+	return -1
+}
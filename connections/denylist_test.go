@@ -0,0 +1,276 @@
+package connections
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func netStrings(nets []*net.IPNet) []string {
+	var s []string
+	for _, n := range nets {
+		s = append(s, n.String())
+	}
+	return s
+}
+
+func TestParseDenylist(t *testing.T) {
+	tests := []struct {
+		name    string
+		list    string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "plain",
+			list: "192.0.2.1\n2001:db8::1\n\n198.51.100.0/24 # comment\n",
+			want: []string{"192.0.2.1/32", "2001:db8::1/128", "198.51.100.0/24"},
+		},
+		{
+			name: "firehol netset",
+			list: "#\n# firehol_level1\n#\n0.0.0.0/8\n1.10.16.0/20\n",
+			want: []string{"0.0.0.0/8", "1.10.16.0/20"},
+		},
+		{
+			name: "spamhaus drop",
+			list: "; Spamhaus DROP List\n1.10.16.0/20 ; SBL256894\n198.51.100.0/24 ; SBL000001\n",
+			want: []string{"1.10.16.0/20", "198.51.100.0/24"},
+		},
+		{
+			name: "empty",
+			list: "# nothing\n",
+		},
+		{
+			name:    "invalid",
+			list:    "192.0.2.1\nexample.com\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseDenylist(strings.NewReader(tt.list))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseDenylist() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(netStrings(got), tt.want) {
+				t.Errorf("ParseDenylist() = %v, want %v", netStrings(got), tt.want)
+			}
+		})
+	}
+}
+
+func TestDenylist_Load(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"firehol.netset", "drop.txt"} {
+		b, err := ioutil.ReadFile(filepath.Join("../test", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name), b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, ".hidden"), []byte("not a denylist"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewDenylist([]string{dir})
+	nets, changed, err := d.Load()
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	want := []string{"1.10.16.0/20", "198.51.100.0/24", "0.0.0.0/8", "192.0.2.1/32"}
+	if !changed || !reflect.DeepEqual(netStrings(nets), want) {
+		t.Errorf("Load() = %v, %v, want %v, true", netStrings(nets), changed, want)
+	}
+
+	if _, changed, _ := d.Load(); changed {
+		t.Errorf("Load() of unchanged files changed = true")
+	}
+
+	// a changed file is read again
+	drop := filepath.Join(dir, "drop.txt")
+	if err := ioutil.WriteFile(drop, []byte("203.0.113.0/24 ; SBL000002\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(drop, later, later); err != nil {
+		t.Fatal(err)
+	}
+	nets, changed, err = d.Load()
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	want = []string{"203.0.113.0/24", "0.0.0.0/8", "1.10.16.0/20", "192.0.2.1/32"}
+	if !changed || !reflect.DeepEqual(netStrings(nets), want) {
+		t.Errorf("Load() after change = %v, %v, want %v, true", netStrings(nets), changed, want)
+	}
+
+	// without paths every network is removed
+	d.Paths = nil
+	nets, changed, _ = d.Load()
+	if !changed || len(nets) != 0 {
+		t.Errorf("Load() without paths = %v, %v, want none, true", netStrings(nets), changed)
+	}
+
+	d.Paths = []string{filepath.Join(dir, "missing")}
+	if _, _, err := d.Load(); err == nil {
+		t.Errorf("Load() of missing file error = nil")
+	}
+}
+
+func TestIPBlocker_SetDenylist(t *testing.T) {
+	backend := newFakeBackend()
+	ipb := &IPBlocker{
+		Backend:   backend,
+		Allowlist: &Allowlist{Nets: []*net.IPNet{hostNet(net.ParseIP("192.0.2.10"))}},
+	}
+
+	nets, err := ParseDenylist(strings.NewReader("198.51.100.0/24\n203.0.113.7\n192.0.2.0/24\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ipb.SetDenylist(nets, 100)
+
+	// 192.0.2.0/24 contains an allowlisted host
+	want := map[string]time.Duration{"198.51.100.0/24": 0, "203.0.113.7/32": 0}
+	if !reflect.DeepEqual(backend.blocked, want) {
+		t.Errorf("SetDenylist() backend = %v, want %v", backend.blocked, want)
+	}
+
+	nets, err = ParseDenylist(strings.NewReader("198.51.100.0/24\n2001:db8::/32\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ipb.SetDenylist(nets, 200)
+
+	want = map[string]time.Duration{"198.51.100.0/24": 0, "2001:db8::/32": 0}
+	if !reflect.DeepEqual(backend.blocked, want) {
+		t.Errorf("SetDenylist() again backend = %v, want %v", backend.blocked, want)
+	}
+
+	wantBlocks := []Block{
+		{Network: "198.51.100.0/24", Reason: ReasonDenylist, BlockedAt: 100},
+		{Network: "2001:db8::/32", Reason: ReasonDenylist, BlockedAt: 200},
+	}
+	if got := ipb.Blocks(); !reflect.DeepEqual(got, wantBlocks) {
+		t.Errorf("Blocks() = %+v, want %+v", got, wantBlocks)
+	}
+}
+
+// overlapBackend is a Backend that rejects blocks overlapping a block it has, as nftables rejects interval elements
+type overlapBackend struct {
+	*fakeBackend
+}
+
+func (b overlapBackend) Block(n *net.IPNet, ttl time.Duration) error {
+	for s := range b.blocked {
+		_, blocked, _ := net.ParseCIDR(s)
+		if blocked.String() != n.String() && (blocked.Contains(n.IP) || n.Contains(blocked.IP)) {
+			return fmt.Errorf("could not process rule: File exists: %s overlaps %s", n, blocked)
+		}
+	}
+	return b.fakeBackend.Block(n, ttl)
+}
+
+func TestIPBlocker_SetDenylist_blockedHost(t *testing.T) {
+	backend := overlapBackend{newFakeBackend()}
+	ipb := &IPBlocker{Backend: backend, BlockTTL: time.Hour}
+
+	// the host is blocked first, then a network containing it is denylisted
+	host := RemoteHost{RemoteIP: net.ParseIP("198.51.100.7"), Ports: []uint16{22}}
+	if errs := ipb.BlockHosts([]Verdict{{Host: host, Reason: ReasonPortScan}}, 100); len(errs) > 0 {
+		t.Fatalf("BlockHosts() errors = %v", errs)
+	}
+
+	_, n, _ := net.ParseCIDR("198.51.100.0/24")
+	ipb.SetDenylist([]*net.IPNet{n}, 200)
+
+	want := map[string]time.Duration{"198.51.100.0/24": 0}
+	if !reflect.DeepEqual(backend.blocked, want) {
+		t.Errorf("SetDenylist() backend = %v, want %v", backend.blocked, want)
+	}
+	if len(ipb.BlockedHosts) != 0 {
+		t.Errorf("SetDenylist() BlockedHosts = %v, want the host in the network forgotten", ipb.BlockedHosts)
+	}
+
+	wantBlocks := []Block{{Network: "198.51.100.0/24", Reason: ReasonDenylist, BlockedAt: 200}}
+	if got := ipb.Blocks(); !reflect.DeepEqual(got, wantBlocks) {
+		t.Errorf("Blocks() = %+v, want %+v", got, wantBlocks)
+	}
+}
+
+func TestIPBlocker_SetDenylist_monitor(t *testing.T) {
+	backend := newFakeBackend()
+	ipb := &IPBlocker{Backend: backend, Monitor: true}
+
+	_, n, _ := net.ParseCIDR("198.51.100.0/24")
+	ipb.SetDenylist([]*net.IPNet{n}, 100)
+	// unchanged networks aren't recorded again
+	ipb.SetDenylist([]*net.IPNet{n}, 200)
+
+	if len(backend.blocked) != 0 {
+		t.Errorf("SetDenylist() backend = %v, want nothing blocked in monitor mode", backend.blocked)
+	}
+
+	wantBlocks := []Block{{Network: "198.51.100.0/24", Reason: ReasonDenylist, BlockedAt: 100}}
+	if got := ipb.Blocks(); !reflect.DeepEqual(got, wantBlocks) {
+		t.Errorf("Blocks() = %+v, want %+v", got, wantBlocks)
+	}
+
+	decisions := ipb.Decisions()
+	if len(decisions) != 1 || decisions[0].Action != ActionWouldBlock || decisions[0].Reason != ReasonDenylist {
+		t.Errorf("Decisions() = %+v, want the denylisted network would be blocked", decisions)
+	}
+
+	ipb.SetDenylist(nil, 300)
+	if len(ipb.Denylisted) != 0 {
+		t.Errorf("SetDenylist() Denylisted = %v, want the removed network forgotten", ipb.Denylisted)
+	}
+}
+
+func TestCollapseNets(t *testing.T) {
+	tests := []struct {
+		name string
+		nets string
+		want []string
+	}{
+		{
+			name: "disjoint",
+			nets: "198.51.100.0/24\n192.0.2.1\n2001:db8::/32\n",
+			want: []string{"198.51.100.0/24", "192.0.2.1/32", "2001:db8::/32"},
+		},
+		{
+			name: "contained in a later network",
+			nets: "1.10.17.0/24\n192.0.2.1\n1.10.16.0/20\n1.10.31.255\n",
+			want: []string{"192.0.2.1/32", "1.10.16.0/20"},
+		},
+		{
+			name: "nested",
+			nets: "10.0.0.0/8\n10.1.0.0/16\n10.1.2.0/24\n11.0.0.0/8\n",
+			want: []string{"10.0.0.0/8", "11.0.0.0/8"},
+		},
+		{
+			name: "families kept apart",
+			nets: "::/0\n192.0.2.0/24\n2001:db8::1\n",
+			want: []string{"::/0", "192.0.2.0/24"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nets, err := ParseDenylist(strings.NewReader(tt.nets))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := netStrings(collapseNets(nets)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("collapseNets() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,326 @@
+package connections
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rcanderson23/connectionWatcher/metrics"
+)
+
+const (
+	// DetectorPortScan blocks remote hosts connecting to many ports of a local IP, a vertical scan
+	DetectorPortScan = "portscan"
+	// DetectorHorizontalScan blocks remote hosts connecting to the same port of many local IPs
+	DetectorHorizontalScan = "horizontal"
+	// DetectorRate blocks remote hosts opening too many new connections to a local port
+	DetectorRate = "rate"
+	// DetectorSequential blocks remote hosts connecting to consecutive ports of a local IP
+	DetectorSequential = "sequential"
+	// DetectorScore blocks remote hosts whose risk score from several signals crosses a threshold
+	DetectorScore = "score"
+)
+
+// DefaultDetectors are the detectors enabled when none are configured
+var DefaultDetectors = []string{DetectorPortScan, DetectorSequential}
+
+// Severity is how confident a Detector is that a remote host is hostile
+type Severity int
+
+const (
+	SeverityLow Severity = iota
+	SeverityMedium
+	SeverityHigh
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityLow:
+		return "low"
+	case SeverityMedium:
+		return "medium"
+	case SeverityHigh:
+		return "high"
+	default:
+		return "unknown"
+	}
+}
+
+// Observation is a remote host connecting to a port of a local IP at unix time Time, both IPs in their string form
+type Observation struct {
+	LocalIP   string
+	RemoteIP  string
+	LocalPort uint16
+	// New is true the first time the connection is observed, connections are observed again on every poll while they
+	// are open
+	New bool
+	// HalfOpen is true for a connection whose handshake isn't complete, a SYN_RECV socket
+	HalfOpen bool
+	// Denylisted is true if the remote host is in a denylisted network, set by the Detection
+	Denylisted bool
+	// Captured is true for a connection attempt seen in a packet capture rather than a socket of the connection source
+	Captured bool
+	Time     int64
+}
+
+// Verdict is the decision of a Detector to block a remote host
+type Verdict struct {
+	Host RemoteHost
+	// Reason is why the host is blocked, the name of the Detector
+	Reason   string
+	Severity Severity
+	// Evidence describes what the Detector observed
+	Evidence string
+	// Factors are what contributed to the verdict of a scoring Detector, by decreasing score
+	Factors []Factor
+}
+
+func (v Verdict) String() string {
+	return fmt.Sprintf("%s (%s) from %s: %s", v.Reason, v.Severity, v.Host.RemoteIP, v.Evidence)
+}
+
+// Detector finds remote hosts to block in the connections observed
+type Detector interface {
+	// Name identifies the Detector in the configuration and is the Reason of its verdicts
+	Name() string
+	// Observe records a connection, it may be called from another goroutine than Verdicts
+	Observe(o Observation)
+	// Verdicts slides the window of the Detector to unix time now and returns the remote hosts to block, whose
+	// observations are then forgotten
+	Verdicts(now int64) []Verdict
+	// Configure applies c without forgetting the connections observed
+	Configure(c DetectorConfig)
+}
+
+// DetectorConfig holds the settings of the detectors
+type DetectorConfig struct {
+	// Detectors are the names of the enabled detectors, DefaultDetectors if empty
+	Detectors []string
+	// PortThreshold is the number of distinct local ports a remote host connects to within Window before it is blocked
+	PortThreshold int
+	Window        time.Duration
+	// Thresholds override PortThreshold and Window for some local addresses and ports
+	Thresholds []Threshold
+	// HorizontalThreshold is the number of distinct local IPs a remote host connects to on the same port within
+	// HorizontalWindow before it is blocked
+	HorizontalThreshold int
+	// HorizontalWindow is Window if zero
+	HorizontalWindow time.Duration
+	// RateLimit is the number of new connections a remote host opens to a local port within RateWindow before it is
+	// blocked
+	RateLimit int
+	// PortRateLimits override RateLimit for some local ports
+	PortRateLimits map[uint16]int
+	// RateWindow is Window if zero
+	RateWindow time.Duration
+	// SequentialPorts is the number of consecutive ports a remote host connects to before it is blocked
+	SequentialPorts int
+	// ScoreThreshold is the risk score that gets a remote host blocked
+	ScoreThreshold float64
+	// ScoreHalfLife is the time it takes a risk score to halve
+	ScoreHalfLife time.Duration
+	ScoreWeights  ScoreWeights
+	// SensitivePorts are weighted with ScoreWeights.SensitivePort
+	SensitivePorts []uint16
+	// Capture is true when connection attempts are captured, new connections are then counted from the capture alone,
+	// which sees every SYN, rather than once more when their socket is observed
+	Capture bool
+}
+
+// NewDetector returns the Detector named name configured with c
+func NewDetector(name string, c DetectorConfig) (Detector, error) {
+	var d Detector
+	switch name {
+	case DetectorPortScan:
+		d = &PortScanDetector{}
+	case DetectorHorizontalScan:
+		d = &HorizontalScanDetector{}
+	case DetectorRate:
+		d = &RateDetector{}
+	case DetectorSequential:
+		d = &SequentialDetector{}
+	case DetectorScore:
+		d = &ScoreDetector{}
+	default:
+		return nil, fmt.Errorf("unknown detector %q", name)
+	}
+
+	d.Configure(c)
+	return d, nil
+}
+
+// Detection runs every enabled Detector on the connections observed and merges their verdicts
+type Detection struct {
+	// mu guards every field, Detectors are replaced on Configure while a packet capture may be observing
+	mu        sync.RWMutex
+	Detectors []Detector
+	// Denylisted are the networks whose hosts' observations are marked Denylisted
+	Denylisted []*net.IPNet
+	// Allowlist are the remote hosts whose captured connection attempts are never observed
+	Allowlist *Allowlist
+}
+
+// NewDetection returns a Detection running the detectors enabled in c
+func NewDetection(c DetectorConfig) (*Detection, error) {
+	d := &Detection{}
+	if err := d.Configure(c); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Configure enables the detectors of c and applies c to them. Detectors that stay enabled keep what they observed.
+func (d *Detection) Configure(c DetectorConfig) error {
+	names := c.Detectors
+	if len(names) == 0 {
+		names = DefaultDetectors
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var detectors []Detector
+	for _, name := range names {
+		var detector Detector
+		for _, existing := range d.Detectors {
+			if existing.Name() == name {
+				detector = existing
+				detector.Configure(c)
+				break
+			}
+		}
+
+		if detector == nil {
+			var err error
+			detector, err = NewDetector(name, c)
+			if err != nil {
+				return err
+			}
+		}
+		detectors = append(detectors, detector)
+	}
+
+	d.Detectors = detectors
+	return nil
+}
+
+// SetDenylisted replaces the Denylisted networks
+func (d *Detection) SetDenylisted(nets []*net.IPNet) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.Denylisted = nets
+}
+
+// SetAllowlist replaces the Allowlist
+func (d *Detection) SetAllowlist(a *Allowlist) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.Allowlist = a
+}
+
+// Observe records o with every Detector, marking it Denylisted if its remote host is in a Denylisted network
+func (d *Detection) Observe(o Observation) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if len(d.Denylisted) > 0 {
+		ip := net.ParseIP(o.RemoteIP)
+		for _, n := range d.Denylisted {
+			if n.Contains(ip) {
+				o.Denylisted = true
+				break
+			}
+		}
+	}
+
+	for _, detector := range d.Detectors {
+		detector.Observe(o)
+	}
+}
+
+// AddPort records a connection attempt of remoteIP to port of localIP seen in a packet capture at time t(unix epoch),
+// unless remoteIP is allowlisted
+func (d *Detection) AddPort(localIP string, remoteIP string, port uint16, t int64) {
+	d.mu.RLock()
+	allowlisted := d.Allowlist.Contains(net.ParseIP(remoteIP))
+	d.mu.RUnlock()
+	if allowlisted {
+		return
+	}
+
+	d.Observe(Observation{LocalIP: localIP, RemoteIP: remoteIP, LocalPort: port, New: true, Captured: true, Time: t})
+}
+
+// Verdicts returns the verdicts of every Detector at unix time now, merged into a single Verdict per remote host
+func (d *Detection) Verdicts(now int64) []Verdict {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	var verdicts []Verdict
+	for _, detector := range d.Detectors {
+		for _, v := range detector.Verdicts(now) {
+			metrics.Verdicts.WithLabelValues(v.Reason, v.Severity.String()).Inc()
+			verdicts = append(verdicts, v)
+		}
+	}
+
+	return mergeVerdicts(verdicts)
+}
+
+// mergeVerdicts merges the verdicts of each remote host into one with the reason and severity of the most severe, the
+// ports and evidence of all of them
+func mergeVerdicts(verdicts []Verdict) []Verdict {
+	var merged []Verdict
+	index := make(map[string]int)
+	for _, v := range verdicts {
+		ip := v.Host.RemoteIP.String()
+		i, present := index[ip]
+		if !present {
+			index[ip] = len(merged)
+			merged = append(merged, v)
+			continue
+		}
+
+		m := &merged[i]
+		if v.Severity > m.Severity {
+			m.Reason, m.Severity, m.Host.LocalIP = v.Reason, v.Severity, v.Host.LocalIP
+		}
+		m.Host.Ports = mergePorts(m.Host.Ports, v.Host.Ports)
+		m.Evidence += "; " + v.Evidence
+		m.Factors = append(m.Factors, v.Factors...)
+	}
+
+	return merged
+}
+
+// mergePorts returns the distinct ports of a and b in order
+func mergePorts(a, b []uint16) []uint16 {
+	seen := make(map[uint16]bool)
+	var ports []uint16
+	for _, p := range append(append([]uint16{}, a...), b...) {
+		if !seen[p] {
+			seen[p] = true
+			ports = append(ports, p)
+		}
+	}
+	sort.Slice(ports, func(i, j int) bool { return ports[i] < ports[j] })
+	return ports
+}
+
+// ipsToString returns the IPs as a comma separated string in order
+func ipsToString(ips []string) string {
+	sorted := append([]string{}, ips...)
+	sort.Slice(sorted, func(i, j int) bool {
+		a, b := net.ParseIP(sorted[i]), net.ParseIP(sorted[j])
+		if a == nil || b == nil {
+			return sorted[i] < sorted[j]
+		}
+		return string(a.To16()) < string(b.To16())
+	})
+	return strings.Join(sorted, ",")
+}
@@ -0,0 +1,88 @@
+package connections
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestMergeVerdicts(t *testing.T) {
+	scan := Verdict{
+		Host:     RemoteHost{RemoteIP: net.ParseIP("192.168.1.1"), LocalIP: net.ParseIP("10.0.0.1"), Ports: []uint16{22, 80, 443}},
+		Reason:   DetectorPortScan,
+		Severity: SeverityMedium,
+		Evidence: "connected to 3 ports of 10.0.0.1: 22,80,443",
+	}
+	sequential := Verdict{
+		Host:     RemoteHost{RemoteIP: net.ParseIP("192.168.1.1"), LocalIP: net.ParseIP("10.0.0.2"), Ports: []uint16{20, 21, 22, 23}},
+		Reason:   DetectorSequential,
+		Severity: SeverityHigh,
+		Evidence: "connected to consecutive ports 20-23 of 10.0.0.2",
+	}
+	other := Verdict{
+		Host:     RemoteHost{RemoteIP: net.ParseIP("192.168.1.2")},
+		Reason:   DetectorRate,
+		Severity: SeverityMedium,
+		Evidence: "opened 101 new connections within 1m0s",
+	}
+
+	tests := []struct {
+		name     string
+		verdicts []Verdict
+		want     []Verdict
+	}{
+		{name: "none", verdicts: nil, want: nil},
+		{name: "distinct hosts kept", verdicts: []Verdict{scan, other}, want: []Verdict{scan, other}},
+		{
+			name:     "most severe reason wins",
+			verdicts: []Verdict{scan, sequential},
+			want: []Verdict{{
+				Host:     RemoteHost{RemoteIP: net.ParseIP("192.168.1.1"), LocalIP: net.ParseIP("10.0.0.2"), Ports: []uint16{20, 21, 22, 23, 80, 443}},
+				Reason:   DetectorSequential,
+				Severity: SeverityHigh,
+				Evidence: scan.Evidence + "; " + sequential.Evidence,
+			}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mergeVerdicts(tt.verdicts); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("mergeVerdicts() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDetection_Configure(t *testing.T) {
+	d, err := NewDetection(DetectorConfig{})
+	if err != nil {
+		t.Fatalf("NewDetection() error = %v", err)
+	}
+	if len(d.Detectors) != len(DefaultDetectors) {
+		t.Fatalf("NewDetection() detectors = %d, want %d", len(d.Detectors), len(DefaultDetectors))
+	}
+
+	d.AddPort("10.0.0.1", "192.168.1.1", 22, 0)
+	d.AddPort("10.0.0.1", "192.168.1.1", 80, 0)
+
+	err = d.Configure(DetectorConfig{Detectors: []string{DetectorPortScan, DetectorRate}, PortThreshold: 2})
+	if err != nil {
+		t.Fatalf("Configure() error = %v", err)
+	}
+	if got := len(d.Detectors); got != 2 {
+		t.Errorf("Configure() detectors = %d, want 2", got)
+	}
+
+	// the ports observed before are counted against the new port threshold
+	verdicts := d.Verdicts(1)
+	if len(verdicts) != 1 || verdicts[0].Reason != DetectorPortScan {
+		t.Errorf("Verdicts() = %v, want port scan from 192.168.1.1", verdicts)
+	}
+
+	if err := d.Configure(DetectorConfig{Detectors: []string{"bogus"}}); err == nil {
+		t.Errorf("Configure() error = nil, want error for unknown detector")
+	}
+	if got := len(d.Detectors); got != 2 {
+		t.Errorf("Configure() detectors = %d, want detectors kept on error", got)
+	}
+}
@@ -0,0 +1,86 @@
+package connections
+
+import (
+	"net"
+	"strconv"
+)
+
+// Direction is which side of a connection initiated it
+type Direction uint8
+
+const (
+	DirectionUnknown Direction = iota
+	// Inbound is a remote host connecting to a local listener
+	Inbound
+	// Outbound is the local host connecting to a remote host
+	Outbound
+)
+
+func (d Direction) String() string {
+	switch d {
+	case Inbound:
+		return "inbound"
+	case Outbound:
+		return "outbound"
+	default:
+		return "unknown"
+	}
+}
+
+// listeners is the set of local endpoints in the LISTEN state keyed by their host:port string
+type listeners map[string]struct{}
+
+// newListeners builds the set of local listening endpoints from the LISTEN rows of an observation
+func newListeners(conns map[string]Connection) listeners {
+	l := make(listeners)
+	for _, conn := range conns {
+		if conn.State == TCPListen {
+			l[endpointKey(conn.LocalIP, conn.LocalPort)] = struct{}{}
+		}
+	}
+	return l
+}
+
+// contains reports if ip and port match a listener, either directly or through a wildcard listener. IPv4 addresses
+// also match an IPv6 wildcard listener since a dual-stack socket accepts both.
+func (l listeners) contains(ip net.IP, port uint16) bool {
+	candidates := []net.IP{ip, net.IPv6unspecified}
+	if ip.To4() != nil {
+		candidates = append(candidates, net.IPv4zero)
+	}
+
+	for _, candidate := range candidates {
+		if _, present := l[endpointKey(candidate, port)]; present {
+			return true
+		}
+	}
+	return false
+}
+
+func endpointKey(ip net.IP, port uint16) string {
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
+}
+
+// direction classifies conn using the listeners of the same observation. A connection is inbound when its local
+// endpoint matches a listener. When no listeners were observed, such as a source that doesn't report them, the
+// local port is compared against the ephemeral port range instead.
+func direction(conn Connection, l listeners, ephemeral PortRange) Direction {
+	switch {
+	case conn.State == TCPListen:
+		return DirectionUnknown
+	case conn.State.HalfOpen():
+		// the remote host sent the SYN
+		return Inbound
+	case conn.State == TCPSynSent:
+		return Outbound
+	case len(l) > 0:
+		if l.contains(conn.LocalIP, conn.LocalPort) {
+			return Inbound
+		}
+		return Outbound
+	case ephemeral.Contains(conn.LocalPort):
+		return Outbound
+	default:
+		return Inbound
+	}
+}
@@ -0,0 +1,113 @@
+package connections
+
+import (
+	"net"
+	"testing"
+)
+
+func Test_direction(t *testing.T) {
+	l := listeners{
+		"0.0.0.0:22":       {},
+		"10.0.0.1:8443":    {},
+		"[::]:80":          {},
+		"[2001:db8::1]:53": {},
+	}
+
+	type args struct {
+		conn Connection
+		l    listeners
+	}
+	tests := []struct {
+		name string
+		args args
+		want Direction
+	}{
+		{
+			name: "ipv4 wildcard listener",
+			args: args{
+				conn: Connection{LocalIP: net.IPv4(10, 0, 0, 1), LocalPort: 22, State: TCPEstablished},
+				l:    l,
+			},
+			want: Inbound,
+		},
+		{
+			name: "high service port listener",
+			args: args{
+				conn: Connection{LocalIP: net.IPv4(10, 0, 0, 1), LocalPort: 8443, State: TCPEstablished},
+				l:    l,
+			},
+			want: Inbound,
+		},
+		{
+			name: "listener on other address",
+			args: args{
+				conn: Connection{LocalIP: net.IPv4(10, 0, 0, 2), LocalPort: 8443, State: TCPEstablished},
+				l:    l,
+			},
+			want: Outbound,
+		},
+		{
+			name: "ipv4 on dual-stack listener",
+			args: args{
+				conn: Connection{LocalIP: net.IPv4(10, 0, 0, 1), LocalPort: 80, State: TCPEstablished},
+				l:    l,
+			},
+			want: Inbound,
+		},
+		{
+			name: "ipv6 listener",
+			args: args{
+				conn: Connection{LocalIP: net.ParseIP("2001:db8::1"), LocalPort: 53, State: TCPEstablished},
+				l:    l,
+			},
+			want: Inbound,
+		},
+		{
+			name: "outbound from low port",
+			args: args{
+				conn: Connection{LocalIP: net.IPv4(10, 0, 0, 1), LocalPort: 1024, State: TCPEstablished},
+				l:    l,
+			},
+			want: Outbound,
+		},
+		{
+			name: "half-open without listener",
+			args: args{
+				conn: Connection{LocalIP: net.IPv4(10, 0, 0, 1), LocalPort: 1024, State: TCPSynRecv},
+				l:    l,
+			},
+			want: Inbound,
+		},
+		{
+			name: "no listeners ephemeral port",
+			args: args{
+				conn: Connection{LocalIP: net.IPv4(10, 0, 0, 1), LocalPort: 50000, State: TCPEstablished},
+				l:    listeners{},
+			},
+			want: Outbound,
+		},
+		{
+			name: "no listeners service port",
+			args: args{
+				conn: Connection{LocalIP: net.IPv4(10, 0, 0, 1), LocalPort: 443, State: TCPEstablished},
+				l:    listeners{},
+			},
+			want: Inbound,
+		},
+		{
+			name: "listening socket",
+			args: args{
+				conn: Connection{LocalIP: net.IPv4zero, LocalPort: 22, State: TCPListen},
+				l:    l,
+			},
+			want: DirectionUnknown,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := direction(tt.args.conn, tt.args.l, DefaultEphemeralRange); got != tt.want {
+				t.Errorf("direction() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
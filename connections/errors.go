@@ -0,0 +1,73 @@
+package connections
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+var (
+	// ErrBackendUnavailable is returned when there is no firewall backend to block with, or it can't be run
+	ErrBackendUnavailable = errors.New("firewall backend unavailable")
+	// ErrPermissionDenied is returned when the firewall backend refuses a change, usually for lack of CAP_NET_ADMIN
+	ErrPermissionDenied = errors.New("permission denied")
+	// ErrRuleExists is returned when a host has a rule in the firewall backend without being blocked by the IPBlocker
+	ErrRuleExists = errors.New("rule exists")
+	// ErrAllowlisted is returned for hosts that are never blocked
+	ErrAllowlisted = errors.New("host is allowlisted")
+)
+
+// Kinds of BlockError, the labels of the block_errors metric
+const (
+	ErrorKindBackendUnavailable = "backend_unavailable"
+	ErrorKindPermissionDenied   = "permission_denied"
+	ErrorKindRuleExists         = "rule_exists"
+	ErrorKindAllowlisted        = "allowlisted"
+	ErrorKindOther              = "other"
+)
+
+// BlockError is a failure to block the remote host IP for Reason
+type BlockError struct {
+	IP     net.IP
+	Reason string
+	Err    error
+}
+
+func (e *BlockError) Error() string {
+	return fmt.Sprintf("failed to block %s for %s: %v", e.IP, e.Reason, e.Err)
+}
+
+func (e *BlockError) Unwrap() error {
+	return e.Err
+}
+
+// Kind returns the kind of the error, ErrorKindOther unless it wraps one of the errors of this package
+func (e *BlockError) Kind() string {
+	switch {
+	case errors.Is(e.Err, ErrBackendUnavailable):
+		return ErrorKindBackendUnavailable
+	case errors.Is(e.Err, ErrPermissionDenied):
+		return ErrorKindPermissionDenied
+	case errors.Is(e.Err, ErrRuleExists):
+		return ErrorKindRuleExists
+	case errors.Is(e.Err, ErrAllowlisted):
+		return ErrorKindAllowlisted
+	default:
+		return ErrorKindOther
+	}
+}
+
+// backendError wraps an error of a Backend with ErrPermissionDenied or ErrBackendUnavailable when its message tells so.
+// The backends run iptables, nft and ipset, whose failures only come as messages.
+func backendError(err error) error {
+	msg := strings.ToLower(err.Error())
+	switch {
+	case strings.Contains(msg, "permission denied"), strings.Contains(msg, "operation not permitted"):
+		return fmt.Errorf("%w: %v", ErrPermissionDenied, err)
+	case strings.Contains(msg, "executable file not found"), strings.Contains(msg, "xtables lock"):
+		return fmt.Errorf("%w: %v", ErrBackendUnavailable, err)
+	default:
+		return err
+	}
+}
@@ -0,0 +1,54 @@
+package connections
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestBlockError(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		wantKind string
+		wantMsg  string
+	}{
+		{
+			name:     "permission denied",
+			err:      backendError(errors.New("running [/usr/sbin/iptables -t filter -I CONNWATCHER 1 -s 192.0.2.1/32 -j DROP --wait]: exit status 4: iptables v1.8.7 (nf_tables): Could not fetch rule set generation id: Permission denied (you must be root)")),
+			wantKind: ErrorKindPermissionDenied,
+		},
+		{
+			name:     "operation not permitted",
+			err:      backendError(errors.New("nft add element inet connwatcher blocked4 { 192.0.2.1 }: exit status 1: Error: Could not process rule: Operation not permitted")),
+			wantKind: ErrorKindPermissionDenied,
+		},
+		{
+			name:     "xtables lock",
+			err:      backendError(errors.New("exit status 4: Another app is currently holding the xtables lock")),
+			wantKind: ErrorKindBackendUnavailable,
+		},
+		{
+			name:     "rule exists",
+			err:      ErrRuleExists,
+			wantKind: ErrorKindRuleExists,
+			wantMsg:  "failed to block 192.0.2.1 for portscan: rule exists",
+		},
+		{
+			name:     "other",
+			err:      backendError(errors.New("exit status 2: Bad argument")),
+			wantKind: ErrorKindOther,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := &BlockError{IP: net.ParseIP("192.0.2.1"), Reason: ReasonPortScan, Err: tt.err}
+			if got := err.Kind(); got != tt.wantKind {
+				t.Errorf("Kind() = %v, want %v", got, tt.wantKind)
+			}
+			if tt.wantMsg != "" && err.Error() != tt.wantMsg {
+				t.Errorf("Error() = %q, want %q", err.Error(), tt.wantMsg)
+			}
+		})
+	}
+}
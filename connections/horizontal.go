@@ -0,0 +1,112 @@
+package connections
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultHorizontalThreshold is the number of distinct local IPs a remote host connects to on the same port before it
+// is blocked
+const DefaultHorizontalThreshold = 5
+
+// HorizontalKey identifies the local IPs a remote host connected to on a local port
+type HorizontalKey struct {
+	RemoteIP  string
+	LocalPort uint16
+}
+
+// HorizontalScanDetector blocks remote hosts connecting to the same port of the threshold or more distinct local IPs
+// within the window, a horizontal scan of a multi-homed host or of many virtual IPs. The PortScanDetector counts ports
+// per local IP, so it never sees such a sweep.
+type HorizontalScanDetector struct {
+	// LocalIPs maps each remote host and local port to the local IPs connected to and when they were last seen
+	LocalIPs map[HorizontalKey]map[string]int64
+	// Threshold is the number of distinct local IPs that gets a host blocked, DefaultHorizontalThreshold if zero
+	Threshold int
+	// Window is the sliding window local IPs are counted in, DefaultWindow if zero
+	Window time.Duration
+
+	// mu guards every field
+	mu sync.Mutex
+}
+
+// Name returns DetectorHorizontalScan
+func (d *HorizontalScanDetector) Name() string {
+	return DetectorHorizontalScan
+}
+
+// Configure counts local IPs against the horizontal threshold and window of c, the window of c if it has no horizontal
+// window
+func (d *HorizontalScanDetector) Configure(c DetectorConfig) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.Threshold = c.HorizontalThreshold
+	d.Window = c.HorizontalWindow
+	if d.Window == 0 {
+		d.Window = c.Window
+	}
+}
+
+// Observe records the local IP of o as connected to on its port
+func (d *HorizontalScanDetector) Observe(o Observation) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.LocalIPs == nil {
+		d.LocalIPs = make(map[HorizontalKey]map[string]int64)
+	}
+
+	key := HorizontalKey{RemoteIP: o.RemoteIP, LocalPort: o.LocalPort}
+	if _, present := d.LocalIPs[key]; !present {
+		d.LocalIPs[key] = make(map[string]int64)
+	}
+	if seen, present := d.LocalIPs[key][o.LocalIP]; !present || o.Time > seen {
+		d.LocalIPs[key][o.LocalIP] = o.Time
+	}
+}
+
+// Verdicts forgets the local IPs last seen a window or longer before unix time now and returns the remote hosts that
+// connected to the threshold or more local IPs on a port
+func (d *HorizontalScanDetector) Verdicts(now int64) []Verdict {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	threshold, window := d.Threshold, d.Window
+	if threshold == 0 {
+		threshold = DefaultHorizontalThreshold
+	}
+	if window == 0 {
+		window = DefaultWindow
+	}
+
+	var verdicts []Verdict
+	for key, localIPs := range d.LocalIPs {
+		for ip, seen := range localIPs {
+			if now-seen >= int64(window/time.Second) {
+				delete(localIPs, ip)
+			}
+		}
+		if len(localIPs) < threshold {
+			if len(localIPs) == 0 {
+				delete(d.LocalIPs, key)
+			}
+			continue
+		}
+
+		var ips []string
+		for ip := range localIPs {
+			ips = append(ips, ip)
+		}
+		verdicts = append(verdicts, Verdict{
+			Host:     RemoteHost{RemoteIP: net.ParseIP(key.RemoteIP), Ports: []uint16{key.LocalPort}},
+			Reason:   DetectorHorizontalScan,
+			Severity: SeverityMedium,
+			Evidence: fmt.Sprintf("connected to port %d of %d local IPs: %s", key.LocalPort, len(ips), ipsToString(ips)),
+		})
+		delete(d.LocalIPs, key)
+	}
+	return verdicts
+}
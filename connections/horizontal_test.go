@@ -0,0 +1,112 @@
+package connections
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHorizontalScanDetector_Verdicts(t *testing.T) {
+	type obs struct {
+		local string
+		port  uint16
+		time  int64
+	}
+	tests := []struct {
+		name string
+		obs  []obs
+		now  int64
+		want string
+	}{
+		{
+			name: "same port of three local ips",
+			obs:  []obs{{"10.0.0.1", 22, 0}, {"10.0.0.2", 22, 1}, {"10.0.0.3", 22, 2}},
+			now:  10,
+			want: "connected to port 22 of 3 local IPs: 10.0.0.1,10.0.0.2,10.0.0.3",
+		},
+		{
+			name: "different ports",
+			obs:  []obs{{"10.0.0.1", 22, 0}, {"10.0.0.2", 23, 1}, {"10.0.0.3", 24, 2}},
+			now:  10,
+		},
+		{
+			name: "same local ip counted once",
+			obs:  []obs{{"10.0.0.1", 22, 0}, {"10.0.0.1", 22, 1}, {"10.0.0.2", 22, 2}},
+			now:  10,
+		},
+		{
+			name: "outside the window",
+			obs:  []obs{{"10.0.0.1", 22, 0}, {"10.0.0.2", 22, 40}, {"10.0.0.3", 22, 80}},
+			now:  80,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &HorizontalScanDetector{Threshold: 3}
+			for _, o := range tt.obs {
+				d.Observe(Observation{LocalIP: o.local, RemoteIP: "192.168.1.1", LocalPort: o.port, Time: o.time})
+			}
+
+			got := d.Verdicts(tt.now)
+			if tt.want == "" {
+				if len(got) != 0 {
+					t.Errorf("Verdicts() = %v, want none", got)
+				}
+				return
+			}
+			if len(got) != 1 || got[0].Evidence != tt.want || got[0].Host.RemoteIP.String() != "192.168.1.1" {
+				t.Errorf("Verdicts() = %v, want 192.168.1.1 %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHorizontalScanDetector_Configure(t *testing.T) {
+	d := &HorizontalScanDetector{}
+	d.Configure(DetectorConfig{PortThreshold: 3, Window: time.Minute, HorizontalThreshold: 10})
+	if d.Threshold != 10 || d.Window != time.Minute {
+		t.Errorf("Configure() = %d %v, want 10 1m0s", d.Threshold, d.Window)
+	}
+
+	d.Configure(DetectorConfig{Window: time.Minute, HorizontalWindow: 5 * time.Minute})
+	if d.Window != 5*time.Minute {
+		t.Errorf("Configure() window = %v, want 5m0s", d.Window)
+	}
+}
+
+// TestHorizontalScanDetector_vipSweep observes a remote host connecting to ssh on six VIPs of a load balancer, one port
+// each, which only the horizontal detector catches
+func TestHorizontalScanDetector_vipSweep(t *testing.T) {
+	tests := []struct {
+		name      string
+		detectors []string
+		want      string
+	}{
+		{name: "missed by the default detectors", detectors: DefaultDetectors},
+		{name: "horizontal", detectors: []string{DetectorPortScan, DetectorHorizontalScan}, want: "10.192.1.21"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			detection, err := NewDetection(DetectorConfig{Detectors: tt.detectors})
+			if err != nil {
+				t.Fatalf("NewDetection() error = %v", err)
+			}
+			cw := NewConnectionWatcher(NewProcSource("../test/tcp_vipsweep"), nil, PortRange{Min: 32768, Max: 60999})
+			cw.Detection = detection
+			cw.Observe(100)
+
+			verdicts := detection.Verdicts(100)
+			if tt.want == "" {
+				if len(verdicts) != 0 {
+					t.Errorf("Verdicts() = %v, want none", verdicts)
+				}
+				return
+			}
+			if len(verdicts) != 1 || verdicts[0].Host.RemoteIP.String() != tt.want || verdicts[0].Reason != DetectorHorizontalScan {
+				t.Fatalf("Verdicts() = %v, want horizontal scan from %s", verdicts, tt.want)
+			}
+			if got := verdicts[0].Host.Ports; len(got) != 1 || got[0] != 22 {
+				t.Errorf("Verdicts() ports = %v, want [22]", got)
+			}
+		})
+	}
+}
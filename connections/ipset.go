@@ -0,0 +1,255 @@
+package connections
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// DefaultIPSetName is the name of the list:set owned by the ipset backend
+const DefaultIPSetName = "connwatcher"
+
+// IPSetBackend blocks hosts by adding them to ipsets, hosts to hash:ip sets and networks to hash:net sets of their
+// address family. The four sets are members of a list:set matched by a single DROP rule at the head of Table and
+// Chain, in both iptables and ip6tables, so the packet path cost doesn't grow with the number of blocks. Members of the
+// sets expire on their own after their ttl.
+type IPSetBackend struct {
+	IP4Table RuleTable
+	IP6Table RuleTable
+	// Table and Chain are where the rule matching the list:set is inserted, DefaultTable and DefaultChain if empty
+	Table string
+	Chain string
+	// Set is the name of the list:set, DefaultIPSetName if empty. The member sets are named after it.
+	Set string
+
+	// run executes ipset with args and stdin, returning its stdout
+	run func(stdin string, args ...string) ([]byte, error)
+}
+
+// NewIPSetBackend returns an IPSetBackend using the list:set named set, matched by a rule in table and chain. The
+// sets and rule are created if missing, members already in the sets are kept.
+func NewIPSetBackend(set, table, chain string) (*IPSetBackend, error) {
+	if _, err := exec.LookPath("ipset"); err != nil {
+		return nil, fmt.Errorf("ipset is unavailable: %v", err)
+	}
+
+	b := &IPSetBackend{
+		IP4Table: NewIPv4Table(),
+		IP6Table: NewIPv6Table(),
+		Table:    table,
+		Chain:    chain,
+		Set:      set,
+		run:      runIPSet,
+	}
+	if b.IP4Table == nil && b.IP6Table == nil {
+		return nil, errors.New("neither iptables nor ip6tables is available")
+	}
+
+	if _, err := b.run(b.createScript(), "restore", "-exist"); err != nil {
+		return nil, fmt.Errorf("failed to create ipset %s: %v", b.set(), err)
+	}
+
+	tableName, chain := ruleLocation(b.Table, b.Chain)
+	for _, t := range availableTables(b.IP4Table, b.IP6Table) {
+		exist, err := t.Exists(tableName, chain, b.matchSpec()...)
+		if err != nil {
+			return nil, err
+		}
+		if exist {
+			continue
+		}
+		if err := t.Insert(tableName, chain, 1, b.matchSpec()...); err != nil {
+			return nil, fmt.Errorf("failed to insert rule matching ipset %s: %v", b.set(), err)
+		}
+	}
+
+	return b, nil
+}
+
+// runIPSet executes the ipset command
+func runIPSet(stdin string, args ...string) ([]byte, error) {
+	cmd := exec.Command("ipset", args...)
+	cmd.Stdin = strings.NewReader(stdin)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("ipset %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+func (b *IPSetBackend) set() string {
+	if b.Set == "" {
+		return DefaultIPSetName
+	}
+	return b.Set
+}
+
+// members returns the names of the sets in the list:set
+func (b *IPSetBackend) members() []string {
+	return []string{b.set() + "-ip4", b.set() + "-ip6", b.set() + "-net4", b.set() + "-net6"}
+}
+
+// memberFor returns the set n is blocked in
+func (b *IPSetBackend) memberFor(n *net.IPNet) string {
+	name := b.set()
+	if ones, bits := n.Mask.Size(); ones == bits {
+		name += "-ip"
+	} else {
+		name += "-net"
+	}
+
+	if isIPv4(n) {
+		return name + "4"
+	}
+	return name + "6"
+}
+
+// createScript returns the ipset restore script creating the sets, a timeout of 0 is the default so members only
+// expire when given a timeout
+func (b *IPSetBackend) createScript() string {
+	m := b.members()
+	return fmt.Sprintf(`create %[1]s hash:ip family inet timeout 0
+create %[2]s hash:ip family inet6 timeout 0
+create %[3]s hash:net family inet timeout 0
+create %[4]s hash:net family inet6 timeout 0
+create %[5]s list:set
+add %[5]s %[1]s
+add %[5]s %[2]s
+add %[5]s %[3]s
+add %[5]s %[4]s
+`, m[0], m[1], m[2], m[3], b.set())
+}
+
+func (b *IPSetBackend) matchSpec() []string {
+	return []string{"-m", "set", "--match-set", b.set(), "src", "-j", "DROP"}
+}
+
+// Block adds n to its set, expiring after ttl unless it is zero. Blocking n again updates its timeout.
+func (b *IPSetBackend) Block(n *net.IPNet, ttl time.Duration) error {
+	timeout := fmt.Sprint(int64(ttl / time.Second))
+	_, err := b.run("", "add", "-exist", b.memberFor(n), element(n), "timeout", timeout)
+	return err
+}
+
+// Unblock deletes n from its set
+func (b *IPSetBackend) Unblock(n *net.IPNet) error {
+	_, err := b.run("", "del", "-exist", b.memberFor(n), element(n))
+	return err
+}
+
+// Exists returns true if n is a member of its set
+func (b *IPSetBackend) Exists(n *net.IPNet) (bool, error) {
+	nets, err := b.listSet(b.memberFor(n))
+	if err != nil {
+		return false, err
+	}
+	return containsNet(nets, n), nil
+}
+
+// List returns the members of every set
+func (b *IPSetBackend) List() ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, set := range b.members() {
+		members, err := b.listSet(set)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, members...)
+	}
+	return nets, nil
+}
+
+func (b *IPSetBackend) listSet(set string) ([]*net.IPNet, error) {
+	out, err := b.run("", "save", set)
+	if err != nil {
+		return nil, err
+	}
+	return parseIPSetSave(out)
+}
+
+// CleanUp deletes the rule matching the list:set and destroys the sets along with all of their members
+func (b *IPSetBackend) CleanUp() error {
+	tableName, chain := ruleLocation(b.Table, b.Chain)
+	for _, t := range availableTables(b.IP4Table, b.IP6Table) {
+		if err := t.DeleteIfExists(tableName, chain, b.matchSpec()...); err != nil {
+			return fmt.Errorf("failed to remove rule matching ipset %s: %v", b.set(), err)
+		}
+	}
+
+	script := "destroy " + b.set() + "\n"
+	for _, set := range b.members() {
+		script += "destroy " + set + "\n"
+	}
+	_, err := b.run(script, "restore")
+	return err
+}
+
+// Relocate moves the rule matching the list:set to table and chain, it is inserted in the new location before it is
+// deleted from the old one
+func (b *IPSetBackend) Relocate(table, chain string) error {
+	oldTable, oldChain := ruleLocation(b.Table, b.Chain)
+	newTable, newChain := ruleLocation(table, chain)
+	if oldTable == newTable && oldChain == newChain {
+		return nil
+	}
+
+	var moved []RuleTable
+	for _, t := range availableTables(b.IP4Table, b.IP6Table) {
+		if err := t.Insert(newTable, newChain, 1, b.matchSpec()...); err != nil {
+			for _, m := range moved {
+				if err := m.Delete(newTable, newChain, b.matchSpec()...); err != nil {
+					log.Printf("Failed to remove rule matching ipset %s from %s/%s: %v", b.set(), newTable, newChain, err)
+				}
+			}
+			return fmt.Errorf("failed to move rule matching ipset %s to %s/%s: %v", b.set(), newTable, newChain, err)
+		}
+		moved = append(moved, t)
+	}
+
+	for _, t := range moved {
+		if err := t.Delete(oldTable, oldChain, b.matchSpec()...); err != nil {
+			log.Printf("Failed to remove rule matching ipset %s from %s/%s: %v", b.set(), oldTable, oldChain, err)
+		}
+	}
+
+	b.Table, b.Chain = table, chain
+	return nil
+}
+
+// parseIPSetSave returns the members in the output of ipset save
+func parseIPSetSave(out []byte) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[0] != "add" {
+			continue
+		}
+
+		if strings.Contains(fields[2], "/") {
+			_, n, err := net.ParseCIDR(fields[2])
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse ipset member: %v", err)
+			}
+			nets = append(nets, n)
+			continue
+		}
+
+		ip := net.ParseIP(fields[2])
+		if ip == nil {
+			return nil, fmt.Errorf("failed to parse ipset member: invalid address %q", fields[2])
+		}
+		nets = append(nets, hostNet(ip))
+	}
+
+	return nets, scanner.Err()
+}
@@ -0,0 +1,99 @@
+package connections
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseIPSetSave(t *testing.T) {
+	tests := []struct {
+		name    string
+		out     string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "empty set",
+			out:  "create connwatcher-ip4 hash:ip family inet hashsize 1024 maxelem 65536 timeout 0\n",
+			want: nil,
+		},
+		{
+			name: "hosts",
+			out: "create connwatcher-ip4 hash:ip family inet hashsize 1024 maxelem 65536 timeout 0\n" +
+				"add connwatcher-ip4 10.192.1.21 timeout 3412\n" +
+				"add connwatcher-ip4 198.51.100.7 timeout 0\n",
+			want: []string{"10.192.1.21/32", "198.51.100.7/32"},
+		},
+		{
+			name: "networks",
+			out: "create connwatcher-net6 hash:net family inet6 hashsize 1024 maxelem 65536 timeout 0\n" +
+				"add connwatcher-net6 2001:db8:1::/48 timeout 0\n",
+			want: []string{"2001:db8:1::/48"},
+		},
+		{
+			name:    "invalid member",
+			out:     "add connwatcher-ip4 10.192.1 timeout 0\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nets, err := parseIPSetSave([]byte(tt.out))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseIPSetSave() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			var got []string
+			for _, n := range nets {
+				got = append(got, n.String())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseIPSetSave() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIPSetBackend(t *testing.T) {
+	var commands []string
+	b := &IPSetBackend{
+		run: func(stdin string, args ...string) ([]byte, error) {
+			commands = append(commands, strings.TrimSpace(strings.Join(args, " ")+" "+strings.ReplaceAll(stdin, "\n", ";")))
+			if args[0] == "save" && args[1] == "connwatcher-ip6" {
+				return []byte("add connwatcher-ip6 2001:db8::1 timeout 0\n"), nil
+			}
+			return nil, nil
+		},
+	}
+	_, n, _ := net.ParseCIDR("192.0.2.0/24")
+
+	if err := b.Block(hostNet(net.ParseIP("10.192.1.21")), time.Hour); err != nil {
+		t.Fatalf("Block() error = %v", err)
+	}
+	if err := b.Block(n, 0); err != nil {
+		t.Fatalf("Block() error = %v", err)
+	}
+	if err := b.Unblock(hostNet(net.ParseIP("10.192.1.21"))); err != nil {
+		t.Errorf("Unblock() error = %v", err)
+	}
+	if exists, err := b.Exists(hostNet(net.ParseIP("2001:db8::1"))); err != nil || !exists {
+		t.Errorf("Exists() = %v, %v, want true", exists, err)
+	}
+	if err := b.CleanUp(); err != nil {
+		t.Errorf("CleanUp() error = %v", err)
+	}
+
+	want := []string{
+		"add -exist connwatcher-ip4 10.192.1.21 timeout 3600",
+		"add -exist connwatcher-net4 192.0.2.0/24 timeout 0",
+		"del -exist connwatcher-ip4 10.192.1.21",
+		"save connwatcher-ip6",
+		"restore destroy connwatcher;destroy connwatcher-ip4;destroy connwatcher-ip6;destroy connwatcher-net4;destroy connwatcher-net6;",
+	}
+	if !reflect.DeepEqual(commands, want) {
+		t.Errorf("ipset commands = %q, want %q", commands, want)
+	}
+}
@@ -0,0 +1,371 @@
+package connections
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+const (
+	// DefaultBlockChain is the chain owned by the iptables backend that holds every block rule
+	DefaultBlockChain = "CONNWATCHER"
+
+	// StaleChainFlush removes the rules of a block chain left behind by a previous run
+	StaleChainFlush = "flush"
+	// StaleChainAdopt keeps the rules of a block chain left behind by a previous run
+	StaleChainAdopt = "adopt"
+
+	// RuleComment tags every rule inserted by the iptables backend, only tagged rules are listed as its blocks
+	RuleComment = "connectionWatcher"
+)
+
+// RuleTable is the part of an iptables.IPTables used by the backends, for either iptables or ip6tables
+type RuleTable interface {
+	Exists(table, chain string, rulespec ...string) (bool, error)
+	Insert(table, chain string, pos int, rulespec ...string) error
+	Append(table, chain string, rulespec ...string) error
+	AppendUnique(table, chain string, rulespec ...string) error
+	Delete(table, chain string, rulespec ...string) error
+	DeleteIfExists(table, chain string, rulespec ...string) error
+	List(table, chain string) ([]string, error)
+	ChainExists(table, chain string) (bool, error)
+	NewChain(table, chain string) error
+	ClearChain(table, chain string) error
+	ClearAndDeleteChain(table, chain string) error
+}
+
+// IPTablesBackend blocks hosts with a DROP rule per host in BlockChain, a chain owned by the backend that Chain of
+// Table jumps to. ip6tables is used for IPv6 hosts, either table may be nil when its command is unavailable. Keeping
+// the rules in their own chain leaves the rules of other tools in Chain alone, and a single jump and chain to remove
+// on CleanUp.
+type IPTablesBackend struct {
+	IP4Table RuleTable
+	IP6Table RuleTable
+	// Table and Chain are where the jump to BlockChain is inserted, DefaultTable and DefaultChain if empty
+	Table string
+	Chain string
+	// BlockChain is the chain holding the block rules, DefaultBlockChain if empty
+	BlockChain string
+}
+
+// NewIPTablesBackend returns an IPTablesBackend keeping rules in blockChain of table, jumped to from chain. A block
+// chain that exists already was left behind by a previous run that didn't clean up, its rules are kept with the
+// StaleChainAdopt policy and removed with StaleChainFlush. At least one of iptables and ip6tables has to be available.
+func NewIPTablesBackend(table, chain, blockChain, stale string) (*IPTablesBackend, error) {
+	b := &IPTablesBackend{
+		IP4Table:   NewIPv4Table(),
+		IP6Table:   NewIPv6Table(),
+		Table:      table,
+		Chain:      chain,
+		BlockChain: blockChain,
+	}
+	if b.IP4Table == nil && b.IP6Table == nil {
+		return nil, errors.New("neither iptables nor ip6tables is available")
+	}
+
+	tableName, chainName := ruleLocation(b.Table, b.Chain)
+	for _, t := range availableTables(b.IP4Table, b.IP6Table) {
+		if err := b.setupChain(t, tableName, stale); err != nil {
+			return nil, err
+		}
+		if err := b.insertJump(t, tableName, chainName); err != nil {
+			return nil, err
+		}
+	}
+
+	return b, nil
+}
+
+// NewIPv4Table returns an IPTables to be used for host blocking. Checks that the ACCEPT and INPUT are present to be used
+// shortcut: we are assuming the ACCEPT table is present along with the INPUT chain
+func NewIPv4Table() RuleTable {
+	ip4t, err := iptables.New()
+	if err != nil {
+		log.Printf("Failed to create iptables: %v. IPv4 host blocking is disabled.", err)
+		return nil
+	}
+
+	return ip4t
+}
+
+// NewIPv6Table returns an IPTables backed by ip6tables to be used for blocking IPv6 hosts
+func NewIPv6Table() RuleTable {
+	ip6t, err := iptables.NewWithProtocol(iptables.ProtocolIPv6)
+	if err != nil {
+		log.Printf("Failed to create ip6tables: %v. IPv6 host blocking is disabled.", err)
+		return nil
+	}
+
+	return ip6t
+}
+
+// ruleLocation returns table and chain, or their defaults if empty
+func ruleLocation(table, chain string) (string, string) {
+	if table == "" {
+		table = DefaultTable
+	}
+	if chain == "" {
+		chain = DefaultChain
+	}
+	return table, chain
+}
+
+func dropSpec(n *net.IPNet) []string {
+	return []string{"-s", n.String(), "-m", "comment", "--comment", RuleComment, "-j", "DROP"}
+}
+
+func (b *IPTablesBackend) blockChain() string {
+	if b.BlockChain == "" {
+		return DefaultBlockChain
+	}
+	return b.BlockChain
+}
+
+func (b *IPTablesBackend) jumpSpec() []string {
+	return []string{"-j", b.blockChain()}
+}
+
+// availableTables returns those of the iptables and ip6tables tables that are available, either is nil when missing
+func availableTables(ip4, ip6 RuleTable) []RuleTable {
+	var tables []RuleTable
+	for _, t := range []RuleTable{ip4, ip6} {
+		if t != nil {
+			tables = append(tables, t)
+		}
+	}
+	return tables
+}
+
+// setupChain creates the block chain in table, applying the stale policy if it exists already
+func (b *IPTablesBackend) setupChain(t RuleTable, table string, stale string) error {
+	exists, err := t.ChainExists(table, b.blockChain())
+	if err != nil {
+		return fmt.Errorf("failed to check for chain %s: %v", b.blockChain(), err)
+	}
+
+	if !exists {
+		if err := t.NewChain(table, b.blockChain()); err != nil {
+			return fmt.Errorf("failed to create chain %s: %v", b.blockChain(), err)
+		}
+		return nil
+	}
+
+	if stale == StaleChainAdopt {
+		nets, err := b.list(t, table)
+		if err != nil {
+			return fmt.Errorf("failed to list stale chain %s: %v", b.blockChain(), err)
+		}
+		log.Printf("Adopted stale chain %s/%s with %d blocks", table, b.blockChain(), len(nets))
+		return nil
+	}
+
+	if err := t.ClearChain(table, b.blockChain()); err != nil {
+		return fmt.Errorf("failed to flush stale chain %s: %v", b.blockChain(), err)
+	}
+	log.Printf("Flushed stale chain %s/%s", table, b.blockChain())
+	return nil
+}
+
+// insertJump inserts the jump to the block chain at the head of chain unless it exists already
+func (b *IPTablesBackend) insertJump(t RuleTable, table, chain string) error {
+	exists, err := t.Exists(table, chain, b.jumpSpec()...)
+	if err != nil {
+		return fmt.Errorf("failed to check for jump to %s: %v", b.blockChain(), err)
+	}
+	if exists {
+		return nil
+	}
+
+	if err := t.Insert(table, chain, 1, b.jumpSpec()...); err != nil {
+		return fmt.Errorf("failed to insert jump to %s into %s/%s: %v", b.blockChain(), table, chain, err)
+	}
+	return nil
+}
+
+// tableFor returns the table used to block n, IPv4-mapped addresses are blocked through iptables
+func (b *IPTablesBackend) tableFor(n *net.IPNet) (RuleTable, error) {
+	if isIPv4(n) {
+		if b.IP4Table == nil {
+			return nil, fmt.Errorf("%w: iptables", ErrBackendUnavailable)
+		}
+		return b.IP4Table, nil
+	}
+
+	if b.IP6Table == nil {
+		return nil, fmt.Errorf("%w: ip6tables", ErrBackendUnavailable)
+	}
+	return b.IP6Table, nil
+}
+
+// Block appends a rule dropping traffic from n to the block chain unless it exists already, the ttl is left to the
+// caller
+func (b *IPTablesBackend) Block(n *net.IPNet, _ time.Duration) error {
+	table, err := b.tableFor(n)
+	if err != nil {
+		return err
+	}
+
+	tableName, _ := ruleLocation(b.Table, b.Chain)
+	return table.AppendUnique(tableName, b.blockChain(), dropSpec(n)...)
+}
+
+// Unblock deletes the rule dropping traffic from n
+func (b *IPTablesBackend) Unblock(n *net.IPNet) error {
+	table, err := b.tableFor(n)
+	if err != nil {
+		return err
+	}
+
+	tableName, _ := ruleLocation(b.Table, b.Chain)
+	return table.DeleteIfExists(tableName, b.blockChain(), dropSpec(n)...)
+}
+
+// Exists returns true if a rule drops traffic from n
+func (b *IPTablesBackend) Exists(n *net.IPNet) (bool, error) {
+	table, err := b.tableFor(n)
+	if err != nil {
+		return false, err
+	}
+
+	tableName, _ := ruleLocation(b.Table, b.Chain)
+	return table.Exists(tableName, b.blockChain(), dropSpec(n)...)
+}
+
+// List returns the sources of every rule in the block chain tagged with the RuleComment
+func (b *IPTablesBackend) List() ([]*net.IPNet, error) {
+	tableName, _ := ruleLocation(b.Table, b.Chain)
+
+	var nets []*net.IPNet
+	for _, t := range availableTables(b.IP4Table, b.IP6Table) {
+		tableNets, err := b.list(t, tableName)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, tableNets...)
+	}
+
+	return nets, nil
+}
+
+// list returns the sources of the rules in the block chain of table
+func (b *IPTablesBackend) list(t RuleTable, table string) ([]*net.IPNet, error) {
+	rules, err := t.List(table, b.blockChain())
+	if err != nil {
+		return nil, err
+	}
+
+	var nets []*net.IPNet
+	for _, rule := range rules {
+		if n, ok := parseDropRule(rule, b.blockChain()); ok {
+			nets = append(nets, n)
+		}
+	}
+	return nets, nil
+}
+
+// parseDropRule returns the source of rule if it is a rule of chain in the form inserted by Block, as printed by
+// iptables -S
+func parseDropRule(rule string, chain string) (*net.IPNet, bool) {
+	fields := strings.Fields(rule)
+	if len(fields) != 10 || fields[0] != "-A" || fields[1] != chain || fields[2] != "-s" {
+		return nil, false
+	}
+	if strings.Join(fields[4:], " ") != "-m comment --comment "+RuleComment+" -j DROP" {
+		return nil, false
+	}
+
+	_, n, err := net.ParseCIDR(fields[3])
+	if err != nil {
+		return nil, false
+	}
+	return n, true
+}
+
+// CleanUp deletes the jump to the block chain and the block chain along with every rule in it
+func (b *IPTablesBackend) CleanUp() error {
+	tableName, chain := ruleLocation(b.Table, b.Chain)
+
+	var failed []string
+	for _, t := range availableTables(b.IP4Table, b.IP6Table) {
+		if err := t.DeleteIfExists(tableName, chain, b.jumpSpec()...); err != nil {
+			failed = append(failed, fmt.Sprintf("jump to %s: %v", b.blockChain(), err))
+			continue
+		}
+		if err := t.ClearAndDeleteChain(tableName, b.blockChain()); err != nil {
+			failed = append(failed, fmt.Sprintf("chain %s: %v", b.blockChain(), err))
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to remove %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// Relocate moves the jump to the block chain to chain of table. When the table changes, the block chain and its rules
+// are copied to the new table first. Nothing is removed from the previous location until every table has been moved,
+// if any can't be the previous table and chain are kept.
+func (b *IPTablesBackend) Relocate(table, chain string) error {
+	oldTable, oldChain := ruleLocation(b.Table, b.Chain)
+	newTable, newChain := ruleLocation(table, chain)
+	if oldTable == newTable && oldChain == newChain {
+		return nil
+	}
+
+	var moved []RuleTable
+	for _, t := range availableTables(b.IP4Table, b.IP6Table) {
+		err := b.copyTo(t, oldTable, newTable, newChain)
+		if err != nil {
+			b.removeFrom(append(moved, t), oldTable, newTable, newChain)
+			return fmt.Errorf("failed to move chain %s to %s/%s: %v", b.blockChain(), newTable, newChain, err)
+		}
+		moved = append(moved, t)
+	}
+
+	b.removeFrom(moved, newTable, oldTable, oldChain)
+
+	b.Table, b.Chain = table, chain
+	return nil
+}
+
+// copyTo copies the block chain of t from table to newTable, if they differ, and inserts the jump into newChain
+func (b *IPTablesBackend) copyTo(t RuleTable, table, newTable, newChain string) error {
+	if newTable != table {
+		nets, err := b.list(t, table)
+		if err != nil {
+			return err
+		}
+		if err := t.ClearChain(newTable, b.blockChain()); err != nil {
+			return err
+		}
+		for _, n := range nets {
+			if err := t.Append(newTable, b.blockChain(), dropSpec(n)...); err != nil {
+				return err
+			}
+		}
+	}
+
+	return b.insertJump(t, newTable, newChain)
+}
+
+// removeFrom deletes the jump from chain of table in every table of tables, along with the block chain unless table
+// is keepTable. Failures are only logged.
+func (b *IPTablesBackend) removeFrom(tables []RuleTable, keepTable, table, chain string) {
+	for _, t := range tables {
+		if err := t.DeleteIfExists(table, chain, b.jumpSpec()...); err != nil {
+			log.Printf("Failed to remove jump to %s from %s/%s: %v", b.blockChain(), table, chain, err)
+			continue
+		}
+		if table == keepTable {
+			continue
+		}
+		if err := t.ClearAndDeleteChain(table, b.blockChain()); err != nil {
+			log.Printf("Failed to remove chain %s from %s: %v", b.blockChain(), table, err)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package connections
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeTable is a RuleTable keeping the rules of each chain in memory, keyed by table/chain
+type fakeTable struct {
+	chains map[string][]string
+}
+
+func newFakeTable(chains map[string][]string) *fakeTable {
+	if chains == nil {
+		chains = map[string][]string{}
+	}
+	return &fakeTable{chains: chains}
+}
+
+func (f *fakeTable) chain(table, chain string) ([]string, error) {
+	rules, ok := f.chains[table+"/"+chain]
+	if !ok {
+		return nil, fmt.Errorf("chain %s/%s does not exist", table, chain)
+	}
+	return rules, nil
+}
+
+func (f *fakeTable) Exists(table, chain string, rulespec ...string) (bool, error) {
+	rules, err := f.chain(table, chain)
+	if err != nil {
+		return false, err
+	}
+	for _, r := range rules {
+		if r == strings.Join(rulespec, " ") {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (f *fakeTable) Insert(table, chain string, pos int, rulespec ...string) error {
+	rules, err := f.chain(table, chain)
+	if err != nil {
+		return err
+	}
+	rules = append(rules[:pos-1:pos-1], append([]string{strings.Join(rulespec, " ")}, rules[pos-1:]...)...)
+	f.chains[table+"/"+chain] = rules
+	return nil
+}
+
+func (f *fakeTable) Append(table, chain string, rulespec ...string) error {
+	rules, err := f.chain(table, chain)
+	if err != nil {
+		return err
+	}
+	f.chains[table+"/"+chain] = append(rules, strings.Join(rulespec, " "))
+	return nil
+}
+
+func (f *fakeTable) AppendUnique(table, chain string, rulespec ...string) error {
+	exists, err := f.Exists(table, chain, rulespec...)
+	if err != nil || exists {
+		return err
+	}
+	return f.Append(table, chain, rulespec...)
+}
+
+func (f *fakeTable) Delete(table, chain string, rulespec ...string) error {
+	exists, err := f.Exists(table, chain, rulespec...)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("rule does not exist in %s/%s", table, chain)
+	}
+	return f.DeleteIfExists(table, chain, rulespec...)
+}
+
+func (f *fakeTable) DeleteIfExists(table, chain string, rulespec ...string) error {
+	rules, err := f.chain(table, chain)
+	if err != nil {
+		return err
+	}
+	var kept []string
+	for _, r := range rules {
+		if r != strings.Join(rulespec, " ") {
+			kept = append(kept, r)
+		}
+	}
+	f.chains[table+"/"+chain] = kept
+	return nil
+}
+
+func (f *fakeTable) List(table, chain string) ([]string, error) {
+	rules, err := f.chain(table, chain)
+	if err != nil {
+		return nil, err
+	}
+	list := []string{"-N " + chain}
+	for _, r := range rules {
+		list = append(list, "-A "+chain+" "+r)
+	}
+	return list, nil
+}
+
+func (f *fakeTable) ChainExists(table, chain string) (bool, error) {
+	_, ok := f.chains[table+"/"+chain]
+	return ok, nil
+}
+
+func (f *fakeTable) NewChain(table, chain string) error {
+	if _, ok := f.chains[table+"/"+chain]; ok {
+		return fmt.Errorf("chain %s/%s already exists", table, chain)
+	}
+	f.chains[table+"/"+chain] = nil
+	return nil
+}
+
+func (f *fakeTable) ClearChain(table, chain string) error {
+	f.chains[table+"/"+chain] = nil
+	return nil
+}
+
+func (f *fakeTable) ClearAndDeleteChain(table, chain string) error {
+	delete(f.chains, table+"/"+chain)
+	return nil
+}
+
+func TestIPTablesBackend_tableFor(t *testing.T) {
+	tests := []struct {
+		name    string
+		backend *IPTablesBackend
+		ip      string
+		wantErr bool
+	}{
+		{name: "ipv4", backend: &IPTablesBackend{IP4Table: newFakeTable(nil)}, ip: "192.0.2.1"},
+		{name: "ipv4-mapped", backend: &IPTablesBackend{IP4Table: newFakeTable(nil)}, ip: "::ffff:192.0.2.1"},
+		{name: "ipv6", backend: &IPTablesBackend{IP6Table: newFakeTable(nil)}, ip: "2001:db8::1"},
+		{name: "no iptables", backend: &IPTablesBackend{IP6Table: newFakeTable(nil)}, ip: "192.0.2.1", wantErr: true},
+		{name: "no ip6tables", backend: &IPTablesBackend{IP4Table: newFakeTable(nil)}, ip: "2001:db8::1", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.backend.tableFor(hostNet(net.ParseIP(tt.ip)))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("tableFor() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrBackendUnavailable) {
+				t.Errorf("tableFor() error = %v, want ErrBackendUnavailable", err)
+			}
+		})
+	}
+}
+
+func TestIPTablesBackend_Relocate(t *testing.T) {
+	drop := "-s 192.168.1.1/32 -m comment --comment connectionWatcher -j DROP"
+	tests := []struct {
+		name  string
+		table string
+		chain string
+		want  map[string][]string
+	}{
+		{
+			name:  "other chain",
+			table: "filter",
+			chain: "FORWARD",
+			want: map[string][]string{
+				"filter/INPUT":       nil,
+				"filter/FORWARD":     {"-j CONNWATCHER"},
+				"filter/CONNWATCHER": {drop},
+				"raw/PREROUTING":     nil,
+			},
+		},
+		{
+			name:  "other table",
+			table: "raw",
+			chain: "PREROUTING",
+			want: map[string][]string{
+				"filter/INPUT":    nil,
+				"filter/FORWARD":  nil,
+				"raw/PREROUTING":  {"-j CONNWATCHER"},
+				"raw/CONNWATCHER": {drop},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			table := newFakeTable(map[string][]string{
+				"filter/INPUT":       {"-j CONNWATCHER"},
+				"filter/FORWARD":     nil,
+				"filter/CONNWATCHER": {drop},
+				"raw/PREROUTING":     nil,
+			})
+			backend := &IPTablesBackend{IP4Table: table}
+
+			if err := backend.Relocate(tt.table, tt.chain); err != nil {
+				t.Fatalf("Relocate() error = %v", err)
+			}
+			if !reflect.DeepEqual(table.chains, tt.want) {
+				t.Errorf("Relocate() chains = %v, want %v", table.chains, tt.want)
+			}
+			if backend.Table != tt.table || backend.Chain != tt.chain {
+				t.Errorf("Relocate() = %s/%s, want %s/%s", backend.Table, backend.Chain, tt.table, tt.chain)
+			}
+		})
+	}
+}
+
+func TestParseDropRule(t *testing.T) {
+	tests := []struct {
+		name   string
+		rule   string
+		want   string
+		wantOk bool
+	}{
+		{name: "ipv4 host", rule: "-A CONNWATCHER -s 10.192.1.21/32 -m comment --comment connectionWatcher -j DROP", want: "10.192.1.21/32", wantOk: true},
+		{name: "ipv6 host", rule: "-A CONNWATCHER -s 2001:db8::1/128 -m comment --comment connectionWatcher -j DROP", want: "2001:db8::1/128", wantOk: true},
+		{name: "policy", rule: "-P INPUT ACCEPT"},
+		{name: "other chain", rule: "-A INPUT -s 10.192.1.21/32 -m comment --comment connectionWatcher -j DROP"},
+		{name: "other target", rule: "-A CONNWATCHER -s 10.192.1.21/32 -m comment --comment connectionWatcher -j ACCEPT"},
+		{name: "untagged", rule: "-A CONNWATCHER -s 10.192.1.21/32 -j DROP"},
+		{name: "other comment", rule: "-A CONNWATCHER -s 10.192.1.21/32 -m comment --comment bastion -j DROP"},
+		{name: "more matches", rule: "-A CONNWATCHER -s 10.192.1.21/32 -p tcp -m comment --comment connectionWatcher -j DROP"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseDropRule(tt.rule, "CONNWATCHER")
+			if ok != tt.wantOk {
+				t.Fatalf("parseDropRule() ok = %v, want %v", ok, tt.wantOk)
+			}
+			if ok && got.String() != tt.want {
+				t.Errorf("parseDropRule() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package connections
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+const (
+	// sockDiagByFamily is the netlink message type for a sock_diag request, SOCK_DIAG_BY_FAMILY in linux/sock_diag.h
+	sockDiagByFamily = 20
+	// inetDiagReqLen is the length of struct inet_diag_req_v2
+	inetDiagReqLen = 56
+	// inetDiagMsgLen is the length of struct inet_diag_msg
+	inetDiagMsgLen = 72
+)
+
+// DefaultNetlinkStates are the states dumped by a NetlinkSource when none are provided. LISTEN is included so
+// direction can be detected from listening sockets.
+var DefaultNetlinkStates = []TCPState{
+	TCPEstablished,
+	TCPSynRecv,
+	TCPFinWait1,
+	TCPFinWait2,
+	TCPTimeWait,
+	TCPCloseWait,
+	TCPLastAck,
+	TCPListen,
+	TCPClosing,
+}
+
+// NetlinkSource dumps TCP sockets with NETLINK_INET_DIAG (sock_diag). Sockets are filtered by state in the kernel,
+// which is far cheaper than reading and parsing /proc/net/tcp on hosts with many sockets.
+type NetlinkSource struct {
+	States []TCPState
+}
+
+// NewNetlinkSource returns a pointer to a NetlinkSource dumping sockets in the provided states, DefaultNetlinkStates
+// is used if none are provided
+func NewNetlinkSource(states ...TCPState) *NetlinkSource {
+	if len(states) == 0 {
+		states = DefaultNetlinkStates
+	}
+	return &NetlinkSource{States: states}
+}
+
+// stateMask returns the idiag_states bitmask for the States of the NetlinkSource
+func (ns *NetlinkSource) stateMask() uint32 {
+	var mask uint32
+	for _, state := range ns.States {
+		mask |= 1 << uint(state)
+	}
+	return mask
+}
+
+// Connections dumps the IPv4 and IPv6 TCP sockets in the kernel
+func (ns *NetlinkSource) Connections() (map[string]Connection, error) {
+	conns := make(map[string]Connection)
+	for _, family := range []uint8{afInet, afInet6} {
+		if err := ns.dump(family, conns); err != nil {
+			return nil, err
+		}
+	}
+	return conns, nil
+}
+
+// newInetDiagReq returns a struct inet_diag_req_v2 requesting every TCP socket of family in the provided states
+func newInetDiagReq(family uint8, states uint32) []byte {
+	b := make([]byte, inetDiagReqLen)
+	b[0] = family
+	b[1] = ipProtoTCP
+	// netlink structs are in host byte order, see the README for supported platforms
+	binary.LittleEndian.PutUint32(b[4:8], states)
+	return b
+}
+
+// parseInetDiagMsg expects a struct inet_diag_msg and returns the Connection it describes
+func parseInetDiagMsg(b []byte) (Connection, error) {
+	if len(b) < inetDiagMsgLen {
+		return Connection{}, fmt.Errorf("inet_diag_msg too short: %d", len(b))
+	}
+
+	family := b[0]
+	state := TCPState(b[1])
+	if _, known := tcpStateNames[state]; !known {
+		return Connection{}, fmt.Errorf("unknown tcp state: %d", b[1])
+	}
+
+	// struct inet_diag_sockid starts at offset 4, ports and addresses are in network byte order
+	id := b[4:]
+	conn := Connection{
+		LocalPort:  binary.BigEndian.Uint16(id[0:2]),
+		RemotePort: binary.BigEndian.Uint16(id[2:4]),
+		State:      state,
+	}
+
+	switch family {
+	case afInet:
+		conn.LocalIP = net.IPv4(id[4], id[5], id[6], id[7])
+		conn.RemoteIP = net.IPv4(id[20], id[21], id[22], id[23])
+	case afInet6:
+		conn.LocalIP = make(net.IP, net.IPv6len)
+		copy(conn.LocalIP, id[4:20])
+		conn.RemoteIP = make(net.IP, net.IPv6len)
+		copy(conn.RemoteIP, id[20:36])
+	default:
+		return Connection{}, fmt.Errorf("unexpected address family: %d", family)
+	}
+
+	return conn, nil
+}
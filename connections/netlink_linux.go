@@ -0,0 +1,75 @@
+//go:build linux
+// +build linux
+
+package connections
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+const (
+	afInet     = syscall.AF_INET
+	afInet6    = syscall.AF_INET6
+	ipProtoTCP = syscall.IPPROTO_TCP
+)
+
+// dump sends a sock_diag dump request for family and adds every socket in the reply to conns
+func (ns *NetlinkSource) dump(family uint8, conns map[string]Connection) error {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, syscall.NETLINK_INET_DIAG)
+	if err != nil {
+		return fmt.Errorf("failed to open netlink socket: %v", err)
+	}
+	defer syscall.Close(fd)
+
+	sa := &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}
+	if err := syscall.Bind(fd, sa); err != nil {
+		return fmt.Errorf("failed to bind netlink socket: %v", err)
+	}
+
+	body := newInetDiagReq(family, ns.stateMask())
+	req := make([]byte, syscall.NLMSG_HDRLEN+len(body))
+	binary.LittleEndian.PutUint32(req[0:4], uint32(len(req)))
+	binary.LittleEndian.PutUint16(req[4:6], sockDiagByFamily)
+	binary.LittleEndian.PutUint16(req[6:8], syscall.NLM_F_REQUEST|syscall.NLM_F_DUMP)
+	binary.LittleEndian.PutUint32(req[8:12], 1)
+	copy(req[syscall.NLMSG_HDRLEN:], body)
+
+	if err := syscall.Sendto(fd, req, 0, sa); err != nil {
+		return fmt.Errorf("failed to send sock_diag request: %v", err)
+	}
+
+	buf := make([]byte, os.Getpagesize()*8)
+	for {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return fmt.Errorf("failed to receive sock_diag reply: %v", err)
+		}
+
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return fmt.Errorf("failed to parse sock_diag reply: %v", err)
+		}
+
+		for _, msg := range msgs {
+			switch msg.Header.Type {
+			case syscall.NLMSG_DONE:
+				return nil
+			case syscall.NLMSG_ERROR:
+				if len(msg.Data) < 4 {
+					return fmt.Errorf("sock_diag request failed")
+				}
+				errno := int32(binary.LittleEndian.Uint32(msg.Data[0:4]))
+				return fmt.Errorf("sock_diag request failed: %v", syscall.Errno(-errno))
+			case sockDiagByFamily:
+				conn, err := parseInetDiagMsg(msg.Data)
+				if err != nil {
+					return err
+				}
+				conns[conn.Key()] = conn
+			}
+		}
+	}
+}
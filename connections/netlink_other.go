@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package connections
+
+import "errors"
+
+const (
+	afInet     = 2
+	afInet6    = 10
+	ipProtoTCP = 6
+)
+
+func (ns *NetlinkSource) dump(family uint8, conns map[string]Connection) error {
+	return errors.New("netlink sock_diag is only supported on linux")
+}
@@ -0,0 +1,134 @@
+package connections
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"log"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func newTestInetDiagMsg(family uint8, state TCPState, src net.IP, sport uint16, dst net.IP, dport uint16) []byte {
+	b := make([]byte, inetDiagMsgLen)
+	b[0] = family
+	b[1] = uint8(state)
+	binary.BigEndian.PutUint16(b[4:6], sport)
+	binary.BigEndian.PutUint16(b[6:8], dport)
+	if family == afInet {
+		copy(b[8:12], src.To4())
+		copy(b[24:28], dst.To4())
+	} else {
+		copy(b[8:24], src.To16())
+		copy(b[24:40], dst.To16())
+	}
+	return b
+}
+
+func Test_parseInetDiagMsg(t *testing.T) {
+	type args struct {
+		b []byte
+	}
+	tests := []struct {
+		name    string
+		args    args
+		want    Connection
+		wantErr bool
+	}{
+		{
+			name: "ipv4 established",
+			args: args{
+				b: newTestInetDiagMsg(afInet, TCPEstablished, net.IPv4(10, 192, 1, 18), 6443, net.IPv4(10, 192, 1, 21), 55468),
+			},
+			want: Connection{
+				LocalIP:    net.ParseIP("10.192.1.18"),
+				LocalPort:  6443,
+				RemoteIP:   net.ParseIP("10.192.1.21"),
+				RemotePort: 55468,
+				State:      TCPEstablished,
+			},
+			wantErr: false,
+		},
+		{
+			name: "ipv6 syn_recv",
+			args: args{
+				b: newTestInetDiagMsg(afInet6, TCPSynRecv, net.ParseIP("2001:db8::1"), 22, net.ParseIP("2001:db8::2"), 40000),
+			},
+			want: Connection{
+				LocalIP:    net.ParseIP("2001:db8::1"),
+				LocalPort:  22,
+				RemoteIP:   net.ParseIP("2001:db8::2"),
+				RemotePort: 40000,
+				State:      TCPSynRecv,
+			},
+			wantErr: false,
+		},
+		{
+			name: "ipv4-mapped",
+			args: args{
+				b: newTestInetDiagMsg(afInet6, TCPEstablished, net.ParseIP("::ffff:10.192.1.18"), 6443, net.ParseIP("::ffff:10.192.1.24"), 60024),
+			},
+			want: Connection{
+				LocalIP:    net.ParseIP("10.192.1.18"),
+				LocalPort:  6443,
+				RemoteIP:   net.ParseIP("10.192.1.24"),
+				RemotePort: 60024,
+				State:      TCPEstablished,
+			},
+			wantErr: false,
+		},
+		{
+			name: "too short",
+			args: args{
+				b: make([]byte, 10),
+			},
+			want:    Connection{},
+			wantErr: true,
+		},
+		{
+			name: "unknown family",
+			args: args{
+				b: newTestInetDiagMsg(1, TCPEstablished, net.IPv4(10, 192, 1, 18), 6443, net.IPv4(10, 192, 1, 21), 55468),
+			},
+			want:    Connection{},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseInetDiagMsg(tt.args.b)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseInetDiagMsg() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseInetDiagMsg() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNetlinkSource_stateMask(t *testing.T) {
+	ns := NewNetlinkSource(TCPEstablished, TCPListen)
+	if got, want := ns.stateMask(), uint32(1<<1|1<<10); got != want {
+		t.Errorf("stateMask() = %b, want %b", got, want)
+	}
+}
+
+func benchmarkSourceConnections(source Source, b *testing.B) {
+	log.SetOutput(ioutil.Discard)
+	for n := 0; n < b.N; n++ {
+		if _, err := source.Connections(); err != nil {
+			b.Fatalf("Connections() error = %v", err)
+		}
+	}
+}
+
+// BenchmarkProcSource_Connections and BenchmarkNetlinkSource_Connections compare both sources against the sockets
+// of the host running the benchmark
+func BenchmarkProcSource_Connections(b *testing.B) {
+	benchmarkSourceConnections(NewProcSource("/proc/net/tcp", "/proc/net/tcp6"), b)
+}
+func BenchmarkNetlinkSource_Connections(b *testing.B) {
+	benchmarkSourceConnections(NewNetlinkSource(), b)
+}
@@ -0,0 +1,227 @@
+package connections
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// DefaultNFTablesTable is the name of the inet table owned by the nftables backend
+const DefaultNFTablesTable = "connectionwatcher"
+
+const (
+	nftSet4 = "blocked4"
+	nftSet6 = "blocked6"
+)
+
+// NFTablesBackend blocks hosts by adding them to the blocked4 and blocked6 sets of an inet table it owns. The table
+// has a single input chain dropping traffic from both sets, so the packet path cost doesn't grow with the number of
+// blocks, and set elements expire on their own after their ttl.
+type NFTablesBackend struct {
+	// Table is the name of the inet table, DefaultNFTablesTable if empty
+	Table string
+
+	// run executes nft with args and stdin, returning its stdout
+	run func(stdin string, args ...string) ([]byte, error)
+}
+
+// NewNFTablesBackend returns an NFTablesBackend using table, the table, sets and chain are created if missing. Blocks
+// already in the sets are kept.
+func NewNFTablesBackend(table string) (*NFTablesBackend, error) {
+	if _, err := exec.LookPath("nft"); err != nil {
+		return nil, fmt.Errorf("nftables is unavailable: %v", err)
+	}
+
+	b := &NFTablesBackend{Table: table, run: runNFT}
+	if _, err := b.run(b.setupScript(), "-f", "-"); err != nil {
+		return nil, fmt.Errorf("failed to create nftables table %s: %v", b.table(), err)
+	}
+
+	return b, nil
+}
+
+// runNFT executes the nft command
+func runNFT(stdin string, args ...string) ([]byte, error) {
+	cmd := exec.Command("nft", args...)
+	cmd.Stdin = strings.NewReader(stdin)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("nft %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+func (b *NFTablesBackend) table() string {
+	if b.Table == "" {
+		return DefaultNFTablesTable
+	}
+	return b.Table
+}
+
+// setupScript returns the nft script creating the table. Adding a table, set or chain that exists is a no-op, the
+// chain is flushed so restarting doesn't duplicate its rules.
+func (b *NFTablesBackend) setupScript() string {
+	t := "inet " + b.table()
+	return fmt.Sprintf(`add table %[1]s
+add set %[1]s %[2]s { type ipv4_addr; flags interval, timeout; }
+add set %[1]s %[3]s { type ipv6_addr; flags interval, timeout; }
+add chain %[1]s input { type filter hook input priority -1; policy accept; }
+flush chain %[1]s input
+add rule %[1]s input ip saddr @%[2]s drop
+add rule %[1]s input ip6 saddr @%[3]s drop
+`, t, nftSet4, nftSet6)
+}
+
+// setFor returns the set n is blocked in
+func setFor(n *net.IPNet) string {
+	if isIPv4(n) {
+		return nftSet4
+	}
+	return nftSet6
+}
+
+// element returns n as a set element, a single host is written as an address
+func element(n *net.IPNet) string {
+	if ones, bits := n.Mask.Size(); ones == bits {
+		return n.IP.String()
+	}
+	return n.String()
+}
+
+// Block adds n to its set, expiring after ttl unless it is zero
+func (b *NFTablesBackend) Block(n *net.IPNet, ttl time.Duration) error {
+	elem := element(n)
+	if ttl > 0 {
+		elem = fmt.Sprintf("%s timeout %ds", elem, int64(ttl/time.Second))
+	}
+
+	_, err := b.run("", "add", "element", "inet", b.table(), setFor(n), "{ "+elem+" }")
+	return err
+}
+
+// Unblock deletes n from its set
+func (b *NFTablesBackend) Unblock(n *net.IPNet) error {
+	_, err := b.run("", "delete", "element", "inet", b.table(), setFor(n), "{ "+element(n)+" }")
+	if err == nil {
+		return nil
+	}
+
+	// deleting an element that isn't in the set is an error, it may have expired already
+	if exists, existsErr := b.Exists(n); existsErr == nil && !exists {
+		return nil
+	}
+	return err
+}
+
+// Exists returns true if n is an element of its set
+func (b *NFTablesBackend) Exists(n *net.IPNet) (bool, error) {
+	nets, err := b.listSet(setFor(n))
+	if err != nil {
+		return false, err
+	}
+	return containsNet(nets, n), nil
+}
+
+// List returns the elements of both sets
+func (b *NFTablesBackend) List() ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, set := range []string{nftSet4, nftSet6} {
+		elems, err := b.listSet(set)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, elems...)
+	}
+	return nets, nil
+}
+
+func (b *NFTablesBackend) listSet(set string) ([]*net.IPNet, error) {
+	out, err := b.run("", "-j", "list", "set", "inet", b.table(), set)
+	if err != nil {
+		return nil, err
+	}
+	return parseNFTSet(out)
+}
+
+// CleanUp deletes the table along with its sets and chain
+func (b *NFTablesBackend) CleanUp() error {
+	_, err := b.run("", "delete", "table", "inet", b.table())
+	return err
+}
+
+// nftElem is an element of a set as listed by nft -j, either an address, a prefix or an element with a timeout
+// wrapping either
+type nftElem struct {
+	addr   string
+	Prefix *struct {
+		Addr string `json:"addr"`
+		Len  int    `json:"len"`
+	} `json:"prefix"`
+	Elem *struct {
+		Val nftElem `json:"val"`
+	} `json:"elem"`
+}
+
+func (e *nftElem) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '"' {
+		return json.Unmarshal(b, &e.addr)
+	}
+
+	type plain nftElem
+	return json.Unmarshal(b, (*plain)(e))
+}
+
+// network returns the network of the element, ranges and anything else nft may print aren't supported
+func (e nftElem) network() (*net.IPNet, error) {
+	switch {
+	case e.Elem != nil:
+		return e.Elem.Val.network()
+	case e.Prefix != nil:
+		_, n, err := net.ParseCIDR(fmt.Sprintf("%s/%d", e.Prefix.Addr, e.Prefix.Len))
+		return n, err
+	case e.addr != "":
+		ip := net.ParseIP(e.addr)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address %q", e.addr)
+		}
+		return hostNet(ip), nil
+	default:
+		return nil, fmt.Errorf("unsupported set element")
+	}
+}
+
+// parseNFTSet returns the elements of the set in the output of nft -j list set
+func parseNFTSet(out []byte) ([]*net.IPNet, error) {
+	var list struct {
+		NFTables []struct {
+			Set *struct {
+				Elem []nftElem `json:"elem"`
+			} `json:"set"`
+		} `json:"nftables"`
+	}
+	if err := json.Unmarshal(out, &list); err != nil {
+		return nil, fmt.Errorf("failed to parse nft output: %v", err)
+	}
+
+	var nets []*net.IPNet
+	for _, obj := range list.NFTables {
+		if obj.Set == nil {
+			continue
+		}
+		for _, elem := range obj.Set.Elem {
+			n, err := elem.network()
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse set element: %v", err)
+			}
+			nets = append(nets, n)
+		}
+	}
+	return nets, nil
+}
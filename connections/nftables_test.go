@@ -0,0 +1,118 @@
+package connections
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseNFTSet(t *testing.T) {
+	tests := []struct {
+		name    string
+		out     string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "empty set",
+			out:  `{"nftables": [{"metainfo": {"version": "1.0.2"}}, {"set": {"family": "inet", "name": "blocked4", "table": "connectionwatcher", "type": "ipv4_addr"}}]}`,
+			want: nil,
+		},
+		{
+			name: "addresses, prefixes and timeouts",
+			out: `{"nftables": [{"metainfo": {"version": "1.0.2"}}, {"set": {"family": "inet", "name": "blocked4", "table": "connectionwatcher", "type": "ipv4_addr", "flags": ["interval", "timeout"], "elem": [
+				"10.192.1.21",
+				{"prefix": {"addr": "192.0.2.0", "len": 24}},
+				{"elem": {"val": "198.51.100.7", "timeout": 3600, "expires": 3412}},
+				{"elem": {"val": {"prefix": {"addr": "203.0.113.0", "len": 25}}, "timeout": 60, "expires": 59}}
+			]}}]}`,
+			want: []string{"10.192.1.21/32", "192.0.2.0/24", "198.51.100.7/32", "203.0.113.0/25"},
+		},
+		{
+			name: "ipv6",
+			out:  `{"nftables": [{"set": {"name": "blocked6", "type": "ipv6_addr", "elem": ["2001:db8::1", {"prefix": {"addr": "2001:db8:1::", "len": 48}}]}}]}`,
+			want: []string{"2001:db8::1/128", "2001:db8:1::/48"},
+		},
+		{
+			name:    "range",
+			out:     `{"nftables": [{"set": {"name": "blocked4", "elem": [{"range": ["10.0.0.1", "10.0.0.5"]}]}}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "not json",
+			out:     `table inet connectionwatcher {`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nets, err := parseNFTSet([]byte(tt.out))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseNFTSet() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			var got []string
+			for _, n := range nets {
+				got = append(got, n.String())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseNFTSet() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNFTablesBackend(t *testing.T) {
+	var commands []string
+	elements := map[string]bool{}
+	b := &NFTablesBackend{
+		run: func(stdin string, args ...string) ([]byte, error) {
+			cmd := strings.Join(args, " ")
+			commands = append(commands, cmd)
+			switch {
+			case strings.HasPrefix(cmd, "delete element") && !elements[strings.Fields(args[5])[1]]:
+				return nil, errors.New("No such file or directory")
+			case strings.HasPrefix(cmd, "delete element"):
+				delete(elements, strings.Fields(args[5])[1])
+			case strings.HasPrefix(cmd, "-j list set") && args[5] == nftSet6:
+				return []byte(`{"nftables": [{"set": {"name": "blocked6", "elem": ["2001:db8::1"]}}]}`), nil
+			case strings.HasPrefix(cmd, "-j list set"):
+				return []byte(`{"nftables": [{"set": {"name": "blocked4"}}]}`), nil
+			case strings.HasPrefix(cmd, "add element"):
+				elements[strings.Fields(args[5])[1]] = true
+			}
+			return nil, nil
+		},
+	}
+
+	if err := b.Block(hostNet(net.ParseIP("10.192.1.21")), time.Hour); err != nil {
+		t.Fatalf("Block() error = %v", err)
+	}
+	if err := b.Block(hostNet(net.ParseIP("2001:db8::1")), 0); err != nil {
+		t.Fatalf("Block() error = %v", err)
+	}
+	if err := b.Unblock(hostNet(net.ParseIP("10.192.1.21"))); err != nil {
+		t.Errorf("Unblock() error = %v", err)
+	}
+	if err := b.Unblock(hostNet(net.ParseIP("192.0.2.1"))); err != nil {
+		t.Errorf("Unblock() of a host that isn't blocked error = %v", err)
+	}
+	if exists, err := b.Exists(hostNet(net.ParseIP("2001:db8::1"))); err != nil || !exists {
+		t.Errorf("Exists() = %v, %v, want true", exists, err)
+	}
+
+	want := []string{
+		"add element inet connectionwatcher blocked4 { 10.192.1.21 timeout 3600s }",
+		"add element inet connectionwatcher blocked6 { 2001:db8::1 }",
+		"delete element inet connectionwatcher blocked4 { 10.192.1.21 }",
+		"delete element inet connectionwatcher blocked4 { 192.0.2.1 }",
+		"-j list set inet connectionwatcher blocked4",
+		"-j list set inet connectionwatcher blocked6",
+	}
+	if !reflect.DeepEqual(commands, want) {
+		t.Errorf("nft commands = %q, want %q", commands, want)
+	}
+}
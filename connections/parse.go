@@ -9,11 +9,19 @@ import (
 	"strings"
 )
 
-// parseEndpoint splits the endpoint hex string delimited by ':' into IP and port
+const (
+	// ipv4EndpointLen is the length of an endpoint in /proc/net/tcp, 8 hex digits for the IP and 4 for the port
+	ipv4EndpointLen = 13
+	// ipv6EndpointLen is the length of an endpoint in /proc/net/tcp6, 32 hex digits for the IP and 4 for the port
+	ipv6EndpointLen = 37
+)
+
+// parseEndpoint splits the endpoint hex string delimited by ':' into IP and port. Both the IPv4 endpoints found in
+// /proc/net/tcp and the IPv6 endpoints found in /proc/net/tcp6 are accepted.
 // returns the IP, port, and errors
 func parseEndpoint(ep string) (net.IP, uint16, error) {
-	if len(ep) != 13 {
-		err := fmt.Errorf("length of string does not equal 13: %d", len(ep))
+	if len(ep) != ipv4EndpointLen && len(ep) != ipv6EndpointLen {
+		err := fmt.Errorf("length of string does not equal %d or %d: %d", ipv4EndpointLen, ipv6EndpointLen, len(ep))
 		return nil, 0, err
 	}
 
@@ -23,7 +31,13 @@ func parseEndpoint(ep string) (net.IP, uint16, error) {
 		return nil, 0, err
 	}
 
-	ip, err := parseIPv4(split[0])
+	var ip net.IP
+	var err error
+	if len(ep) == ipv4EndpointLen {
+		ip, err = parseIPv4(split[0])
+	} else {
+		ip, err = parseIPv6(split[0])
+	}
 	if err != nil {
 		return nil, 0, err
 	}
@@ -42,6 +56,9 @@ func parseIPv4(s string) (net.IP, error) {
 	if err != nil {
 		return nil, err
 	}
+	if len(ipBytes) != net.IPv4len {
+		return nil, fmt.Errorf("expected %d bytes for ipv4 address, got %d", net.IPv4len, len(ipBytes))
+	}
 
 	ip := net.IPv4(ipBytes[3], ipBytes[2], ipBytes[1], ipBytes[0])
 	if ip == nil {
@@ -51,11 +68,35 @@ func parseIPv4(s string) (net.IP, error) {
 	return ip, nil
 }
 
+// parseIPv6 expects an IP as four 32 bit words in hex, each little endian, and returns an IP struct.
+// IPv4-mapped addresses (::ffff:a.b.c.d) are returned in the same form as parseIPv4 so they compare equal.
+func parseIPv6(s string) (net.IP, error) {
+	ipBytes, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(ipBytes) != net.IPv6len {
+		return nil, fmt.Errorf("expected %d bytes for ipv6 address, got %d", net.IPv6len, len(ipBytes))
+	}
+
+	ip := make(net.IP, net.IPv6len)
+	for word := 0; word < net.IPv6len; word += 4 {
+		for i := 0; i < 4; i++ {
+			ip[word+i] = ipBytes[word+3-i]
+		}
+	}
+
+	return ip, nil
+}
+
 // parsePort expects a port in hex and returns the uint16
 func parsePort(s string) (uint16, error) {
 	portBytes, err := hex.DecodeString(s)
 	if err != nil {
 		return 0, err
 	}
+	if len(portBytes) != 2 {
+		return 0, fmt.Errorf("expected 2 bytes for port, got %d", len(portBytes))
+	}
 	return binary.BigEndian.Uint16(portBytes), nil
 }
@@ -44,6 +44,33 @@ func Test_ParseEndpoint(t *testing.T) {
 			want1:   55468,
 			wantErr: false,
 		},
+		{
+			name: "2001:db8::1",
+			args: args{
+				ep: "B80D0120000000000000000001000000:0016",
+			},
+			want:    net.ParseIP("2001:db8::1"),
+			want1:   22,
+			wantErr: false,
+		},
+		{
+			name: "ipv4-mapped 10.192.1.18",
+			args: args{
+				ep: "0000000000000000FFFF00001201C00A:192B",
+			},
+			want:    net.IPv4(10, 192, 1, 18),
+			want1:   6443,
+			wantErr: false,
+		},
+		{
+			name: "invalid ipv6 hex",
+			args: args{
+				ep: "X80D0120000000000000000001000000:0016",
+			},
+			want:    nil,
+			want1:   0,
+			wantErr: true,
+		},
 		{
 			name: "invalid hex",
 			args: args{
@@ -62,6 +89,24 @@ func Test_ParseEndpoint(t *testing.T) {
 			want1:   0,
 			wantErr: true,
 		},
+		{
+			name: "misplaced :",
+			args: args{
+				ep: "1201C0:0A192B",
+			},
+			want:    nil,
+			want1:   0,
+			wantErr: true,
+		},
+		{
+			name: "missing port",
+			args: args{
+				ep: "1201C00A192B:",
+			},
+			want:    nil,
+			want1:   0,
+			wantErr: true,
+		},
 		{
 			name: "too many :",
 			args: args{
@@ -0,0 +1,163 @@
+package connections
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultPortThreshold is the number of distinct local ports a remote host connects to before it is blocked
+const DefaultPortThreshold = 3
+
+// PortScanDetector blocks remote hosts connecting to the port threshold or more distinct ports of a local IP within a
+// sliding window, a vertical port scan
+type PortScanDetector struct {
+	// Windows are the ports each remote host connected to on each local IP within the window
+	Windows map[WindowKey]*PortWindow
+	// PortThreshold is the number of distinct ports that gets a host blocked, DefaultPortThreshold if zero
+	PortThreshold int
+	// Window is the sliding window ports are counted in, DefaultWindow if zero
+	Window time.Duration
+	// Thresholds override the PortThreshold and Window for connections they match, the first match applies
+	Thresholds []Threshold
+
+	// mu guards every field, ports may be added from a packet capture while the main loop checks for hosts to block
+	mu sync.Mutex
+}
+
+// Name returns DetectorPortScan
+func (d *PortScanDetector) Name() string {
+	return DetectorPortScan
+}
+
+// Configure applies the port threshold, window and thresholds of c
+func (d *PortScanDetector) Configure(c DetectorConfig) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.PortThreshold = c.PortThreshold
+	d.Window = c.Window
+	d.Thresholds = c.Thresholds
+}
+
+// threshold returns the port threshold and window of the Threshold named name, the detector's own for an empty or
+// unknown name. Unset values are inherited from the detector, then the defaults.
+func (d *PortScanDetector) threshold(name string) (int, time.Duration) {
+	portThreshold, window := d.PortThreshold, d.Window
+	if portThreshold == 0 {
+		portThreshold = DefaultPortThreshold
+	}
+	if window == 0 {
+		window = DefaultWindow
+	}
+
+	for _, th := range d.Thresholds {
+		if name == "" || th.Name != name {
+			continue
+		}
+		if th.PortThreshold != 0 {
+			portThreshold = th.PortThreshold
+		}
+		if th.Window != 0 {
+			window = th.Window
+		}
+		break
+	}
+	return portThreshold, window
+}
+
+// thresholdFor returns the name of the first Threshold matching a connection to port of localIP, empty if none does
+func (d *PortScanDetector) thresholdFor(localIP string, port uint16) string {
+	if len(d.Thresholds) == 0 {
+		return ""
+	}
+
+	ip := net.ParseIP(localIP)
+	for _, th := range d.Thresholds {
+		if th.matches(ip, port) {
+			return th.Name
+		}
+	}
+	return ""
+}
+
+// Observe adds the port of o to the window of its remote host connecting to its local IP
+func (d *PortScanDetector) Observe(o Observation) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.Windows == nil {
+		d.Windows = make(map[WindowKey]*PortWindow)
+	}
+
+	key := WindowKey{
+		HostPair:  HostPair{LocalIP: o.LocalIP, RemoteIP: o.RemoteIP},
+		Threshold: d.thresholdFor(o.LocalIP, o.LocalPort),
+	}
+	if _, present := d.Windows[key]; !present {
+		d.Windows[key] = &PortWindow{}
+	}
+
+	d.Windows[key].Add(o.LocalPort, o.Time)
+}
+
+// Verdicts slides every window to unix time now and returns the remote hosts over their port threshold
+func (d *PortScanDetector) Verdicts(now int64) []Verdict {
+	d.RemoveOldConnections(now)
+
+	var verdicts []Verdict
+	for _, host := range d.HostsToBlock() {
+		verdicts = append(verdicts, Verdict{
+			Host:     host,
+			Reason:   ReasonPortScan,
+			Severity: SeverityMedium,
+			Evidence: fmt.Sprintf("connected to %d ports of %s: %s", len(host.Ports), host.LocalIP, portsToString(host.Ports)),
+		})
+	}
+	return verdicts
+}
+
+// RemoveOldConnections slides every window to the unix time now, removing the ports last seen a window or longer
+// before now. Returns the removed ports.
+func (d *PortScanDetector) RemoveOldConnections(now int64) []uint16 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var removedPorts []uint16
+
+	for key, w := range d.Windows {
+		_, window := d.threshold(key.Threshold)
+		removedPorts = append(removedPorts, w.Slide(now, window)...)
+		if len(w.Seen) == 0 {
+			delete(d.Windows, key)
+		}
+	}
+
+	return removedPorts
+}
+
+// HostsToBlock checks for any remote hosts that connected to the port threshold or more distinct ports of a local IP
+// within the window, returns a slice of RemoteHost.
+func (d *PortScanDetector) HostsToBlock() []RemoteHost {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var hosts []RemoteHost
+
+	for key, w := range d.Windows {
+		portThreshold, _ := d.threshold(key.Threshold)
+		if len(w.Seen) < portThreshold {
+			continue
+		}
+
+		hosts = append(hosts, RemoteHost{
+			RemoteIP: net.ParseIP(key.RemoteIP),
+			LocalIP:  net.ParseIP(key.LocalIP),
+			Ports:    w.Ports(),
+		})
+		delete(d.Windows, key)
+	}
+
+	return hosts
+}
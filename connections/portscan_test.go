@@ -0,0 +1,160 @@
+package connections
+
+import (
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestPortScanDetector_HostsToBlock(t *testing.T) {
+	web := Threshold{
+		Name:          "web",
+		LocalNets:     []*net.IPNet{{IP: net.IP{10, 0, 0, 0}, Mask: net.CIDRMask(24, 32)}},
+		Ports:         []uint16{80, 443, 8443},
+		PortThreshold: 4,
+	}
+
+	type add struct {
+		local  string
+		remote string
+		port   uint16
+	}
+	tests := []struct {
+		name       string
+		thresholds []Threshold
+		adds       []add
+		want       []RemoteHost
+	}{
+		{
+			name: "block 192.168.1.1",
+			adds: []add{{"10.0.0.1", "192.168.1.1", 80}, {"10.0.0.1", "192.168.1.1", 81}, {"10.0.0.1", "192.168.1.1", 82}},
+			want: []RemoteHost{{RemoteIP: net.ParseIP("192.168.1.1"), LocalIP: net.ParseIP("10.0.0.1"), Ports: []uint16{80, 81, 82}}},
+		},
+		{
+			name: "same port counted once",
+			adds: []add{{"10.0.0.1", "192.168.1.1", 80}, {"10.0.0.1", "192.168.1.1", 80}, {"10.0.0.1", "192.168.1.1", 81}},
+		},
+		{
+			name: "counted per local ip",
+			adds: []add{{"10.0.0.1", "192.168.1.1", 80}, {"10.0.0.2", "192.168.1.1", 81}, {"10.0.0.3", "192.168.1.1", 82}},
+		},
+		{
+			name:       "web clients under the web threshold",
+			thresholds: []Threshold{web},
+			adds:       []add{{"10.0.0.1", "192.168.1.1", 80}, {"10.0.0.1", "192.168.1.1", 443}, {"10.0.0.1", "192.168.1.1", 8443}},
+		},
+		{
+			name:       "web threshold only applies to its local ips",
+			thresholds: []Threshold{web},
+			adds:       []add{{"10.0.1.1", "192.168.1.1", 80}, {"10.0.1.1", "192.168.1.1", 443}, {"10.0.1.1", "192.168.1.1", 8443}},
+			want:       []RemoteHost{{RemoteIP: net.ParseIP("192.168.1.1"), LocalIP: net.ParseIP("10.0.1.1"), Ports: []uint16{80, 443, 8443}}},
+		},
+		{
+			name:       "other ports counted apart from the web ports",
+			thresholds: []Threshold{web},
+			adds: []add{
+				{"10.0.0.1", "192.168.1.1", 80}, {"10.0.0.1", "192.168.1.1", 443},
+				{"10.0.0.1", "192.168.1.1", 22}, {"10.0.0.1", "192.168.1.1", 23}, {"10.0.0.1", "192.168.1.1", 25},
+			},
+			want: []RemoteHost{{RemoteIP: net.ParseIP("192.168.1.1"), LocalIP: net.ParseIP("10.0.0.1"), Ports: []uint16{22, 23, 25}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &PortScanDetector{PortThreshold: 3, Thresholds: tt.thresholds}
+			for i, a := range tt.adds {
+				d.Observe(Observation{LocalIP: a.local, RemoteIP: a.remote, LocalPort: a.port, New: true, Time: int64(i)})
+			}
+
+			got := d.HostsToBlock()
+			sort.Slice(got, func(i, j int) bool { return got[i].RemoteIP.String() < got[j].RemoteIP.String() })
+			for _, host := range got {
+				sort.Slice(host.Ports, func(i, j int) bool { return host.Ports[i] < host.Ports[j] })
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("HostsToBlock() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPortScanDetector_RemoveOldConnections(t *testing.T) {
+	key := WindowKey{HostPair: HostPair{RemoteIP: "192.168.1.1"}}
+	slow := WindowKey{HostPair: HostPair{RemoteIP: "192.168.1.2"}, Threshold: "slow"}
+
+	type args struct {
+		now int64
+	}
+	tests := []struct {
+		name string
+		args args
+		want []uint16
+	}{
+		{name: "remove all", args: args{now: 90}, want: []uint16{80, 81, 82}},
+		{name: "remove 80", args: args{now: 70}, want: []uint16{80}},
+		{name: "remove none", args: args{now: 60}, want: nil},
+		{name: "remove with threshold window", args: args{now: 100}, want: []uint16{80, 81, 82, 22}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &PortScanDetector{
+				Window:     30 * time.Second,
+				Thresholds: []Threshold{{Name: "slow", Window: time.Minute}},
+				Windows: map[WindowKey]*PortWindow{
+					key:  {Seen: []PortSeen{{Port: 80, Time: 40}, {Port: 81, Time: 50}, {Port: 82, Time: 60}}},
+					slow: {Seen: []PortSeen{{Port: 22, Time: 40}}},
+				},
+			}
+
+			if got := d.RemoveOldConnections(tt.args.now); !containsSamePorts(got, tt.want) {
+				t.Errorf("RemoveOldConnections() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func containsSamePorts(a, b []uint16) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	present := func(item uint16, slice []uint16) bool {
+		for _, s := range slice {
+			if s == item {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, i := range b {
+		if !present(i, a) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestPortScanDetector_Verdicts(t *testing.T) {
+	d := &PortScanDetector{}
+	for i, port := range []uint16{22, 80, 443} {
+		d.Observe(Observation{LocalIP: "10.0.0.1", RemoteIP: "192.168.1.1", LocalPort: port, Time: int64(i)})
+	}
+
+	got := d.Verdicts(10)
+	if len(got) != 1 {
+		t.Fatalf("Verdicts() = %v, want 192.168.1.1", got)
+	}
+	if got[0].Reason != ReasonPortScan || got[0].Severity != SeverityMedium {
+		t.Errorf("Verdicts() = %s (%s), want %s (%s)", got[0].Reason, got[0].Severity, ReasonPortScan, SeverityMedium)
+	}
+	if want := "connected to 3 ports of 10.0.0.1: 22,80,443"; got[0].Evidence != want {
+		t.Errorf("Verdicts() evidence = %q, want %q", got[0].Evidence, want)
+	}
+
+	if got := d.Verdicts(11); len(got) != 0 {
+		t.Errorf("Verdicts() = %v, want ports forgotten after the verdict", got)
+	}
+}
@@ -0,0 +1,130 @@
+package connections
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultRateLimit is the number of new connections a remote host opens to a local port within the window before it is
+// blocked
+const DefaultRateLimit = 100
+
+// RateKey identifies the new connections of a remote host to a local port, a local service
+type RateKey struct {
+	RemoteIP  string
+	LocalPort uint16
+}
+
+// RateDetector blocks remote hosts opening more new connections to a local port than its limit within the window, a
+// connection flood or a brute-force attack on a service such as ssh or smtp. Connections are counted per port, so a
+// client opening many connections to a single port is caught even though it never reaches the port threshold.
+type RateDetector struct {
+	// Opened are the unix times of the new connections of each remote host to each local port within the window,
+	// oldest first
+	Opened map[RateKey][]int64
+	// Limit is the number of new connections to a port allowed within the Window, DefaultRateLimit if zero
+	Limit int
+	// PortLimits override the Limit for some local ports
+	PortLimits map[uint16]int
+	// Window is the sliding window new connections are counted in, DefaultWindow if zero
+	Window time.Duration
+	// Capture counts the captured connection attempts alone, otherwise only the new connections of the source count
+	Capture bool
+
+	// mu guards every field
+	mu sync.Mutex
+}
+
+// Name returns DetectorRate
+func (d *RateDetector) Name() string {
+	return DetectorRate
+}
+
+// Configure applies the rate limits of c and counts new connections in its rate window, the window of c if it has no
+// rate window, from the capture if c has one
+func (d *RateDetector) Configure(c DetectorConfig) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.Limit = c.RateLimit
+	d.PortLimits = c.PortRateLimits
+	d.Window = c.RateWindow
+	if d.Window == 0 {
+		d.Window = c.Window
+	}
+	d.Capture = c.Capture
+}
+
+// limit returns the number of new connections allowed to port
+func (d *RateDetector) limit(port uint16) int {
+	if limit, ok := d.PortLimits[port]; ok && limit > 0 {
+		return limit
+	}
+	if d.Limit > 0 {
+		return d.Limit
+	}
+	return DefaultRateLimit
+}
+
+// Observe counts o if it is a new connection of the counted source, so a connection is counted once
+func (d *RateDetector) Observe(o Observation) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if !o.New || o.Captured != d.Capture {
+		return
+	}
+
+	if d.Opened == nil {
+		d.Opened = make(map[RateKey][]int64)
+	}
+
+	// observations mostly arrive in order, an older one is moved back to its place
+	key := RateKey{RemoteIP: o.RemoteIP, LocalPort: o.LocalPort}
+	opened := append(d.Opened[key], o.Time)
+	for i := len(opened) - 1; i > 0 && opened[i-1] > opened[i]; i-- {
+		opened[i-1], opened[i] = opened[i], opened[i-1]
+	}
+	d.Opened[key] = opened
+}
+
+// Verdicts forgets the connections opened a window or longer before unix time now and returns the remote hosts that
+// opened more than the limit of a port
+func (d *RateDetector) Verdicts(now int64) []Verdict {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	window := d.Window
+	if window == 0 {
+		window = DefaultWindow
+	}
+
+	var verdicts []Verdict
+	for key, opened := range d.Opened {
+		i := 0
+		for i < len(opened) && now-opened[i] >= int64(window/time.Second) {
+			i++
+		}
+		opened = opened[i:]
+		d.Opened[key] = opened
+
+		limit := d.limit(key.LocalPort)
+		if len(opened) <= limit {
+			if len(opened) == 0 {
+				delete(d.Opened, key)
+			}
+			continue
+		}
+
+		verdicts = append(verdicts, Verdict{
+			Host:     RemoteHost{RemoteIP: net.ParseIP(key.RemoteIP), Ports: []uint16{key.LocalPort}},
+			Reason:   DetectorRate,
+			Severity: SeverityMedium,
+			Evidence: fmt.Sprintf("opened %d new connections to port %d within %v, limit %d", len(opened), key.LocalPort, window, limit),
+		})
+		delete(d.Opened, key)
+	}
+	return verdicts
+}
@@ -0,0 +1,96 @@
+package connections
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRateDetector_Verdicts(t *testing.T) {
+	tests := []struct {
+		name   string
+		opened int
+		new    bool
+		want   bool
+	}{
+		{name: "at the limit", opened: 5, new: true, want: false},
+		{name: "over the limit", opened: 6, new: true, want: true},
+		{name: "connections seen again not counted", opened: 6, new: false, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &RateDetector{Limit: 5, Window: 10 * time.Second}
+			for i := 0; i < tt.opened; i++ {
+				d.Observe(Observation{LocalIP: "10.0.0.1", RemoteIP: "192.168.1.1", LocalPort: 80, New: tt.new, Time: int64(i)})
+			}
+
+			got := d.Verdicts(int64(tt.opened))
+			if (len(got) == 1) != tt.want {
+				t.Errorf("Verdicts() = %v, want blocked %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateDetector_capture(t *testing.T) {
+	tests := []struct {
+		name    string
+		capture bool
+	}{
+		{name: "counted from the source", capture: false},
+		{name: "counted from the capture", capture: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &RateDetector{Limit: 3, Window: 10 * time.Second, Capture: tt.capture}
+			// every connection is captured, then observed by the source, and is only counted once
+			for i := int64(0); i < 3; i++ {
+				d.Observe(Observation{RemoteIP: "192.168.1.1", LocalPort: 443, New: true, Captured: true, Time: i})
+				d.Observe(Observation{RemoteIP: "192.168.1.1", LocalPort: 443, New: true, Time: i})
+			}
+
+			if got := d.Verdicts(3); len(got) != 0 {
+				t.Errorf("Verdicts() = %v, want every connection counted once", got)
+			}
+		})
+	}
+}
+
+func TestRateDetector_window(t *testing.T) {
+	d := &RateDetector{Limit: 2, Window: 10 * time.Second}
+	for _, ts := range []int64{0, 5, 10, 12} {
+		d.Observe(Observation{RemoteIP: "192.168.1.1", LocalPort: 22, New: true, Time: ts})
+	}
+
+	// the connection opened at 0 left the window
+	if got := d.Verdicts(12); len(got) != 1 {
+		t.Fatalf("Verdicts() = %v, want 192.168.1.1", got)
+	}
+	if got := d.Verdicts(13); len(got) != 0 {
+		t.Errorf("Verdicts() = %v, want connections forgotten after the verdict", got)
+	}
+}
+
+func TestRateDetector_portLimits(t *testing.T) {
+	d := &RateDetector{Limit: 10, PortLimits: map[uint16]int{22: 3}}
+	for i := 0; i < 4; i++ {
+		for _, port := range []uint16{22, 80} {
+			d.Observe(Observation{LocalIP: "10.0.0.1", RemoteIP: "192.168.1.1", LocalPort: port, New: true, Time: int64(i)})
+		}
+	}
+	// connections to different ports are counted apart
+	for _, port := range []uint16{8080, 8081, 8082, 8083} {
+		d.Observe(Observation{LocalIP: "10.0.0.1", RemoteIP: "192.168.1.2", LocalPort: port, New: true, Time: 0})
+	}
+
+	got := d.Verdicts(5)
+	if len(got) != 1 {
+		t.Fatalf("Verdicts() = %v, want 192.168.1.1 on port 22", got)
+	}
+	if got[0].Host.RemoteIP.String() != "192.168.1.1" || !reflect.DeepEqual(got[0].Host.Ports, []uint16{22}) {
+		t.Errorf("Verdicts() = %v, want 192.168.1.1 on port 22", got[0])
+	}
+	if want := "opened 4 new connections to port 22 within 1m0s, limit 3"; got[0].Evidence != want {
+		t.Errorf("Verdicts() evidence = %q, want %q", got[0].Evidence, want)
+	}
+}
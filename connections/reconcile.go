@@ -0,0 +1,130 @@
+package connections
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/rcanderson23/connectionWatcher/metrics"
+)
+
+const (
+	// DefaultReconcileInterval is how often the blocks of the Backend are reconciled with the BlockedHosts
+	DefaultReconcileInterval = 5 * time.Minute
+
+	// ReasonAdopted is the reason of hosts found blocked in the Backend on startup, blocked by a previous run
+	ReasonAdopted = "adopted"
+)
+
+// Adopt records the hosts blocked in the Backend that aren't BlockedHosts as blocked for ReasonAdopted at unix time
+// now, so blocks kept by a previous run, such as an adopted stale chain or blocks kept on exit, aren't removed as
+// orphans. Adopted blocks expire after the BlockTTL. Networks other than single hosts are left to Reconcile, they can
+// only have been blocked for a denylist. Allowlisted hosts are unblocked. Returns the number of hosts adopted.
+func (ipb *IPBlocker) Adopt(now int64) (int, error) {
+	if ipb.Backend == nil {
+		return 0, nil
+	}
+
+	listed, err := ipb.Backend.List()
+	if err != nil {
+		return 0, fmt.Errorf("failed to list blocks: %v", err)
+	}
+
+	var adopted int
+	for _, n := range listed {
+		if ones, bits := n.Mask.Size(); ones != bits || ipb.isBlocked(n.IP) || indexDenylisted(ipb.Denylisted, n) >= 0 {
+			continue
+		}
+
+		// the allowlist may have changed since the previous run, its hosts are unblocked instead
+		if ipb.Allowlist.Contains(n.IP) {
+			if err := ipb.Backend.Unblock(n); err != nil {
+				log.Printf("Failed to remove block of allowlisted host %s: %v", n.IP, err)
+				continue
+			}
+			log.Printf("Removed block of allowlisted host %s", n.IP)
+			continue
+		}
+
+		host := BlockedHost{IP: n.IP, Reason: ReasonAdopted, BlockedAt: now}
+		if ttl := ipb.blockTTL(0); ttl > 0 {
+			host.Expires = now + int64(ttl/time.Second)
+		}
+		ipb.BlockedHosts = append(ipb.BlockedHosts, host)
+		metrics.BlockedHosts.WithLabelValues(ReasonAdopted).Inc()
+		adopted++
+	}
+
+	if adopted > 0 {
+		log.Printf("Adopted %d blocked hosts of a previous run", adopted)
+		ipb.saveState()
+	}
+	return adopted, nil
+}
+
+// Reconcile makes the blocks of the Backend match the BlockedHosts and Denylisted networks at unix time now. Blocks
+// listed by the Backend for hosts that aren't blocked, such as rules left behind by a crash, are orphans and are
+// removed. Blocked hosts missing from the Backend, such as a rule deleted by hand, are blocked again for the rest of
+// their ttl, unless it is over and the block is only waiting for ExpireBlocks to remove it. Returns the number of
+// orphans and missing blocks found.
+func (ipb *IPBlocker) Reconcile(now int64) (int, int, error) {
+	if ipb.Backend == nil {
+		return 0, 0, nil
+	}
+
+	listed, err := ipb.Backend.List()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to list blocks: %v", err)
+	}
+
+	var expected []*net.IPNet
+	for _, host := range ipb.BlockedHosts {
+		expected = append(expected, hostNet(host.IP))
+	}
+	for _, d := range ipb.Denylisted {
+		expected = append(expected, d.Net)
+	}
+
+	var orphans int
+	for _, n := range listed {
+		if containsNet(expected, n) {
+			continue
+		}
+
+		log.Printf("Removing orphaned block for %s", n)
+		orphans++
+		if err := ipb.Backend.Unblock(n); err != nil {
+			log.Printf("Failed to remove orphaned block for %s: %v", n, err)
+		}
+	}
+
+	var missing int
+	for _, host := range ipb.BlockedHosts {
+		if containsNet(listed, hostNet(host.IP)) || (host.Expires != 0 && host.Expires <= now) {
+			continue
+		}
+
+		log.Printf("Restoring missing block for %s", host.IP)
+		missing++
+		if err := ipb.restoreRule(host, now); err != nil {
+			log.Printf("Failed to restore missing block for %s: %v", host.IP, err)
+		}
+	}
+
+	for _, d := range ipb.Denylisted {
+		if containsNet(listed, d.Net) {
+			continue
+		}
+
+		log.Printf("Restoring missing block for denylisted network %s", d.Net)
+		missing++
+		if err := ipb.Backend.Block(d.Net, 0); err != nil {
+			log.Printf("Failed to restore missing block for %s: %v", d.Net, err)
+		}
+	}
+
+	metrics.ReconcileDrift.WithLabelValues("orphan").Add(float64(orphans))
+	metrics.ReconcileDrift.WithLabelValues("missing").Add(float64(missing))
+	return orphans, missing, nil
+}
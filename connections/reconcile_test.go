@@ -0,0 +1,114 @@
+package connections
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestIPBlocker_Reconcile(t *testing.T) {
+	// 10.192.1.22 was blocked by a previous run, 10.192.1.21 and 198.51.100.0/24 were removed by hand, 10.192.1.23
+	// expired and was removed by the firewall but failed to be removed by ExpireBlocks
+	backend := newFakeBackend("10.192.1.22/32", "2001:db8::1/128", "203.0.113.0/24")
+	ipb := &IPBlocker{
+		Backend: backend,
+		BlockedHosts: []BlockedHost{
+			{IP: net.ParseIP("10.192.1.21"), Reason: ReasonPortScan, BlockedAt: 100, Expires: 3700},
+			{IP: net.ParseIP("2001:db8::1"), Reason: ReasonPortScan, BlockedAt: 100},
+			{IP: net.ParseIP("10.192.1.23"), Reason: ReasonPortScan, BlockedAt: 100, Expires: 700},
+		},
+		Denylisted: []DenylistedNet{
+			{Net: &net.IPNet{IP: net.IP{198, 51, 100, 0}, Mask: net.CIDRMask(24, 32)}},
+			{Net: &net.IPNet{IP: net.IP{203, 0, 113, 0}, Mask: net.CIDRMask(24, 32)}},
+		},
+	}
+
+	orphans, missing, err := ipb.Reconcile(700)
+	if err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	if orphans != 1 || missing != 2 {
+		t.Errorf("Reconcile() = %d orphans, %d missing, want 1 and 2", orphans, missing)
+	}
+
+	want := map[string]time.Duration{
+		"10.192.1.21/32":  3000 * time.Second,
+		"2001:db8::1/128": 0,
+		"198.51.100.0/24": 0,
+		"203.0.113.0/24":  0,
+	}
+	if !reflect.DeepEqual(backend.blocked, want) {
+		t.Errorf("Reconcile() backend = %v, want %v", backend.blocked, want)
+	}
+
+	if orphans, missing, _ := ipb.Reconcile(700); orphans != 0 || missing != 0 {
+		t.Errorf("Reconcile() again = %d orphans, %d missing, want no drift", orphans, missing)
+	}
+}
+
+func TestIPBlocker_Adopt(t *testing.T) {
+	// 10.192.1.22 and 198.51.100.0/24 were kept by a previous run without a state file
+	backend := newFakeBackend("10.192.1.21/32", "10.192.1.22/32", "198.51.100.0/24", "203.0.113.0/24")
+	ipb := &IPBlocker{
+		Backend:  backend,
+		BlockTTL: time.Hour,
+		BlockedHosts: []BlockedHost{
+			{IP: net.ParseIP("10.192.1.21"), Reason: ReasonPortScan, BlockedAt: 100, Expires: 3700},
+		},
+		Denylisted: []DenylistedNet{
+			{Net: &net.IPNet{IP: net.IP{203, 0, 113, 0}, Mask: net.CIDRMask(24, 32)}},
+		},
+	}
+
+	adopted, err := ipb.Adopt(700)
+	if err != nil {
+		t.Fatalf("Adopt() error = %v", err)
+	}
+	if adopted != 1 {
+		t.Errorf("Adopt() = %d, want 1", adopted)
+	}
+
+	want := []BlockedHost{
+		{IP: net.ParseIP("10.192.1.21"), Reason: ReasonPortScan, BlockedAt: 100, Expires: 3700},
+		{IP: net.ParseIP("10.192.1.22").To4(), Reason: ReasonAdopted, BlockedAt: 700, Expires: 4300},
+	}
+	if !reflect.DeepEqual(ipb.BlockedHosts, want) {
+		t.Errorf("Adopt() BlockedHosts = %v, want %v", ipb.BlockedHosts, want)
+	}
+
+	// the adopted host is kept, the network no longer denylisted is removed
+	if orphans, missing, _ := ipb.Reconcile(700); orphans != 1 || missing != 0 {
+		t.Errorf("Reconcile() = %d orphans, %d missing, want 1 and 0", orphans, missing)
+	}
+	if _, present := backend.blocked["10.192.1.22/32"]; !present {
+		t.Errorf("Reconcile() backend = %v, want adopted 10.192.1.22 kept", backend.blocked)
+	}
+}
+
+func TestIPBlocker_Adopt_allowlisted(t *testing.T) {
+	allowlist, err := NewAllowlist([]string{"10.192.1.0/24"}, nil)
+	if err != nil {
+		t.Fatalf("NewAllowlist() error = %v", err)
+	}
+
+	// 10.192.1.22 was blocked by a previous run before its network was allowlisted
+	backend := newFakeBackend("10.192.1.22/32", "198.51.100.7/32")
+	ipb := &IPBlocker{Backend: backend, Allowlist: allowlist}
+
+	adopted, err := ipb.Adopt(700)
+	if err != nil {
+		t.Fatalf("Adopt() error = %v", err)
+	}
+	if adopted != 1 {
+		t.Errorf("Adopt() = %d, want 1", adopted)
+	}
+
+	want := []BlockedHost{{IP: net.ParseIP("198.51.100.7").To4(), Reason: ReasonAdopted, BlockedAt: 700}}
+	if !reflect.DeepEqual(ipb.BlockedHosts, want) {
+		t.Errorf("Adopt() BlockedHosts = %v, want %v", ipb.BlockedHosts, want)
+	}
+	if _, present := backend.blocked["10.192.1.22/32"]; present {
+		t.Errorf("Adopt() backend = %v, want allowlisted 10.192.1.22 unblocked", backend.blocked)
+	}
+}
@@ -0,0 +1,290 @@
+package connections
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rcanderson23/connectionWatcher/metrics"
+)
+
+const (
+	// DefaultScoreThreshold is the risk score that gets a remote host blocked
+	DefaultScoreThreshold = 10.0
+	// DefaultScoreHalfLife is the time it takes the risk score of a remote host to halve
+	DefaultScoreHalfLife = 5 * time.Minute
+)
+
+// Names of the factors of a risk score
+const (
+	FactorPorts          = "ports"
+	FactorSensitivePorts = "sensitive ports"
+	FactorHalfOpen       = "half-open"
+	FactorNewConnections = "new connections"
+	FactorDenylist       = "denylist"
+)
+
+// DefaultSensitivePorts are the ports whose scans weigh the most: ssh, telnet and rdp
+var DefaultSensitivePorts = []uint16{22, 23, 3389}
+
+// ScoreWeights are what each signal adds to the risk score of a remote host
+type ScoreWeights struct {
+	// Port is added for every distinct port connected to, once per window
+	Port float64
+	// SensitivePort is added instead of Port for a sensitive port
+	SensitivePort float64
+	// HalfOpen is added for every new half-open connection, a SYN that was never completed
+	HalfOpen float64
+	// NewConnection is added for every new connection, scoring the connection rate
+	NewConnection float64
+	// Denylist is added for every new connection from a denylisted network
+	Denylist float64
+}
+
+// DefaultScoreWeights block a remote host scanning 5 ports, or 4 when one is sensitive
+var DefaultScoreWeights = ScoreWeights{
+	Port:          2,
+	SensitivePort: 4,
+	HalfOpen:      1,
+	NewConnection: 0.1,
+	Denylist:      10,
+}
+
+// Factor is what a signal contributed to a risk score
+type Factor struct {
+	Name  string
+	Score float64
+}
+
+// HostScore is the decaying risk score of a remote host, kept per factor
+type HostScore struct {
+	Factors map[string]float64
+	// Ports are the local ports connected to and when they were last seen
+	Ports map[uint16]int64
+	// Updated is the unix time the Factors were last decayed to
+	Updated int64
+	// Changed is true if a signal was added since the last Verdicts
+	Changed bool
+}
+
+// Score returns the sum of the Factors
+func (s *HostScore) Score() float64 {
+	var score float64
+	for _, f := range s.Factors {
+		score += f
+	}
+	return score
+}
+
+// decay halves the Factors every halfLife until unix time t
+func (s *HostScore) decay(t int64, halfLife time.Duration) {
+	if t <= s.Updated {
+		return
+	}
+	d := math.Pow(0.5, float64(t-s.Updated)/halfLife.Seconds())
+	for name := range s.Factors {
+		s.Factors[name] *= d
+	}
+	s.Updated = t
+}
+
+// factors returns the Factors by decreasing score
+func (s *HostScore) factors() []Factor {
+	var factors []Factor
+	for name, score := range s.Factors {
+		factors = append(factors, Factor{Name: name, Score: score})
+	}
+	sort.Slice(factors, func(i, j int) bool {
+		if factors[i].Score != factors[j].Score {
+			return factors[i].Score > factors[j].Score
+		}
+		return factors[i].Name < factors[j].Name
+	})
+	return factors
+}
+
+// ScoreDetector blocks remote hosts whose risk score crosses the threshold. Every signal of a remote host adds its
+// weight to the score, which halves every half-life, so a host is blocked for the sum of what it did recently rather
+// than for a single count.
+type ScoreDetector struct {
+	Hosts map[string]*HostScore
+	// Threshold is the score that gets a host blocked, DefaultScoreThreshold if zero
+	Threshold float64
+	// HalfLife is DefaultScoreHalfLife if zero
+	HalfLife time.Duration
+	Weights  ScoreWeights
+	// SensitivePorts are weighted with Weights.SensitivePort
+	SensitivePorts []uint16
+	// Window is how long before a port counts as distinct again, DefaultWindow if zero
+	Window time.Duration
+	// Capture scores the new connections of captured connection attempts alone, otherwise only those of the source.
+	// Half-open connections are only known from the source.
+	Capture bool
+
+	// mu guards every field
+	mu sync.Mutex
+}
+
+// Name returns DetectorScore
+func (d *ScoreDetector) Name() string {
+	return DetectorScore
+}
+
+// Configure applies the score threshold, half-life, weights, sensitive ports, window and capture of c
+func (d *ScoreDetector) Configure(c DetectorConfig) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.Threshold = c.ScoreThreshold
+	d.HalfLife = c.ScoreHalfLife
+	d.Weights = c.ScoreWeights
+	d.SensitivePorts = c.SensitivePorts
+	d.Window = c.Window
+	d.Capture = c.Capture
+}
+
+func (d *ScoreDetector) settings() (float64, time.Duration, time.Duration) {
+	threshold, halfLife, window := d.Threshold, d.HalfLife, d.Window
+	if threshold == 0 {
+		threshold = DefaultScoreThreshold
+	}
+	if halfLife == 0 {
+		halfLife = DefaultScoreHalfLife
+	}
+	if window == 0 {
+		window = DefaultWindow
+	}
+	return threshold, halfLife, window
+}
+
+func (d *ScoreDetector) sensitive(port uint16) bool {
+	for _, p := range d.SensitivePorts {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
+// Observe adds the signals of o to the score of its remote host
+func (d *ScoreDetector) Observe(o Observation) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.Hosts == nil {
+		d.Hosts = make(map[string]*HostScore)
+	}
+
+	_, halfLife, window := d.settings()
+	s, present := d.Hosts[o.RemoteIP]
+	if !present {
+		s = &HostScore{Factors: make(map[string]float64), Ports: make(map[uint16]int64), Updated: o.Time}
+		d.Hosts[o.RemoteIP] = s
+	}
+	s.decay(o.Time, halfLife)
+
+	add := func(name string, weight float64) {
+		if weight > 0 {
+			s.Factors[name] += weight
+			s.Changed = true
+		}
+	}
+
+	seen, present := s.Ports[o.LocalPort]
+	if !present || o.Time-seen >= int64(window/time.Second) {
+		if d.sensitive(o.LocalPort) {
+			add(FactorSensitivePorts, d.Weights.SensitivePort)
+		} else {
+			add(FactorPorts, d.Weights.Port)
+		}
+	}
+	if !present || o.Time > seen {
+		s.Ports[o.LocalPort] = o.Time
+	}
+
+	if !o.New {
+		return
+	}
+	if o.HalfOpen {
+		add(FactorHalfOpen, d.Weights.HalfOpen)
+	}
+	// a connection is both captured and observed by the source, it is only scored once
+	if o.Captured != d.Capture {
+		return
+	}
+	add(FactorNewConnections, d.Weights.NewConnection)
+	if o.Denylisted {
+		add(FactorDenylist, d.Weights.Denylist)
+	}
+}
+
+// Verdicts decays every score to unix time now and returns the remote hosts whose score crossed the threshold, whose
+// scores are then reset. Scores that changed since the last Verdicts are logged and every score is exported as the
+// host_risk_score metric.
+func (d *ScoreDetector) Verdicts(now int64) []Verdict {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	threshold, halfLife, window := d.settings()
+
+	var verdicts []Verdict
+	for ip, s := range d.Hosts {
+		s.decay(now, halfLife)
+		for port, seen := range s.Ports {
+			if now-seen >= int64(window/time.Second) {
+				delete(s.Ports, port)
+			}
+		}
+
+		score := s.Score()
+		if s.Changed {
+			log.Printf("Risk score of %s is %.1f of %.1f: %s", ip, score, threshold, factorsToString(s.factors()))
+			s.Changed = false
+		}
+
+		// a host with no recent ports and a negligible score is forgotten
+		if score < threshold && (len(s.Ports) > 0 || score >= 0.05) {
+			metrics.RiskScore.WithLabelValues(ip).Set(score)
+			continue
+		}
+		metrics.RiskScore.DeleteLabelValues(ip)
+		delete(d.Hosts, ip)
+		if score < threshold {
+			continue
+		}
+
+		var ports []uint16
+		for port := range s.Ports {
+			ports = append(ports, port)
+		}
+		sort.Slice(ports, func(i, j int) bool { return ports[i] < ports[j] })
+
+		severity := SeverityMedium
+		if score >= 2*threshold {
+			severity = SeverityHigh
+		}
+		factors := s.factors()
+		verdicts = append(verdicts, Verdict{
+			Host:     RemoteHost{RemoteIP: net.ParseIP(ip), Ports: ports},
+			Reason:   DetectorScore,
+			Severity: severity,
+			Evidence: fmt.Sprintf("risk score %.1f of %.1f: %s", score, threshold, factorsToString(factors)),
+			Factors:  factors,
+		})
+	}
+	return verdicts
+}
+
+// factorsToString returns the factors as a comma separated string such as "ports 4.0, half-open 1.0"
+func factorsToString(factors []Factor) string {
+	s := make([]string, 0, len(factors))
+	for _, f := range factors {
+		s = append(s, fmt.Sprintf("%s %.1f", f.Name, f.Score))
+	}
+	return strings.Join(s, ", ")
+}
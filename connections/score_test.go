@@ -0,0 +1,144 @@
+package connections
+
+import (
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestHostScore_decay(t *testing.T) {
+	s := &HostScore{Factors: map[string]float64{FactorPorts: 8, FactorHalfOpen: 4}, Updated: 100}
+	s.decay(400, 5*time.Minute)
+	if got := s.Score(); math.Abs(got-6) > 1e-9 {
+		t.Errorf("Score() = %v after a half-life, want 6", got)
+	}
+
+	// observations older than the last decay are added as is
+	s.decay(300, 5*time.Minute)
+	if s.Updated != 400 {
+		t.Errorf("decay() Updated = %d, want 400", s.Updated)
+	}
+}
+
+func TestScoreDetector_Verdicts(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	type obs struct {
+		port     uint16
+		new      bool
+		halfOpen bool
+		time     int64
+	}
+	tests := []struct {
+		name       string
+		obs        []obs
+		denylisted bool
+		now        int64
+		want       []Factor
+	}{
+		{
+			name: "three web ports",
+			obs:  []obs{{80, true, false, 0}, {443, true, false, 0}, {8443, true, false, 0}},
+			now:  10,
+		},
+		{
+			name: "scan of a sensitive port",
+			obs:  []obs{{22, true, false, 0}, {80, true, false, 0}, {443, true, false, 0}, {8080, true, false, 0}},
+			now:  0,
+			want: []Factor{{FactorPorts, 6}, {FactorSensitivePorts, 4}, {FactorNewConnections, 0.4}},
+		},
+		{
+			name: "connection observed again scores once",
+			obs:  []obs{{22, true, false, 0}, {22, false, false, 10}, {22, false, false, 20}, {80, true, false, 20}},
+			now:  20,
+		},
+		{
+			name: "half-open connections",
+			obs:  []obs{{22, true, true, 0}, {23, true, true, 0}, {80, true, true, 0}},
+			now:  0,
+			want: []Factor{{FactorSensitivePorts, 8}, {FactorHalfOpen, 3}, {FactorPorts, 2}, {FactorNewConnections, 0.3}},
+		},
+		{
+			name:       "denylisted host",
+			obs:        []obs{{443, true, false, 0}},
+			denylisted: true,
+			now:        0,
+			want:       []Factor{{FactorDenylist, 10}, {FactorPorts, 2}, {FactorNewConnections, 0.1}},
+		},
+		{
+			name: "scan decayed below the threshold",
+			obs:  []obs{{22, true, false, 0}, {80, true, false, 0}, {443, true, false, 0}, {8080, true, false, 0}},
+			now:  300,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &ScoreDetector{Weights: DefaultScoreWeights, SensitivePorts: DefaultSensitivePorts}
+			for _, o := range tt.obs {
+				d.Observe(Observation{
+					LocalIP:    "10.0.0.1",
+					RemoteIP:   "192.168.1.1",
+					LocalPort:  o.port,
+					New:        o.new,
+					HalfOpen:   o.halfOpen,
+					Denylisted: tt.denylisted,
+					Time:       o.time,
+				})
+			}
+
+			got := d.Verdicts(tt.now)
+			if tt.want == nil {
+				if len(got) != 0 {
+					t.Errorf("Verdicts() = %v, want none", got)
+				}
+				return
+			}
+			if len(got) != 1 || got[0].Reason != DetectorScore {
+				t.Fatalf("Verdicts() = %v, want score verdict", got)
+			}
+			for i := range got[0].Factors {
+				got[0].Factors[i].Score = math.Round(got[0].Factors[i].Score*10) / 10
+			}
+			if !reflect.DeepEqual(got[0].Factors, tt.want) {
+				t.Errorf("Verdicts() factors = %v, want %v", got[0].Factors, tt.want)
+			}
+			if _, present := d.Hosts["192.168.1.1"]; present {
+				t.Errorf("Verdicts() kept the score of a blocked host")
+			}
+		})
+	}
+}
+
+func TestDetection_Observe_denylisted(t *testing.T) {
+	d := &ScoreDetector{Weights: DefaultScoreWeights, Capture: true}
+	detection := &Detection{Detectors: []Detector{d}}
+	detection.SetDenylisted([]*net.IPNet{{IP: net.IP{192, 0, 2, 0}, Mask: net.CIDRMask(24, 32)}})
+
+	detection.AddPort("10.0.0.1", "192.0.2.10", 443, 0)
+	detection.AddPort("10.0.0.1", "198.51.100.10", 443, 0)
+
+	if got := d.Hosts["192.0.2.10"].Factors[FactorDenylist]; got != DefaultScoreWeights.Denylist {
+		t.Errorf("denylisted host scored %v, want %v", got, DefaultScoreWeights.Denylist)
+	}
+	if got := d.Hosts["198.51.100.10"].Factors[FactorDenylist]; got != 0 {
+		t.Errorf("host outside the denylist scored %v, want 0", got)
+	}
+}
+
+func TestScoreDetector_capture(t *testing.T) {
+	d := &ScoreDetector{Weights: DefaultScoreWeights, Capture: true}
+	for _, port := range []uint16{80, 443} {
+		d.Observe(Observation{RemoteIP: "192.168.1.1", LocalPort: port, New: true, Captured: true, Time: 0})
+		d.Observe(Observation{RemoteIP: "192.168.1.1", LocalPort: port, New: true, HalfOpen: true, Time: 0})
+	}
+
+	// half-open connections are only known from the source, new connections are counted from the capture alone
+	want := map[string]float64{FactorPorts: 4, FactorHalfOpen: 2, FactorNewConnections: 0.2}
+	if got := d.Hosts["192.168.1.1"].Factors; !reflect.DeepEqual(got, want) {
+		t.Errorf("Observe() factors = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,113 @@
+package connections
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultSequentialPorts is the number of consecutive local ports a remote host connects to before it is blocked
+const DefaultSequentialPorts = 4
+
+// SequentialDetector blocks remote hosts connecting to a run of consecutive ports of a local IP within the window, the
+// pattern of a scanner walking a port range. It catches scans of local IPs whose port threshold is raised.
+type SequentialDetector struct {
+	// Windows are the ports each remote host connected to on each local IP within the window
+	Windows map[HostPair]*PortWindow
+	// Ports is the length of the run of consecutive ports that gets a host blocked, DefaultSequentialPorts if zero
+	Ports int
+	// Window is the sliding window ports are counted in, DefaultWindow if zero
+	Window time.Duration
+
+	// mu guards every field
+	mu sync.Mutex
+}
+
+// Name returns DetectorSequential
+func (d *SequentialDetector) Name() string {
+	return DetectorSequential
+}
+
+// Configure applies the sequential ports and window of c
+func (d *SequentialDetector) Configure(c DetectorConfig) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.Ports = c.SequentialPorts
+	d.Window = c.Window
+}
+
+// Observe adds the port of o to the window of its remote host connecting to its local IP
+func (d *SequentialDetector) Observe(o Observation) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.Windows == nil {
+		d.Windows = make(map[HostPair]*PortWindow)
+	}
+
+	key := HostPair{LocalIP: o.LocalIP, RemoteIP: o.RemoteIP}
+	if _, present := d.Windows[key]; !present {
+		d.Windows[key] = &PortWindow{}
+	}
+	d.Windows[key].Add(o.LocalPort, o.Time)
+}
+
+// Verdicts slides every window to unix time now and returns the remote hosts that connected to a run of consecutive
+// ports
+func (d *SequentialDetector) Verdicts(now int64) []Verdict {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	length, window := d.Ports, d.Window
+	if length == 0 {
+		length = DefaultSequentialPorts
+	}
+	if window == 0 {
+		window = DefaultWindow
+	}
+
+	var verdicts []Verdict
+	for key, w := range d.Windows {
+		w.Slide(now, window)
+		if len(w.Seen) == 0 {
+			delete(d.Windows, key)
+			continue
+		}
+
+		run := longestRun(w.Ports())
+		if len(run) < length {
+			continue
+		}
+
+		verdicts = append(verdicts, Verdict{
+			Host:     RemoteHost{RemoteIP: net.ParseIP(key.RemoteIP), LocalIP: net.ParseIP(key.LocalIP), Ports: run},
+			Reason:   DetectorSequential,
+			Severity: SeverityHigh,
+			Evidence: fmt.Sprintf("connected to consecutive ports %d-%d of %s", run[0], run[len(run)-1], key.LocalIP),
+		})
+		delete(d.Windows, key)
+	}
+	return verdicts
+}
+
+// longestRun returns the longest run of consecutive ports in ports, the first if several are as long
+func longestRun(ports []uint16) []uint16 {
+	sorted := append([]uint16{}, ports...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	var longest []uint16
+	start := 0
+	for i := 1; i <= len(sorted); i++ {
+		if i < len(sorted) && sorted[i] == sorted[i-1]+1 {
+			continue
+		}
+		if i-start > len(longest) {
+			longest = sorted[start:i]
+		}
+		start = i
+	}
+	return longest
+}
@@ -0,0 +1,46 @@
+package connections
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLongestRun(t *testing.T) {
+	tests := []struct {
+		name  string
+		ports []uint16
+		want  []uint16
+	}{
+		{name: "empty", ports: nil, want: nil},
+		{name: "single", ports: []uint16{22}, want: []uint16{22}},
+		{name: "unordered run", ports: []uint16{23, 21, 22, 20}, want: []uint16{20, 21, 22, 23}},
+		{name: "longest of two", ports: []uint16{80, 81, 443, 444, 445}, want: []uint16{443, 444, 445}},
+		{name: "first of equal runs", ports: []uint16{8080, 8081, 22, 23}, want: []uint16{22, 23}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := longestRun(tt.ports); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("longestRun() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSequentialDetector_Verdicts(t *testing.T) {
+	d := &SequentialDetector{}
+	for i, port := range []uint16{1000, 1001, 1002, 5000} {
+		d.Observe(Observation{LocalIP: "10.0.0.1", RemoteIP: "192.168.1.1", LocalPort: port, Time: int64(i)})
+	}
+	if got := d.Verdicts(10); len(got) != 0 {
+		t.Fatalf("Verdicts() = %v, want none for 3 consecutive ports", got)
+	}
+
+	d.Observe(Observation{LocalIP: "10.0.0.1", RemoteIP: "192.168.1.1", LocalPort: 1003, Time: 11})
+	got := d.Verdicts(12)
+	if len(got) != 1 {
+		t.Fatalf("Verdicts() = %v, want 192.168.1.1", got)
+	}
+	if want := []uint16{1000, 1001, 1002, 1003}; !reflect.DeepEqual(got[0].Host.Ports, want) || got[0].Severity != SeverityHigh {
+		t.Errorf("Verdicts() = %v %v, want %v high", got[0].Host.Ports, got[0].Severity, want)
+	}
+}
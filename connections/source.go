@@ -0,0 +1,80 @@
+package connections
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"time"
+)
+
+// Source returns every connection currently on the host keyed by the connection tuple, in the same form as
+// getConnections
+type Source interface {
+	Connections() (map[string]Connection, error)
+}
+
+// ProcSource reads connections from tcp tables such as /proc/net/tcp and /proc/net/tcp6
+type ProcSource struct {
+	Paths []string
+	// Recorder, if set, has every poll of Paths written to it
+	Recorder *ArchiveWriter
+}
+
+// NewProcSource returns a pointer to a ProcSource reading the provided paths
+func NewProcSource(paths ...string) *ProcSource {
+	return &ProcSource{Paths: paths}
+}
+
+// Connections returns the combined connections of every path. A file that fails to be read is logged and skipped,
+// an error is only returned when no file could be read.
+func (ps *ProcSource) Connections() (map[string]Connection, error) {
+	var files []ArchiveFile
+	for _, path := range ps.Paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Printf("failed to check new connections in %s: %v", path, err)
+			continue
+		}
+		files = append(files, ArchiveFile{Path: path, Data: data})
+	}
+
+	if len(files) == 0 {
+		return nil, fmt.Errorf("failed to read any of %v", ps.Paths)
+	}
+
+	if ps.Recorder != nil {
+		if err := ps.Recorder.WritePoll(Poll{Time: time.Now().Unix(), Files: files}); err != nil {
+			log.Printf("failed to record poll: %v", err)
+		}
+	}
+
+	return connectionsFromFiles(files)
+}
+
+// connectionsFromFiles returns the combined connections of the tcp tables in files. A file that fails to be parsed
+// is logged and skipped, an error is only returned when no file could be parsed.
+func connectionsFromFiles(files []ArchiveFile) (map[string]Connection, error) {
+	obsConns := make(map[string]Connection)
+	var parsed int
+
+	for _, f := range files {
+		conns, err := getConnections(bytes.NewReader(f.Data))
+		if err != nil {
+			log.Printf("failed to check new connections in %s: %v", f.Path, err)
+			continue
+		}
+		parsed++
+
+		for key, conn := range conns {
+			obsConns[key] = conn
+		}
+	}
+
+	if parsed == 0 {
+		return nil, errors.New("no tcp tables could be parsed")
+	}
+
+	return obsConns, nil
+}
@@ -0,0 +1,66 @@
+package connections
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestProcSource_Connections(t *testing.T) {
+	tests := []struct {
+		name    string
+		paths   []string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:  "tcp and tcp6",
+			paths: []string{"../test/tcp2", "../test/tcp6"},
+			want: []string{
+				"10.192.1.18:6443:10.192.1.21:55468",
+				"10.192.1.18:6443:10.192.1.24:60024",
+				"[::]:22:[::]:0",
+				"[2001:db8::1]:22:[2001:db8::2]:55468",
+			},
+			wantErr: false,
+		},
+		{
+			name:  "missing file skipped",
+			paths: []string{"../test/tcp2", "../test/missing"},
+			want: []string{
+				"10.192.1.18:6443:10.192.1.21:55468",
+				"10.192.1.18:6443:10.192.1.24:60024",
+			},
+			wantErr: false,
+		},
+		{
+			name:    "nothing read",
+			paths:   []string{"../test/tcpEmpty", "../test/missing"},
+			want:    nil,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewProcSource(tt.paths...).Connections()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Connections() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.wantErr {
+				return
+			}
+
+			want := make(map[string]struct{})
+			for _, key := range tt.want {
+				want[key] = struct{}{}
+			}
+			keys := make(map[string]struct{})
+			for key := range got {
+				keys[key] = struct{}{}
+			}
+			if !reflect.DeepEqual(keys, want) {
+				t.Errorf("Connections() keys = %v, want %v", keys, want)
+			}
+		})
+	}
+}
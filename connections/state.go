@@ -0,0 +1,79 @@
+package connections
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// TCPState is the state of a socket as reported in the st column of /proc/net/tcp, values match the kernel's
+// enum in include/net/tcp_states.h
+type TCPState uint8
+
+const (
+	TCPEstablished TCPState = iota + 1
+	TCPSynSent
+	TCPSynRecv
+	TCPFinWait1
+	TCPFinWait2
+	TCPTimeWait
+	TCPClose
+	TCPCloseWait
+	TCPLastAck
+	TCPListen
+	TCPClosing
+	TCPNewSynRecv
+)
+
+var tcpStateNames = map[TCPState]string{
+	TCPEstablished: "ESTABLISHED",
+	TCPSynSent:     "SYN_SENT",
+	TCPSynRecv:     "SYN_RECV",
+	TCPFinWait1:    "FIN_WAIT1",
+	TCPFinWait2:    "FIN_WAIT2",
+	TCPTimeWait:    "TIME_WAIT",
+	TCPClose:       "CLOSE",
+	TCPCloseWait:   "CLOSE_WAIT",
+	TCPLastAck:     "LAST_ACK",
+	TCPListen:      "LISTEN",
+	TCPClosing:     "CLOSING",
+	TCPNewSynRecv:  "NEW_SYN_RECV",
+}
+
+func (s TCPState) String() string {
+	if name, present := tcpStateNames[s]; present {
+		return name
+	}
+	return fmt.Sprintf("UNKNOWN(%d)", uint8(s))
+}
+
+// HalfOpen reports if the remote host has sent a SYN that has not yet completed the handshake. The kernel reports
+// pending requests as SYN_RECV in /proc/net/tcp, NEW_SYN_RECV is included for sources that expose it directly.
+func (s TCPState) HalfOpen() bool {
+	return s == TCPSynRecv || s == TCPNewSynRecv
+}
+
+// Detectable reports if a socket in this state represents a connection with a remote host that should be considered
+// for port scan detection. Listening and closed sockets have no remote host and SYN_SENT is the local host connecting out.
+func (s TCPState) Detectable() bool {
+	switch s {
+	case TCPListen, TCPClose, TCPSynSent:
+		return false
+	}
+	_, known := tcpStateNames[s]
+	return known
+}
+
+// parseState expects the hex st column and returns the TCPState
+func parseState(s string) (TCPState, error) {
+	st, err := strconv.ParseUint(s, 16, 8)
+	if err != nil {
+		return 0, err
+	}
+
+	state := TCPState(st)
+	if _, known := tcpStateNames[state]; !known {
+		return 0, fmt.Errorf("unknown tcp state: %s", s)
+	}
+
+	return state, nil
+}
@@ -0,0 +1,104 @@
+package connections
+
+import "testing"
+
+func Test_parseState(t *testing.T) {
+	type args struct {
+		s string
+	}
+	tests := []struct {
+		name    string
+		args    args
+		want    TCPState
+		wantErr bool
+	}{
+		{
+			name:    "ESTABLISHED",
+			args:    args{s: "01"},
+			want:    TCPEstablished,
+			wantErr: false,
+		},
+		{
+			name:    "SYN_RECV",
+			args:    args{s: "03"},
+			want:    TCPSynRecv,
+			wantErr: false,
+		},
+		{
+			name:    "LISTEN",
+			args:    args{s: "0A"},
+			want:    TCPListen,
+			wantErr: false,
+		},
+		{
+			name:    "unknown state",
+			args:    args{s: "0F"},
+			want:    0,
+			wantErr: true,
+		},
+		{
+			name:    "invalid hex",
+			args:    args{s: "XX"},
+			want:    0,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseState(tt.args.s)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseState() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("parseState() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTCPState_Detectable(t *testing.T) {
+	tests := []struct {
+		name  string
+		state TCPState
+		want  bool
+	}{
+		{
+			name:  "ESTABLISHED",
+			state: TCPEstablished,
+			want:  true,
+		},
+		{
+			name:  "SYN_RECV",
+			state: TCPSynRecv,
+			want:  true,
+		},
+		{
+			name:  "TIME_WAIT",
+			state: TCPTimeWait,
+			want:  true,
+		},
+		{
+			name:  "LISTEN",
+			state: TCPListen,
+			want:  false,
+		},
+		{
+			name:  "SYN_SENT",
+			state: TCPSynSent,
+			want:  false,
+		},
+		{
+			name:  "unknown",
+			state: TCPState(0),
+			want:  false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.state.Detectable(); got != tt.want {
+				t.Errorf("Detectable() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
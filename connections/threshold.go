@@ -0,0 +1,112 @@
+package connections
+
+import (
+	"net"
+	"time"
+)
+
+// DefaultWindow is the sliding window distinct ports are counted in
+const DefaultWindow = 60 * time.Second
+
+// Threshold overrides the PortThreshold and Window of the PortScanDetector for connections to LocalNets and Ports, such as a
+// web tier whose clients legitimately connect to several ports. The connections matching a Threshold are counted
+// apart from the others.
+type Threshold struct {
+	// Name identifies the Threshold in logs
+	Name string
+	// LocalNets are the local addresses the Threshold applies to, any if empty
+	LocalNets []*net.IPNet
+	// Ports are the local ports the Threshold applies to, any if empty
+	Ports []uint16
+	// PortThreshold is the number of distinct ports that gets a host blocked, the PortScanDetector's if zero
+	PortThreshold int
+	// Window is the sliding window ports are counted in, the PortScanDetector's if zero
+	Window time.Duration
+}
+
+// matches returns true if a connection to port of localIP is counted against the Threshold
+func (th Threshold) matches(localIP net.IP, port uint16) bool {
+	if len(th.LocalNets) > 0 {
+		var found bool
+		for _, n := range th.LocalNets {
+			if n.Contains(localIP) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(th.Ports) == 0 {
+		return true
+	}
+	for _, p := range th.Ports {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
+// WindowKey identifies the ports a remote host connected to on a local IP, counted against the Threshold named
+// Threshold or the PortScanDetector's own threshold if empty
+type WindowKey struct {
+	HostPair
+	Threshold string
+}
+
+// PortWindow is a sliding window of the local ports a remote host connected to. Ports are ordered by when they were
+// last seen, oldest first, so sliding the window only looks at the ports leaving it.
+type PortWindow struct {
+	Seen []PortSeen
+}
+
+// PortSeen is a port and when it was last seen, in seconds since the unix epoch
+type PortSeen struct {
+	Port uint16
+	Time int64
+}
+
+// Add records port as seen at unix time t
+func (w *PortWindow) Add(port uint16, t int64) {
+	for i, s := range w.Seen {
+		if s.Port == port {
+			if s.Time >= t {
+				return
+			}
+			w.Seen = append(w.Seen[:i], w.Seen[i+1:]...)
+			break
+		}
+	}
+
+	// observations mostly arrive in order, an older one is moved back to its place
+	i := len(w.Seen)
+	for i > 0 && w.Seen[i-1].Time > t {
+		i--
+	}
+	w.Seen = append(w.Seen, PortSeen{})
+	copy(w.Seen[i+1:], w.Seen[i:])
+	w.Seen[i] = PortSeen{Port: port, Time: t}
+}
+
+// Slide removes the ports last seen a window or longer before unix time now and returns them
+func (w *PortWindow) Slide(now int64, window time.Duration) []uint16 {
+	var removed []uint16
+	i := 0
+	for ; i < len(w.Seen) && now-w.Seen[i].Time >= int64(window/time.Second); i++ {
+		removed = append(removed, w.Seen[i].Port)
+	}
+	w.Seen = w.Seen[i:]
+	return removed
+}
+
+// Ports returns the distinct ports in the window
+func (w *PortWindow) Ports() []uint16 {
+	ports := make([]uint16, 0, len(w.Seen))
+	for _, s := range w.Seen {
+		ports = append(ports, s.Port)
+	}
+	return ports
+}
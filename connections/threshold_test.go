@@ -0,0 +1,63 @@
+package connections
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestThreshold_matches(t *testing.T) {
+	th := Threshold{
+		LocalNets: []*net.IPNet{{IP: net.IP{10, 0, 0, 0}, Mask: net.CIDRMask(24, 32)}},
+		Ports:     []uint16{80, 443},
+	}
+
+	tests := []struct {
+		name      string
+		threshold Threshold
+		localIP   string
+		port      uint16
+		want      bool
+	}{
+		{name: "local ip and port", threshold: th, localIP: "10.0.0.5", port: 443, want: true},
+		{name: "other port", threshold: th, localIP: "10.0.0.5", port: 22, want: false},
+		{name: "other local ip", threshold: th, localIP: "10.0.1.5", port: 443, want: false},
+		{name: "any local ip", threshold: Threshold{Ports: []uint16{80}}, localIP: "2001:db8::1", port: 80, want: true},
+		{name: "any port", threshold: Threshold{LocalNets: th.LocalNets}, localIP: "10.0.0.5", port: 22, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.threshold.matches(net.ParseIP(tt.localIP), tt.port); got != tt.want {
+				t.Errorf("matches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPortWindow(t *testing.T) {
+	w := &PortWindow{}
+	w.Add(80, 10)
+	w.Add(81, 20)
+	w.Add(82, 30)
+	// seeing 80 again moves it to the end of the window, an older observation of 81 is ignored
+	w.Add(80, 40)
+	w.Add(81, 15)
+	// an observation arriving late is placed by its time
+	w.Add(83, 25)
+
+	want := []PortSeen{{Port: 81, Time: 20}, {Port: 83, Time: 25}, {Port: 82, Time: 30}, {Port: 80, Time: 40}}
+	if !reflect.DeepEqual(w.Seen, want) {
+		t.Fatalf("Add() Seen = %v, want %v", w.Seen, want)
+	}
+
+	if got := w.Slide(54, 30*time.Second); !reflect.DeepEqual(got, []uint16{81}) {
+		t.Errorf("Slide() = %v, want [81]", got)
+	}
+	if got := w.Slide(60, 30*time.Second); !reflect.DeepEqual(got, []uint16{83, 82}) {
+		t.Errorf("Slide() = %v, want [83 82]", got)
+	}
+	if got := w.Ports(); !reflect.DeepEqual(got, []uint16{80}) {
+		t.Errorf("Ports() = %v, want [80]", got)
+	}
+}
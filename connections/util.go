@@ -1,5 +1,59 @@
 package connections
 
-func IsEphemeralPort(port uint16) bool {
-	return port >= MinEphemeralPort && port <= MaxEphemeralPort
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// EphemeralPortRangePath is the fs path to the kernel's local port range used for outgoing connections
+const EphemeralPortRangePath = "/proc/sys/net/ipv4/ip_local_port_range"
+
+// DefaultEphemeralRange is the kernel's default local port range, used when EphemeralPortRangePath can't be read
+var DefaultEphemeralRange = PortRange{Min: 32768, Max: 60999}
+
+// PortRange is an inclusive range of ports
+type PortRange struct {
+	Min uint16
+	Max uint16
+}
+
+// Contains reports if port is within the range
+func (r PortRange) Contains(port uint16) bool {
+	return port >= r.Min && port <= r.Max
+}
+
+// ReadPortRange reads a port range in the format of ip_local_port_range, two whitespace separated ports
+func ReadPortRange(path string) (PortRange, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return PortRange{}, err
+	}
+
+	return ParsePortRange(string(b))
+}
+
+// ParsePortRange parses two ports separated by whitespace, as in ip_local_port_range, or by a dash as in 32768-60999
+func ParsePortRange(s string) (PortRange, error) {
+	fields := strings.Fields(strings.Replace(s, "-", " ", 1))
+	if len(fields) != 2 {
+		return PortRange{}, fmt.Errorf("expected 2 ports in range, got %d", len(fields))
+	}
+
+	min, err := strconv.ParseUint(fields[0], 10, 16)
+	if err != nil {
+		return PortRange{}, err
+	}
+
+	max, err := strconv.ParseUint(fields[1], 10, 16)
+	if err != nil {
+		return PortRange{}, err
+	}
+
+	if min > max {
+		return PortRange{}, fmt.Errorf("invalid port range %d-%d", min, max)
+	}
+
+	return PortRange{Min: uint16(min), Max: uint16(max)}, nil
 }
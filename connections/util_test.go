@@ -2,7 +2,7 @@ package connections
 
 import "testing"
 
-func TestIsEphemeralPort(t *testing.T) {
+func TestPortRange_Contains(t *testing.T) {
 	type args struct {
 		port uint16
 	}
@@ -28,8 +28,69 @@ func TestIsEphemeralPort(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := IsEphemeralPort(tt.args.port); got != tt.want {
-				t.Errorf("IsEphemeralPort() = %v, want %v", got, tt.want)
+			if got := DefaultEphemeralRange.Contains(tt.args.port); got != tt.want {
+				t.Errorf("Contains() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePortRange(t *testing.T) {
+	type args struct {
+		s string
+	}
+	tests := []struct {
+		name    string
+		args    args
+		want    PortRange
+		wantErr bool
+	}{
+		{
+			name:    "default range",
+			args:    args{s: "32768\t60999\n"},
+			want:    PortRange{Min: 32768, Max: 60999},
+			wantErr: false,
+		},
+		{
+			name:    "tuned range",
+			args:    args{s: "1024 65535\n"},
+			want:    PortRange{Min: 1024, Max: 65535},
+			wantErr: false,
+		},
+		{
+			name:    "dash separated",
+			args:    args{s: "1024-65535"},
+			want:    PortRange{Min: 1024, Max: 65535},
+			wantErr: false,
+		},
+		{
+			name:    "single port",
+			args:    args{s: "1024\n"},
+			want:    PortRange{},
+			wantErr: true,
+		},
+		{
+			name:    "min greater than max",
+			args:    args{s: "60999 32768\n"},
+			want:    PortRange{},
+			wantErr: true,
+		},
+		{
+			name:    "out of range",
+			args:    args{s: "1024 70000\n"},
+			want:    PortRange{},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParsePortRange(tt.args.s)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParsePortRange() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("ParsePortRange() got = %v, want %v", got, tt.want)
 			}
 		})
 	}
@@ -5,4 +5,5 @@ go 1.16
 require (
 	github.com/coreos/go-iptables v0.6.0
 	github.com/prometheus/client_golang v1.11.0
+	gopkg.in/yaml.v2 v2.4.0
 )
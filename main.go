@@ -1,6 +1,8 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"log"
 	"net/http"
 	"os"
@@ -9,64 +11,210 @@ import (
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rcanderson23/connectionWatcher/api"
+	"github.com/rcanderson23/connectionWatcher/capture"
+	"github.com/rcanderson23/connectionWatcher/config"
 	"github.com/rcanderson23/connectionWatcher/connections"
 )
 
-const (
-	// TCP is the fs path to the tcp file
-	TCP = "/proc/net/tcp"
-	// TTL is the length of time in seconds that connections need to be tracked
-	TTL = int64(60)
-	// WaitPeriod is the amount of time in seconds before every observation of TCP
-	WaitPeriod = time.Second * 10
-)
-
-// shortcut: configurable settings, such as prometheus listening port, TTL, period between observations, etc
-// shortcut: no timeout on the blocking of a remote host, probably best to set some kind of TTL on host blocking instead of indefinitely
 // shortcut: this is all done sequentially which probably isn't the most efficient. It _may_ be better to use channels, especially if
 // reading directly from a pcap instead of polling. Channels generally make it more complex to read, we would want to ensure
 // channels are actually faster and worth it.
 func main() {
-	blocker := connections.NewIPBlocker()
-	cw := connections.NewConnectionWatcher(blocker)
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		if err := runReplay(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	cfg, _, err := config.Load(os.Args[0], os.Args[1:], os.LookupEnv)
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	source := newSource(cfg)
+
+	allowlist, err := cfg.NewAllowlist()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	detection, err := connections.NewDetection(cfg.Detection())
+	if err != nil {
+		log.Fatal(err)
+	}
+	detection.Allowlist = allowlist
+
+	blocker := connections.NewIPBlocker(cfg.Blocker())
+	blocker.Allowlist = allowlist
+	// a monitoring run must not restore, or overwrite, the blocks of an enforcing run
+	if cfg.StateFile != "" && !cfg.Monitor {
+		state, err := connections.LoadState(cfg.StateFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		blocker.Restore(state, time.Now().Unix())
+	}
+	denylist := connections.NewDenylist(cfg.Denylist)
+	updateDenylist(blocker, detection, denylist, time.Now().Unix())
+	// blocks kept by a previous run that the state doesn't have are adopted rather than removed as orphans
+	if _, err := blocker.Adopt(time.Now().Unix()); err != nil {
+		log.Printf("Failed to adopt blocks: %v", err)
+	}
+	reconcile(blocker, time.Now().Unix())
+
+	cw := connections.NewConnectionWatcher(source, blocker, cfg.EphemeralPorts())
+	cw.Detection = detection
+	cw.Allowlist = allowlist
+
+	// the archive records the ephemeral port range in use so replays classify directions the same
+	if cfg.Record != "" {
+		procSource, ok := source.(*connections.ProcSource)
+		if !ok {
+			log.Fatalf("recording requires the proc source")
+		}
 
-	// seed connection watcher data, better UX to see logs right away rather than after the first ticker loop
-	cw.Observe(TCP, time.Now().Unix())
+		f, err := os.Create(cfg.Record)
+		if err != nil {
+			log.Fatalf("failed to create archive: %v", err)
+		}
+		defer f.Close()
+
+		procSource.Recorder, err = connections.NewArchiveWriter(f, cw.EphemeralPorts)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
 
-	ticker := time.NewTicker(WaitPeriod)
+	// packets are captured alongside the connection source so probes that never create a socket are counted
+	var packets *capture.Capture
+	if cfg.Capture {
+		packets, err = capture.Open(capture.NewTracker(detection))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		go func() {
+			if err := packets.Run(); err != nil {
+				log.Printf("packet capture stopped: %v", err)
+			}
+		}()
+	}
+
+	// seed connection watcher data so the connections open at startup aren't taken for new ones on the first tick
+	cw.Observe(time.Now().Unix())
+
+	ticker := time.NewTicker(cfg.WaitPeriod)
+	reconcileTicker := time.NewTicker(cfg.ReconcileInterval)
+	denylistTicker := time.NewTicker(cfg.DenylistInterval)
+
+	// the API serves the blocks published by the main loop after every change
+	apiServer := &api.Server{Monitor: cfg.Monitor}
+	apiServer.SetBlocks(blocker.Blocks())
+	apiServer.SetDecisions(blocker.Decisions())
 
 	// create channel to gracefully terminate
 	done := make(chan os.Signal, 1)
 	signal.Notify(done, syscall.SIGINT, syscall.SIGTERM, os.Interrupt)
 
+	// SIGHUP reloads the configuration, handled by the main loop so it never races an observation
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	// the metrics address can't be changed on reload, the main loop replaces cfg so it's read once here
+	addr := cfg.MetricsAddress
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
 	go func() {
+		defer close(stopped)
 		for {
 			select {
 			case <-ticker.C:
 				t := time.Now().Unix()
-				cw.Observe(TCP, t)
-				cw.Blocker.RemoveOldConnections(t, TTL)
-				hosts := cw.Blocker.HostsToBlock()
-				errs := cw.Blocker.BlockHosts(hosts)
-				if len(errs) != 0 {
-					for err := range errs {
-						log.Printf("failed to block host: %v", err)
+				cw.Observe(t)
+				cw.Blocker.ExpireBlocks(t)
+				verdicts := cw.Detection.Verdicts(t)
+				for _, err := range cw.Blocker.BlockHosts(verdicts, t) {
+					if errors.Is(err, connections.ErrAllowlisted) {
+						// logged by BlockHosts, allowlisted hosts are never blocked by design
+						continue
 					}
+					log.Printf("%v", err)
 				}
-			case <-done:
-				break
+			case <-reconcileTicker.C:
+				t := time.Now().Unix()
+				// expire blocks first so a block the firewall expired on its own isn't restored
+				cw.Blocker.ExpireBlocks(t)
+				reconcile(cw.Blocker, t)
+			case <-denylistTicker.C:
+				updateDenylist(cw.Blocker, cw.Detection, denylist, time.Now().Unix())
+			case <-hup:
+				cfg = reload(cfg, cw, denylist, ticker, reconcileTicker, denylistTicker)
+			case <-stop:
+				return
 			}
+			apiServer.SetBlocks(cw.Blocker.Blocks())
+			apiServer.SetDecisions(cw.Blocker.Decisions())
 		}
 	}()
 
 	go func() {
-		// shortcut: hardcode path and port for metrics, production you may want to make these configurable
 		http.Handle("/metrics", promhttp.Handler())
-		log.Fatal(http.ListenAndServe(":9090", nil))
+		http.Handle("/api/", apiServer.Handler())
+		log.Fatal(http.ListenAndServe(addr, nil))
 	}()
 
 	<-done
+	close(stop)
+	<-stopped
 
-	// cleanup iptables added during runtime
+	if packets != nil {
+		packets.Close()
+	}
+
+	// cleanup firewall entries added during runtime, unless they should outlive the process
+	if cfg.ExitPolicy == config.ExitKeep {
+		log.Printf("Keeping %d blocked hosts on exit", len(cw.Blocker.BlockedHosts))
+		return
+	}
 	cw.Blocker.CleanUp()
 }
+
+// reconcile reconciles the firewall with the hosts blocked by blocker, logging any drift
+func reconcile(blocker *connections.IPBlocker, t int64) {
+	orphans, missing, err := blocker.Reconcile(t)
+	if err != nil {
+		log.Printf("Failed to reconcile firewall: %v", err)
+		return
+	}
+	if orphans > 0 || missing > 0 {
+		log.Printf("Reconciled firewall: removed %d orphaned blocks, restored %d missing blocks", orphans, missing)
+	}
+}
+
+// updateDenylist blocks the networks of the denylist files with blocker at unix time t if any file changed, and gives
+// them to detection for scoring. A denylist that can't be read is logged and the networks blocked before are kept.
+func updateDenylist(blocker *connections.IPBlocker, detection *connections.Detection, denylist *connections.Denylist, t int64) {
+	nets, changed, err := denylist.Load()
+	if err != nil {
+		log.Printf("Failed to load denylist, keeping previous denylist: %v", err)
+		return
+	}
+	if changed {
+		blocker.SetDenylist(nets, t)
+		detection.SetDenylisted(nets)
+	}
+}
+
+// newSource returns the connections.Source configured in cfg, the source name has been validated by config.Load
+func newSource(cfg config.Config) connections.Source {
+	if cfg.Source == "netlink" {
+		return connections.NewNetlinkSource()
+	}
+	return connections.NewProcSource(cfg.TCPPaths...)
+}
@@ -12,4 +12,93 @@ var (
 			Name: "proc_net_tcp_new_connections",
 			Help: "New connections observed at /proc/net/tcp",
 		})
+
+	// HalfOpenConnections is a counter for the number of observed new connections in the SYN_RECV state
+	HalfOpenConnections = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "proc_net_tcp_half_open_connections",
+			Help: "New half-open (SYN_RECV) connections observed at /proc/net/tcp",
+		})
+
+	// ClosedConnections is a counter for the number of observed connections that closed
+	ClosedConnections = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "proc_net_tcp_closed_connections",
+			Help: "Observed connections that closed",
+		})
+
+	// ConnectionDuration is a histogram of how long closed connections were observed for by direction. A connection
+	// seen in a single observation lasted 0s.
+	ConnectionDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "connection_duration_seconds",
+			Help:    "Time closed connections were observed for, from their first to their last observation",
+			Buckets: []float64{0, 10, 30, 60, 300, 900, 3600, 14400, 86400},
+		}, []string{"direction"})
+
+	// CaptureAttempts is a counter for the connection attempts seen in captured packets by their result
+	CaptureAttempts = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "capture_connection_attempts",
+			Help: "Inbound connection attempts observed in captured packets by result",
+		}, []string{"result"})
+
+	// ConfigReloads is a counter for the number of configuration reloads by result
+	ConfigReloads = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "config_reloads",
+			Help: "Configuration reloads triggered by SIGHUP by result",
+		}, []string{"result"})
+
+	// BlockedHosts is a gauge for the number of remote hosts and networks currently blocked by reason
+	BlockedHosts = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "blocked_hosts",
+			Help: "Remote hosts and networks currently blocked by reason",
+		}, []string{"reason"})
+
+	// WouldBlock is a counter for the verdicts that would have blocked a remote host in monitor mode by reason
+	WouldBlock = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "would_block_hosts",
+			Help: "Remote hosts that would have been blocked in monitor mode by reason",
+		}, []string{"reason"})
+
+	// BlockErrors is a counter for the failures to block a remote host by kind
+	BlockErrors = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "block_errors",
+			Help: "Failures to block a remote host by kind",
+		}, []string{"kind"})
+
+	// ExpiredBlocks is a counter for the number of blocks removed after their block TTL
+	ExpiredBlocks = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "expired_blocks",
+			Help: "Blocks removed after their block TTL expired",
+		})
+
+	// Verdicts is a counter for the verdicts of the detectors by reason and severity, before verdicts of the same host
+	// are merged
+	Verdicts = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "detector_verdicts",
+			Help: "Verdicts to block a remote host by detector reason and severity",
+		}, []string{"reason", "severity"})
+
+	// RiskScore is a gauge for the risk score of every remote host scored by the score detector, a host is removed once
+	// it is blocked or its score has decayed away
+	RiskScore = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "host_risk_score",
+			Help: "Decaying risk score of a remote host",
+		}, []string{"remote_ip"})
+
+	// ReconcileDrift is a counter for the differences found between the firewall and the blocked hosts by kind, orphan
+	// blocks that were removed or missing blocks that were restored
+	ReconcileDrift = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "firewall_drift",
+			Help: "Differences found reconciling the firewall with the blocked hosts by kind",
+		}, []string{"kind"})
 )
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rcanderson23/connectionWatcher/config"
+	"github.com/rcanderson23/connectionWatcher/connections"
+	"github.com/rcanderson23/connectionWatcher/metrics"
+)
+
+// reload re-reads the configuration from the config file, environment and the args main was started with. A valid
+// configuration has its runtime settings applied to cw, the denylist and the tickers and is returned, otherwise cfg is
+// kept. Hosts that are blocked stay blocked either way, unless they are allowlisted or no longer denylisted.
+func reload(cfg config.Config, cw *connections.ConnectionWatcher, denylist *connections.Denylist, ticker, reconcileTicker, denylistTicker *time.Ticker) config.Config {
+	next, _, err := config.Load(os.Args[0], os.Args[1:], os.LookupEnv)
+	if err != nil {
+		log.Printf("Failed to reload configuration, keeping previous configuration: %v", err)
+		metrics.ConfigReloads.WithLabelValues("failure").Inc()
+		return cfg
+	}
+
+	next, restart := cfg.Reload(next)
+	if len(restart) > 0 {
+		log.Printf("Configuration changes to %s require a restart and were not applied", strings.Join(restart, ", "))
+	}
+
+	allowlist, err := next.NewAllowlist()
+	if err != nil {
+		log.Printf("Failed to reload configuration, keeping previous configuration: %v", err)
+		metrics.ConfigReloads.WithLabelValues("failure").Inc()
+		return cfg
+	}
+
+	// the blocker goes first as moving its rules can fail, the detector names have been validated by config.Load
+	if err := cw.Blocker.Reconfigure(next.Blocker()); err != nil {
+		log.Printf("Failed to reload configuration, keeping previous configuration: %v", err)
+		metrics.ConfigReloads.WithLabelValues("failure").Inc()
+		return cfg
+	}
+
+	if err := cw.Detection.Configure(next.Detection()); err != nil {
+		log.Printf("Failed to reload configuration, keeping previous configuration: %v", err)
+		metrics.ConfigReloads.WithLabelValues("failure").Inc()
+		return cfg
+	}
+
+	// interface addresses and gateways are read again, and hosts that were allowlisted are unblocked
+	cw.Allowlist = allowlist
+	cw.Blocker.Allowlist = allowlist
+	cw.Detection.SetAllowlist(allowlist)
+	cw.Blocker.UnblockAllowlisted()
+
+	denylist.Paths = next.Denylist
+	updateDenylist(cw.Blocker, cw.Detection, denylist, time.Now().Unix())
+
+	cw.SetEphemeralPorts(next.EphemeralPorts())
+	ticker.Reset(next.WaitPeriod)
+	reconcileTicker.Reset(next.ReconcileInterval)
+	denylistTicker.Reset(next.DenylistInterval)
+
+	log.Printf("Reloaded configuration")
+	metrics.ConfigReloads.WithLabelValues("success").Inc()
+	return next
+}
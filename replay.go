@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/rcanderson23/connectionWatcher/capture"
+	"github.com/rcanderson23/connectionWatcher/config"
+	"github.com/rcanderson23/connectionWatcher/connections"
+)
+
+// runReplay implements the replay subcommand. Either connection attempts in a pcap or pcapng file, or the polls of a
+// snapshot archive made with -record, are driven through the detectors with a clock simulated from the recorded
+// timestamps, printing every host that would have been blocked. There is no IPBlocker, so replaying never blocks
+// anything on the host running it.
+// The same config file, environment and flags as the main command apply, pcap files are checked every wait period.
+func runReplay(args []string) error {
+	cfg, files, err := config.Load("replay", args, os.LookupEnv)
+	if err == flag.ErrHelp {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(files) != 1 {
+		return errors.New("usage: replay [flags] <file.pcap|file.pcapng|archive>")
+	}
+
+	f, err := os.Open(files[0])
+	if err != nil {
+		return fmt.Errorf("failed to open file: %v", err)
+	}
+	defer f.Close()
+
+	allowlist, err := cfg.NewAllowlist()
+	if err != nil {
+		return err
+	}
+
+	br := bufio.NewReader(f)
+	magic, _ := br.Peek(len(connections.ArchiveMagic))
+	archive := string(magic) == connections.ArchiveMagic
+
+	// connections are only captured when replaying a pcap file, and the archive of a capturing run has every new
+	// connection its source observed
+	detectorConfig := cfg.Detection()
+	detectorConfig.Capture = !archive
+	detection, err := connections.NewDetection(detectorConfig)
+	if err != nil {
+		return err
+	}
+	detection.Allowlist = allowlist
+
+	if archive {
+		return replayArchive(br, detection, allowlist, cfg.EphemeralPorts())
+	}
+	return replayCapture(br, detection, allowlist, cfg.WaitPeriod)
+}
+
+// replayCapture replays a pcap or pcapng file, checking for hosts to block every period of capture time
+func replayCapture(r io.Reader, detection *connections.Detection, allowlist *connections.Allowlist, period time.Duration) error {
+	pr, err := capture.NewReader(r)
+	if err != nil {
+		return err
+	}
+
+	var blocked int
+	handled, err := capture.ReplayWithClock(pr, capture.NewTracker(detection), period, func(now time.Time) {
+		blocked += checkHosts(detection, allowlist, now.Unix())
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("replayed %d tcp packets, %d hosts would have been blocked\n", handled, blocked)
+	return nil
+}
+
+// replayArchive replays a snapshot archive, observing every poll at its recorded time like the main loop. Directions are
+// classified with the ephemeral port range recorded in the archive unless ephemeral overrides it.
+func replayArchive(r io.Reader, detection *connections.Detection, allowlist *connections.Allowlist, ephemeral connections.PortRange) error {
+	ar, err := connections.NewArchiveReader(r)
+	if err != nil {
+		return err
+	}
+	if ephemeral == (connections.PortRange{}) {
+		ephemeral = ar.Ephemeral
+	}
+
+	source := connections.NewArchiveSource(ar)
+	cw := connections.NewConnectionWatcher(source, nil, ephemeral)
+	cw.Detection = detection
+	cw.Allowlist = allowlist
+
+	var polls, blocked int
+	for {
+		t, err := source.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		cw.Observe(t)
+		blocked += checkHosts(detection, allowlist, t)
+		polls++
+	}
+
+	fmt.Printf("replayed %d polls, %d hosts would have been blocked\n", polls, blocked)
+	return nil
+}
+
+// checkHosts runs the detectors at unix time t, prints the hosts that would be blocked and returns how many.
+// Allowlisted hosts are never blocked.
+func checkHosts(detection *connections.Detection, allowlist *connections.Allowlist, t int64) int {
+	var blocked int
+	for _, v := range detection.Verdicts(t) {
+		if allowlist.Contains(v.Host.RemoteIP) {
+			continue
+		}
+		fmt.Printf("%s would block %s\n", time.Unix(t, 0).UTC().Format(time.RFC3339), v.String())
+		blocked++
+	}
+	return blocked
+}